@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
 )
 
 // api server handler func type
@@ -41,6 +47,22 @@ func (s *APIServer) Run() error {
 	// TODO: retrieve files
 	s.mux.HandleFunc("GET /read", s.handler(s.read))
 
+	// delete files across the network
+	s.mux.HandleFunc("DELETE /delete", s.handler(s.delete))
+
+	// list and describe records held by this node
+	s.mux.HandleFunc("GET /records", s.handler(s.records))
+	s.mux.HandleFunc("GET /metadata", s.handler(s.metadata))
+
+	// list the versions of a record
+	s.mux.HandleFunc("GET /history", s.handler(s.history))
+
+	// report the integrity checks of stored objects
+	s.mux.HandleFunc("GET /scrub", s.handler(s.scrub))
+
+	// remove objects no record refers to | report them on a dry run
+	s.mux.HandleFunc("POST /gc", s.handler(s.gc))
+
 	// start and listen api server
 	return http.ListenAndServe(s.ListenAddr, s.mux)
 }
@@ -61,14 +83,43 @@ func (s *APIServer) handler(fn APIFunc) http.HandlerFunc {
 }
 
 func (s *APIServer) write(w http.ResponseWriter, r *http.Request) error {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "key not found", http.StatusBadRequest)
+		return nil
+	}
+
+	opts := StoreFileOpts{
+		ContentType: r.Header.Get("Content-Type"),
+		Owner:       r.URL.Query().Get("owner"),
+		PatientID:   r.URL.Query().Get("patient"),
+	}
+
+	// optional hex encoded public key to seal the record to
+	if recipient := r.URL.Query().Get("recipient"); recipient != "" {
+		b, err := hex.DecodeString(strings.TrimPrefix(recipient, "0x"))
+		if err != nil {
+			http.Error(w, "invalid recipient public key", http.StatusBadRequest)
+			return nil
+		}
+
+		opts.Recipient, err = ethcrypto.UnmarshalPubkey(b)
+		if err != nil {
+			http.Error(w, "invalid recipient public key", http.StatusBadRequest)
+			return nil
+		}
+	}
 
-	err := s.localNode.Store("12345", r.Body)
+	digest, err := s.localNode.StoreWithOpts(key, r.Body, opts)
 	if err != nil {
 		http.Error(w, "failed to write data", http.StatusInternalServerError)
 		return nil
 	}
 
-	return writeJSON(w, map[string]string{"message": "data written successfully"})
+	return writeJSON(w, map[string]string{
+		"message": "data written successfully",
+		"digest":  digest,
+	})
 }
 
 func (s *APIServer) read(w http.ResponseWriter, r *http.Request) error {
@@ -78,19 +129,181 @@ func (s *APIServer) read(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	n, reader, err := s.localNode.Get(key[0])
+	// the latest version unless a version is asked for
+	open := s.localNode.Open
+	if version := r.URL.Query().Get("version"); version != "" {
+		v, err := strconv.Atoi(version)
+		if err != nil || v <= 0 {
+			http.Error(w, "invalid version", http.StatusBadRequest)
+			return nil
+		}
+
+		open = func(key string) (io.ReadSeekCloser, Metadata, error) {
+			return s.localNode.OpenVersion(key, v)
+		}
+	}
+
+	f, meta, err := open(key[0])
+	if errors.Is(err, ErrNoVersion) || errors.Is(err, ErrFileNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return nil
 	}
-	b := make([]byte, n)
-	_, err = reader.Read(b)
+	defer f.Close()
+
+	// the content type is sniffed if the record has none
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+
+	// versions are immutable so the digest identifies the content
+	w.Header().Set("ETag", `"`+meta.Digest+`"`)
+
+	// streams the file answering Range and conditional requests
+	http.ServeContent(w, r, "", meta.CreatedAt, f)
+	return nil
+}
+
+func (s *APIServer) delete(w http.ResponseWriter, r *http.Request) error {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "key not found", http.StatusBadRequest)
+		return nil
+	}
+
+	// deletions must say why | e.g. a right to erasure request
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		http.Error(w, "reason not found", http.StatusBadRequest)
+		return nil
+	}
+
+	t, err := s.localNode.Delete(key, reason)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return nil
 	}
-	_, err = w.Write(b)
-	return err
+
+	return writeJSON(w, map[string]any{
+		"message":    "data deleted successfully",
+		"deleter":    t.Deleter,
+		"reason":     t.Reason,
+		"deleted_at": t.DeletedAt,
+	})
+}
+
+func (s *APIServer) records(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+
+	q := MetadataQuery{
+		Owner:     query.Get("owner"),
+		PatientID: query.Get("patient"),
+		Prefix:    query.Get("prefix"),
+		After:     query.Get("after"),
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return nil
+		}
+		q.Limit = n
+	}
+
+	records, err := s.localNode.List(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	// a full page may be followed by more records
+	next := ""
+	if len(records) != 0 && len(records) == q.limit() {
+		next = records[len(records)-1].Key
+	}
+
+	return writeJSON(w, map[string]any{
+		"records": records,
+		"next":    next,
+	})
+}
+
+func (s *APIServer) metadata(w http.ResponseWriter, r *http.Request) error {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "key not found", http.StatusBadRequest)
+		return nil
+	}
+
+	meta, err := s.localNode.Metadata(key)
+	if errors.Is(err, ErrNoMetadata) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	return writeJSON(w, map[string]any{
+		"metadata":          meta,
+		"replication_state": meta.ReplicationState(),
+	})
+}
+
+func (s *APIServer) history(w http.ResponseWriter, r *http.Request) error {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "key not found", http.StatusBadRequest)
+		return nil
+	}
+
+	versions, err := s.localNode.History(key)
+	if errors.Is(err, ErrFileNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	return writeJSON(w, map[string]any{
+		"key":      key,
+		"versions": versions,
+	})
+}
+
+func (s *APIServer) scrub(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, map[string]any{
+		"scrub": s.localNode.ScrubStats(),
+	})
+}
+
+func (s *APIServer) gc(w http.ResponseWriter, r *http.Request) error {
+	var dryRun bool
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid dry_run", http.StatusBadRequest)
+			return nil
+		}
+		dryRun = b
+	}
+
+	report, err := s.localNode.CollectGarbage(dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	return writeJSON(w, map[string]any{
+		"gc": report,
+	})
 }
 
 func writeJSON(w io.Writer, v any) error {
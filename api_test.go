@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIReadRange(t *testing.T) {
+	node := NewFileServer(FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		ChunkSize:         1024,
+	})
+
+	data := bytes.Repeat([]byte("some dicom bytes "), 1000)
+	_, err := node.StoreWithOpts("study", bytes.NewReader(data), StoreFileOpts{
+		ContentType: "application/dicom",
+	})
+	assert.Nil(t, err)
+
+	api := NewAPIServer(APIServerOpts{localNode: node})
+
+	// partial download of a large attachment
+	req := httptest.NewRequest(http.MethodGet, "/read?key=study", nil)
+	req.Header.Set("Range", "bytes=5000-5999")
+	w := httptest.NewRecorder()
+	api.handler(api.read)(w, req)
+
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "application/dicom", w.Header().Get("Content-Type"))
+	assert.Equal(t, data[5000:6000], w.Body.Bytes())
+
+	// the whole file
+	req = httptest.NewRequest(http.MethodGet, "/read?key=study", nil)
+	w = httptest.NewRecorder()
+	api.handler(api.read)(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.Bytes())
+
+	// unchanged content is not sent again
+	req = httptest.NewRequest(http.MethodGet, "/read?key=study", nil)
+	req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	api.handler(api.read)(w, req)
+
+	assert.Equal(t, http.StatusNotModified, w.Code)
+}
+
+func TestAPIWrite(t *testing.T) {
+	node := NewFileServer(FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	api := NewAPIServer(APIServerOpts{localNode: node})
+
+	// records are written under the key they are asked for
+	data := []byte("some ehr bytes")
+	req := httptest.NewRequest(http.MethodPost, "/write?key=ehr", bytes.NewReader(data))
+	w := httptest.NewRecorder()
+	api.handler(api.write)(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var body map[string]string
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+	digest, err := node.store.Resolve("ehr")
+	assert.Nil(t, err)
+	assert.Equal(t, digest, body["digest"])
+
+	req = httptest.NewRequest(http.MethodPost, "/write", bytes.NewReader(data))
+	w = httptest.NewRecorder()
+	api.handler(api.write)(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAPIScrub(t *testing.T) {
+	node := NewFileServer(FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	digest, err := node.Store("record", bytes.NewReader([]byte("some ehr bytes")))
+	assert.Nil(t, err)
+
+	m, err := node.store.Manifest(digest)
+	assert.Nil(t, err)
+	path := node.store.Root + "/" + chunkKeyOf(t, node.store, digest, m.Chunks[0].Digest)
+	assert.Nil(t, os.WriteFile(path, []byte("some bad bytes"), 0o644))
+
+	node.Scrub()
+
+	api := NewAPIServer(APIServerOpts{localNode: node})
+	req := httptest.NewRequest(http.MethodGet, "/scrub", nil)
+	w := httptest.NewRecorder()
+	api.handler(api.scrub)(w, req)
+
+	var report struct {
+		Scrub ScrubStats
+	}
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&report))
+	assert.Equal(t, uint64(1), report.Scrub.ObjectsScrubbed)
+	assert.Equal(t, uint64(1), report.Scrub.Corrupt)
+
+	// no peer holds a healthy copy
+	assert.Equal(t, uint64(0), report.Scrub.Repaired)
+	assert.Equal(t, uint64(1), report.Scrub.Failures)
+}
+
+func TestAPIGarbageCollection(t *testing.T) {
+	node := NewFileServer(FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	_, err := node.Store("record", bytes.NewReader([]byte("some ehr bytes")))
+	assert.Nil(t, err)
+
+	api := NewAPIServer(APIServerOpts{localNode: node})
+	req := httptest.NewRequest(http.MethodPost, "/gc?dry_run=true", nil)
+	w := httptest.NewRecorder()
+	api.handler(api.gc)(w, req)
+
+	var report struct {
+		GC GCReport
+	}
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&report))
+	assert.True(t, report.GC.DryRun)
+	assert.Empty(t, report.GC.Objects)
+
+	req = httptest.NewRequest(http.MethodPost, "/gc?dry_run=maybe", nil)
+	w = httptest.NewRecorder()
+	api.handler(api.gc)(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// BlobStore holds the content of stored objects | their manifests
+// and chunks | under slash separated keys
+// the store keeps key mappings, tombstones, metadata and writes
+// in progress on local disk whatever the BlobStore
+type BlobStore interface {
+	// Has reports whether a blob with key exists
+	Has(key string) (bool, error)
+
+	// Stat returns the size of the blob with key
+	// fails with os.ErrNotExist if there is none
+	Stat(key string) (BlobInfo, error)
+
+	// Open opens the blob with key for reading
+	// fails with os.ErrNotExist if there is none
+	Open(key string) (io.ReadCloser, error)
+
+	// Write stores the content of r under key replacing any blob with key
+	// the blob is never seen partially written
+	// returns written bytes size (int64) | error
+	Write(key string, r io.Reader) (int64, error)
+
+	// Delete removes the blob with key
+	// deleting a blob that does not exist is not an error
+	Delete(key string) error
+
+	// List returns the keys starting with prefix in lexical order
+	List(prefix string) ([]string, error)
+}
+
+// BlobInfo describes a blob
+type BlobInfo struct {
+	Key string
+
+	// blob size in bytes
+	Size int64
+}
+
+// blobImporter is implemented by blob stores that take over
+// a local file as a blob without copying it
+type blobImporter interface {
+	// Import moves the file at path to the blob with key
+	Import(key string, path string) error
+}
+
+// blobPrefixDeleter is implemented by blob stores that remove
+// every blob under a prefix at once
+type blobPrefixDeleter interface {
+	// DeletePrefix removes every blob whose key starts with prefix
+	// prefix is empty or ends with a slash
+	DeletePrefix(prefix string) error
+}
+
+// blobDirPruner is implemented by blob stores keeping blobs in folders
+type blobDirPruner interface {
+	// PruneDirs removes the folders holding no blobs deepest first
+	// only folders whose key owned accepts are visited
+	// folders are listed but not removed on a dry run
+	// returns the keys of the removed folders ([]string) | error
+	PruneDirs(owned func(dir string) bool, dryRun bool) ([]string, error)
+}
+
+// FSBlobStore keeps every blob as a file under Root
+// the key is the file path relative to Root
+type FSBlobStore struct {
+	Root string
+
+	// blobs are written to a temporary file in tmp
+	// and renamed into place
+	tmp string
+}
+
+// create new filesystem blob store rooted at root
+// temporary files are written to root/tmpFolder
+// return *FSBlobStore
+func NewFSBlobStore(root string) *FSBlobStore {
+	return &FSBlobStore{
+		Root: root,
+		tmp:  root + "/" + tmpFolder,
+	}
+}
+
+// returns the path of the file holding the blob with key
+func (b *FSBlobStore) path(key string) (string, error) {
+	// keys end up in paths
+	if !fs.ValidPath(key) {
+		return "", fmt.Errorf("invalid blob key (%s)", key)
+	}
+	return b.Root + "/" + key, nil
+}
+
+func (b *FSBlobStore) Has(key string) (bool, error) {
+	_, err := b.Stat(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *FSBlobStore) Stat(key string) (BlobInfo, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	return BlobInfo{Key: key, Size: stat.Size()}, nil
+}
+
+func (b *FSBlobStore) Open(key string) (io.ReadCloser, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+func (b *FSBlobStore) Write(key string, r io.Reader) (int64, error) {
+	if _, err := b.path(key); err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(b.tmp, os.ModePerm); err != nil {
+		return 0, err
+	}
+
+	f, err := os.CreateTemp(b.tmp, "blob-")
+	if err != nil {
+		return 0, err
+	}
+
+	// remove temporary file on failure
+	// after a successful rename this is a no-op
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+
+	// the content must be on disk before the rename is
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return n, err
+	}
+
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+
+	return n, b.Import(key, f.Name())
+}
+
+func (b *FSBlobStore) Import(key string, file string) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file, path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+func (b *FSBlobStore) Delete(key string) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (b *FSBlobStore) DeletePrefix(prefix string) error {
+	if len(prefix) != 0 && (!strings.HasSuffix(prefix, "/") || !fs.ValidPath(strings.TrimSuffix(prefix, "/"))) {
+		return fmt.Errorf("invalid blob prefix (%s)", prefix)
+	}
+
+	return os.RemoveAll(b.Root + "/" + prefix)
+}
+
+func (b *FSBlobStore) PruneDirs(owned func(dir string) bool, dryRun bool) ([]string, error) {
+	pruned := []string{}
+
+	// returns whether the folder with key dir is empty once
+	// the empty folders below it are removed
+	var prune func(dir string) (bool, error)
+	prune = func(dir string) (bool, error) {
+		entries, err := readDir(b.Root + "/" + dir)
+		if err != nil {
+			return false, err
+		}
+
+		empty := true
+		for _, entry := range entries {
+			key := path.Join(dir, entry.Name())
+			if !entry.IsDir() || !owned(key) {
+				empty = false
+				continue
+			}
+
+			ok, err := prune(key)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				empty = false
+				continue
+			}
+
+			if !dryRun {
+				// a blob written meanwhile keeps its folder
+				err := os.Remove(b.Root + "/" + key)
+				if errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, os.ErrExist) {
+					empty = false
+					continue
+				}
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					return false, err
+				}
+			}
+			pruned = append(pruned, key)
+		}
+
+		return empty, nil
+	}
+
+	// the root folder itself is kept
+	_, err := prune("")
+	return pruned, err
+}
+
+func (b *FSBlobStore) List(prefix string) ([]string, error) {
+	// only the folder holding the prefix is walked
+	dir := b.Root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		if !fs.ValidPath(prefix[:i]) {
+			return nil, fmt.Errorf("invalid blob prefix (%s)", prefix)
+		}
+		dir += "/" + prefix[:i]
+	}
+
+	keys := []string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.Root, p)
+		if err != nil {
+			return err
+		}
+
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+
+	sort.Strings(keys)
+	return keys, err
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// objects are split into chunks of at most ChunkSize bytes
+// the object digest path holds a manifest listing the chunks in order
+// and the chunks are stored under the object digest in chunksFolder
+// both are blobs of the store BlobStore | chunks of objects still
+// being written or received are kept on local disk
+const (
+	// chunksFolder holds the chunks of every object
+	chunksFolder = "chunks"
+
+	// partialFolder holds the chunks of objects still being received
+	// so an interrupted transfer resumes where it stopped
+	partialFolder = "partial"
+
+	// default size of the chunks objects are split into
+	defaultChunkSize = 4 << 20
+
+	// largest chunk accepted from peers
+	maxChunkSize = 64 << 20
+)
+
+// Chunk is a piece of an object
+type Chunk struct {
+
+	// SHA-256 digest of the chunk content
+	Digest string
+
+	// chunk size in bytes
+	Size int64
+}
+
+// Manifest lists the chunks an object is made of
+type Manifest struct {
+
+	// SHA-256 digest of the object content
+	Digest string
+
+	// object size in bytes
+	Size int64
+
+	// compression every chunk is stored with | CompressionNone if empty
+	// chunk digests and sizes are those of the uncompressed content
+	Compression string
+
+	// chunks in content order
+	Chunks []Chunk
+
+	// when the object was last written or linked on this node
+	// garbage collection keeps objects written within its grace period
+	Written time.Time
+}
+
+// validate checks a manifest received from a peer
+func (m Manifest) validate() error {
+	if !isSHA256Hex(m.Digest) {
+		return fmt.Errorf("invalid manifest digest (%s)", m.Digest)
+	}
+
+	if err := checkCompression(m.Compression); err != nil {
+		return err
+	}
+
+	var size int64
+	for i, c := range m.Chunks {
+		if !isSHA256Hex(c.Digest) || c.Size <= 0 || c.Size > maxChunkSize {
+			return fmt.Errorf("invalid chunk %d in manifest of (%s)", i, m.Digest)
+		}
+		size += c.Size
+	}
+
+	if size != m.Size {
+		return fmt.Errorf("chunks of (%s) add up to %d bytes not %d", m.Digest, size, m.Size)
+	}
+
+	return nil
+}
+
+// Manifest returns the manifest of the object with digest
+func (s *Store) Manifest(digest string) (Manifest, error) {
+	key, err := s.manifestKey(digest)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	_, r, err := s.openBlob(key)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer r.Close()
+
+	// fails if an encrypted manifest has been tampered with
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("reading manifest of (%s): %w", digest, err)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return Manifest{}, fmt.Errorf("reading manifest of (%s): %w", digest, err)
+	}
+
+	return m, nil
+}
+
+// ReadChunk reads the chunk with digest chunk of the object with digest
+// as it is stored | compressed with the compression of the object
+// returns stored chunk size (int64) | reader (io.ReadCloser) | error
+func (s *Store) ReadChunk(digest string, chunk string) (int64, io.ReadCloser, error) {
+	// digests come from peers and end up in paths
+	if !isSHA256Hex(digest) || !isSHA256Hex(chunk) {
+		return 0, nil, fmt.Errorf("invalid chunk (%s) of (%s)", chunk, digest)
+	}
+
+	return s.storedChunks(digest)(chunk)
+}
+
+// WriteChunk writes chunk c of the object with digest
+// received from a peer until the object is committed
+// r holds the chunk compressed with compression which must be
+// the compression of the manifest the object is committed with
+// the uncompressed content must hash to c.Digest
+func (s *Store) WriteChunk(digest string, c Chunk, compression string, r io.Reader) error {
+	if !isSHA256Hex(digest) || !isSHA256Hex(c.Digest) {
+		return fmt.Errorf("invalid chunk (%s) of (%s)", c.Digest, digest)
+	}
+
+	dir := s.partialDir(digest)
+
+	held, err := s.HasDigest(digest)
+	if err != nil {
+		return err
+	}
+
+	// chunks held already are not written twice
+	_, err = os.Stat(dir + "/" + c.Digest)
+	if held || err == nil {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	plain, err := decompress(r, compression)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+
+	if _, err := s.writeChunk(dir, io.LimitReader(plain, c.Size), compression, c.Digest); err != nil {
+		return err
+	}
+
+	// read what is left of the stream after the content
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// MissingChunks returns the indexes of the chunks of m
+// that have not been received yet
+// chunks with the same content are only listed once
+func (s *Store) MissingChunks(m Manifest) ([]int, error) {
+	if !isSHA256Hex(m.Digest) {
+		return nil, fmt.Errorf("invalid manifest digest (%s)", m.Digest)
+	}
+
+	held, err := s.HasDigest(m.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if held {
+		return nil, nil
+	}
+
+	dir := s.partialDir(m.Digest)
+	listed := make(map[string]bool)
+
+	missing := []int{}
+	for i, c := range m.Chunks {
+		if listed[c.Digest] {
+			continue
+		}
+
+		_, err := os.Stat(dir + "/" + c.Digest)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		listed[c.Digest] = true
+		missing = append(missing, i)
+	}
+
+	return missing, nil
+}
+
+// CommitManifest stores the object described by m once
+// all its chunks have been received
+// fails with ErrDigestMismatch if the chunks do not hash to m.Digest
+func (s *Store) CommitManifest(m Manifest) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+
+	missing, err := s.MissingChunks(m)
+	if err != nil {
+		return err
+	}
+
+	if len(missing) != 0 {
+		return fmt.Errorf("%d chunks of (%s) not received", len(missing), m.Digest)
+	}
+
+	held, err := s.HasDigest(m.Digest)
+	if err != nil {
+		return err
+	}
+	if held {
+		return s.touch(m.Digest)
+	}
+
+	dir := s.partialDir(m.Digest)
+
+	// every chunk was verified when it was written
+	// the manifest must describe the object it claims to
+	hash := sha256.New()
+	r := newChunkReader(s.receivedChunks(dir), m)
+	_, err = io.Copy(hash, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	if digest := hex.EncodeToString(hash.Sum(nil)); digest != m.Digest {
+		os.RemoveAll(dir)
+		return fmt.Errorf("%w: expected %s got %s", ErrDigestMismatch, m.Digest, digest)
+	}
+
+	return s.commit(dir, m)
+}
+
+// store the chunks in dir as blobs and write manifest m
+// an object exists once its manifest does so the manifest is written last
+func (s *Store) commit(dir string, m Manifest) error {
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+
+	// identical content is stored once
+	held, err := s.HasDigest(m.Digest)
+	if err != nil {
+		return err
+	}
+	if held {
+		if err := s.touchLocked(m.Digest); err != nil {
+			return err
+		}
+		return os.RemoveAll(dir)
+	}
+
+	key, err := s.manifestKey(m.Digest)
+	if err != nil {
+		return err
+	}
+
+	prefix, err := s.chunkPrefix(m.Digest)
+	if err != nil {
+		return err
+	}
+
+	// drop chunks left behind by an interrupted commit
+	if err := s.deletePrefix(prefix); err != nil {
+		return err
+	}
+
+	// chunks with the same content are stored once
+	stored := make(map[string]bool)
+	for _, c := range m.Chunks {
+		if stored[c.Digest] {
+			continue
+		}
+
+		if err := s.putBlob(prefix+c.Digest, dir+"/"+c.Digest); err != nil {
+			return err
+		}
+		stored[c.Digest] = true
+	}
+
+	m.Written = time.Now().UTC()
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if err := s.writeBlob(key, b); err != nil {
+		return err
+	}
+	s.usage += m.Size
+
+	return os.RemoveAll(dir)
+}
+
+// write chunk read from r to dir under the digest of its content
+// the chunk is compressed with compression before it is encrypted
+// if expected is not empty the computed digest must match it
+// returns the written Chunk | a zero Chunk if r is empty | error
+func (s *Store) writeChunk(dir string, r io.Reader, compression string, expected string) (Chunk, error) {
+	f, err := os.CreateTemp(dir, "chunk-")
+	if err != nil {
+		return Chunk{}, err
+	}
+
+	// remove temporary file on failure
+	// after a successful rename this is a no-op
+	defer os.Remove(f.Name())
+
+	// encrypt chunk before it reaches the disk
+	w, err := s.encryptTo(f)
+	if err != nil {
+		f.Close()
+		return Chunk{}, err
+	}
+
+	// compress chunk before it is encrypted
+	cw, err := compress(w, compression)
+	if err != nil {
+		f.Close()
+		return Chunk{}, err
+	}
+
+	// digest is computed over the plaintext content
+	hash := sha256.New()
+
+	n, err := io.Copy(io.MultiWriter(cw, hash), r)
+	if err != nil {
+		f.Close()
+		return Chunk{}, err
+	}
+
+	// flush the compressed stream and the last encrypted segment
+	if err := cw.Close(); err != nil {
+		f.Close()
+		return Chunk{}, err
+	}
+
+	if err := w.Close(); err != nil {
+		f.Close()
+		return Chunk{}, err
+	}
+
+	// the chunk must be on disk before its manifest is
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return Chunk{}, err
+	}
+
+	if err := f.Close(); err != nil {
+		return Chunk{}, err
+	}
+
+	digest := hex.EncodeToString(hash.Sum(nil))
+
+	// verify content against expected digest
+	if len(expected) != 0 && expected != digest {
+		return Chunk{}, fmt.Errorf("%w: expected %s got %s", ErrDigestMismatch, expected, digest)
+	}
+
+	if n == 0 {
+		return Chunk{}, nil
+	}
+
+	if err := os.Rename(f.Name(), dir+"/"+digest); err != nil {
+		return Chunk{}, err
+	}
+
+	return Chunk{Digest: digest, Size: n}, nil
+}
+
+// chunkOpener opens the chunk with digest chunk of an object
+// decrypted but still compressed
+// returns stored chunk size (int64) | reader (io.ReadCloser) | error
+type chunkOpener func(chunk string) (int64, io.ReadCloser, error)
+
+// returns opener of the stored chunks of the object with digest
+func (s *Store) storedChunks(digest string) chunkOpener {
+	return func(chunk string) (int64, io.ReadCloser, error) {
+		key, err := s.chunkKey(digest, chunk)
+		if err != nil {
+			return 0, nil, err
+		}
+		return s.openBlob(key)
+	}
+}
+
+// returns opener of the chunks received into folder dir
+func (s *Store) receivedChunks(dir string) chunkOpener {
+	return func(chunk string) (int64, io.ReadCloser, error) {
+		return s.openFile(dir + "/" + chunk)
+	}
+}
+
+// open chunk with open decompressing it with compression
+// returns reader over the chunk content (io.ReadCloser) | error
+func openChunk(open chunkOpener, chunk string, compression string) (io.ReadCloser, error) {
+	_, f, err := open(chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	if compression == CompressionNone {
+		return f, nil
+	}
+
+	r, err := decompress(f, compression)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("decompressing (%s): %w", chunk, err)
+	}
+
+	return readCloser{r, f}, nil
+}
+
+// returns the key prefix of the chunks of the object with digest
+func (s *Store) chunkPrefix(digest string) (string, error) {
+	pathKey, err := s.PathTransformFunc(digest)
+	if err != nil {
+		return "", err
+	}
+	return chunksFolder + "/" + pathKey.FullPath() + "/", nil
+}
+
+// returns the key of chunk of the object with digest
+func (s *Store) chunkKey(digest string, chunk string) (string, error) {
+	prefix, err := s.chunkPrefix(digest)
+	if err != nil {
+		return "", err
+	}
+	return prefix + chunk, nil
+}
+
+// returns the folder holding the received chunks of the object with digest
+func (s *Store) partialDir(digest string) string {
+	return s.Root + "/" + tmpFolder + "/" + partialFolder + "/" + digest
+}
+
+// chunkReader reads chunks opened with open as a single file
+// only the chunk being read is open
+type chunkReader struct {
+	open   chunkOpener
+	chunks []Chunk
+
+	// compression the chunks are stored with
+	compression string
+
+	// offset of every chunk in the file
+	offsets []int64
+
+	// file size
+	size int64
+
+	// offset of the next read
+	pos int64
+
+	// chunk being read and the offset it ends at
+	// cur is nil until the next read
+	cur io.ReadCloser
+	end int64
+}
+
+func newChunkReader(open chunkOpener, m Manifest) *chunkReader {
+	r := &chunkReader{
+		open:        open,
+		chunks:      m.Chunks,
+		compression: m.Compression,
+		offsets:     make([]int64, len(m.Chunks)),
+	}
+
+	for i, c := range m.Chunks {
+		r.offsets[i] = r.size
+		r.size += c.Size
+	}
+
+	return r
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.cur == nil {
+		if err := r.openChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	// never read past the chunk into the next one
+	if left := r.end - r.pos; int64(len(b)) > left {
+		b = b[:left]
+	}
+
+	n, err := r.cur.Read(b)
+	r.pos += int64(n)
+
+	if r.pos == r.end {
+		// move on to the next chunk
+		r.cur.Close()
+		r.cur = nil
+		return n, nil
+	}
+
+	if errors.Is(err, io.EOF) {
+		return n, fmt.Errorf("chunk ending at %d: %w", r.end, io.ErrUnexpectedEOF)
+	}
+
+	return n, err
+}
+
+// open the chunk holding the read offset
+// positioned at the read offset
+func (r *chunkReader) openChunk() error {
+	i := sort.Search(len(r.offsets), func(i int) bool {
+		return r.offsets[i] > r.pos
+	}) - 1
+
+	c := r.chunks[i]
+	f, err := openChunk(r.open, c.Digest, r.compression)
+	if err != nil {
+		return err
+	}
+
+	// plaintext chunks are seeked | encrypted or compressed
+	// ones are read up to the offset
+	if skip := r.pos - r.offsets[i]; skip > 0 {
+		if seeker, ok := f.(io.Seeker); ok {
+			_, err = seeker.Seek(skip, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, f, skip)
+		}
+
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	r.cur, r.end = f, r.offsets[i]+c.Size
+	return nil
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+
+	// the chunk holding the new offset is opened on the next read
+	if offset != r.pos && r.cur != nil {
+		r.cur.Close()
+		r.cur = nil
+	}
+
+	r.pos = offset
+	return offset, nil
+}
+
+// Close closes the chunk being read
+func (r *chunkReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
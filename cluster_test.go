@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/luqxus/dstore/contract"
+	"github.com/luqxus/dstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// starts n fully connected servers on an in memory network
+// every node is registered in an in memory contract and
+// authenticates its peers with the default handshake
+// configure may adjust the options of every server
+func makeMemoryCluster(t *testing.T, n int, opts p2p.MemoryNetworkOpts, configure ...func(*FileServerOpts)) (*p2p.MemoryNetwork, []*FileServer) {
+	network := p2p.NewMemoryNetwork(opts)
+	registry := contract.NewMemoryRegistry()
+
+	servers := make([]*FileServer, n)
+	addrs := make([]string, n)
+	joined := make([]*joinedNodes, n)
+	for i := range servers {
+		joined[i] = newJoinedNodes()
+
+		addrs[i] = fmt.Sprintf("node-%02d", i)
+		ks := newTestKeystore(t)
+		registry.Allow(ethcrypto.PubkeyToAddress(ks.key.PublicKey), addrs[i])
+
+		tr := p2p.NewMemoryTransport(network, p2p.TCPTransportOpts{
+			ListenAddr:    addrs[i],
+			HandshakeFunc: p2p.DefaultHandshakeFunc,
+			Keystore:      ks,
+			Contract:      registry.Contract(&ks.key.PublicKey),
+		})
+
+		serverOpts := FileServerOpts{
+			StorageRoot:       t.TempDir(),
+			PathTransformFunc: CASPathTransformFunc,
+			Keystore:          ks,
+			Transport:         tr,
+			BootstrapNodes:    append([]string(nil), addrs[:i]...),
+			RequestTimeout:    time.Second,
+		}
+		for _, fn := range configure {
+			fn(&serverOpts)
+		}
+
+		// placement is only stable once every node announced itself
+		hook := serverOpts.OnPeerEvent
+		serverOpts.OnPeerEvent = func(e PeerEvent) {
+			joined[i].observe(e)
+			if hook != nil {
+				hook(e)
+			}
+		}
+
+		servers[i] = NewFileServer(serverOpts)
+		tr.OnPeer = servers[i].OnPeer
+		tr.OnPeerDisconnect = servers[i].OnPeerDisconnect
+
+		go servers[i].Start()
+		t.Cleanup(func() { stopServer(servers[i]) })
+	}
+
+	for _, j := range joined {
+		j.wait(t, func(nodes map[string]bool) bool { return len(nodes) == n-1 })
+	}
+
+	return network, servers
+}
+
+// joinedNodes tracks the nodes a server reported joining
+// and not leaving again through its peer events
+type joinedNodes struct {
+	lock  sync.Mutex
+	nodes map[string]bool
+
+	// signaled after every change of nodes
+	changed chan struct{}
+}
+
+func newJoinedNodes() *joinedNodes {
+	return &joinedNodes{
+		nodes:   make(map[string]bool),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+func (j *joinedNodes) observe(e PeerEvent) {
+	j.lock.Lock()
+	switch e.Type {
+	case PeerJoined:
+		j.nodes[e.Node.Addr] = true
+	case PeerLeft:
+		delete(j.nodes, e.Node.Addr)
+	}
+	j.lock.Unlock()
+
+	select {
+	case j.changed <- struct{}{}:
+	default:
+	}
+}
+
+// waits until ready accepts the addresses of the joined nodes
+func (j *joinedNodes) wait(t *testing.T, ready func(map[string]bool) bool) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		j.lock.Lock()
+		ok := ready(j.nodes)
+		j.lock.Unlock()
+		if ok {
+			return
+		}
+
+		select {
+		case <-j.changed:
+		case <-timeout:
+			t.Fatalf("nodes never settled")
+		}
+	}
+}
+
+// returns the servers holding content with digest
+func holdersOf(t *testing.T, servers []*FileServer, digest string) []*FileServer {
+	holders := []*FileServer{}
+	for _, s := range servers {
+		if holds(t, s.store, digest) {
+			holders = append(holders, s)
+		}
+	}
+	return holders
+}
+
+// stops s and waits for its message loop to return
+// so nothing is written to its root after the test
+func stopServer(s *FileServer) {
+	s.Stop()
+	select {
+	case <-s.stopped:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+func TestClusterReplication(t *testing.T) {
+	_, servers := makeMemoryCluster(t, 20, p2p.MemoryNetworkOpts{Latency: time.Millisecond})
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("record-%d", i)
+		data := []byte("ehr bytes of " + key)
+
+		writer := servers[i*3]
+		digest, err := writer.Store(key, bytes.NewReader(data))
+		assert.Nil(t, err)
+
+		// the writer and the responsible peers hold a copy
+		responsible, _ := writer.placePeers(digest, defaultReplicationFactor)
+		assert.Eventually(t, func() bool {
+			return len(holdersOf(t, servers, digest)) == 1+len(responsible)
+		}, 2*time.Second, 10*time.Millisecond)
+
+		// any node serves the record
+		reader := servers[19-i]
+		n, r, err := reader.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(data)), n)
+
+		b, _ := io.ReadAll(r)
+		r.Close()
+		assert.Equal(t, data, b)
+	}
+}
+
+func TestClusterPartition(t *testing.T) {
+	network, servers := makeMemoryCluster(t, 6, p2p.MemoryNetworkOpts{})
+
+	data := []byte("some ehr bytes")
+	digest, _, err := servers[0].store.Write("record", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	// cut the only holder off from the rest
+	others := []string{}
+	for _, s := range servers[1:] {
+		others = append(others, s.Transport.Addr())
+	}
+	network.Partition([]string{servers[0].Transport.Addr()}, others)
+
+	_, _, err = servers[1].Get("record")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+
+	network.Heal()
+
+	_, r, err := servers[1].Get("record")
+	assert.Nil(t, err)
+
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, data, b)
+	assert.True(t, holds(t, servers[1].store, digest))
+}
+
+// returns the number of connected peers of s
+func peerCount(s *FileServer) int {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	return len(s.peers)
+}
+
+// waits for a peer event of type on events
+func waitPeerEvent(t *testing.T, events <-chan PeerEvent, typ PeerEventType) PeerEvent {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type == typ {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no peer %s event", typ)
+			return PeerEvent{}
+		}
+	}
+}
+
+func TestClusterPeerLeaves(t *testing.T) {
+	events := make(chan PeerEvent, 64)
+	_, servers := makeMemoryCluster(t, 3, p2p.MemoryNetworkOpts{}, func(opts *FileServerOpts) {
+		if len(opts.BootstrapNodes) == 0 {
+			opts.OnPeerEvent = func(e PeerEvent) { events <- e }
+		}
+	})
+
+	leaving := servers[2]
+	leaving.Stop()
+
+	// the remaining nodes drop the stopped node
+	event := waitPeerEvent(t, events, PeerLeft)
+	assert.Equal(t, leaving.self.ID, event.Node.ID)
+
+	assert.Eventually(t, func() bool {
+		return peerCount(servers[0]) == 1 && peerCount(servers[1]) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestClusterHalfOpenConnection(t *testing.T) {
+	events := make(chan PeerEvent, 64)
+	network, servers := makeMemoryCluster(t, 2, p2p.MemoryNetworkOpts{}, func(opts *FileServerOpts) {
+		opts.RequestTimeout = 50 * time.Millisecond
+		opts.HeartbeatInterval = 20 * time.Millisecond
+		opts.RedialBackoff = 20 * time.Millisecond
+		opts.MaxRedialBackoff = 100 * time.Millisecond
+		if len(opts.BootstrapNodes) != 0 {
+			opts.OnPeerEvent = func(e PeerEvent) { events <- e }
+		}
+	})
+
+	// heartbeats stop crossing the link | the connection stays open
+	network.Partition([]string{servers[0].Transport.Addr()}, []string{servers[1].Transport.Addr()})
+
+	event := waitPeerEvent(t, events, PeerLeft)
+	assert.Equal(t, servers[0].self.ID, event.Node.ID)
+	assert.Equal(t, 0, peerCount(servers[1]))
+
+	// the dialing node reconnects with backoff once the link is back
+	network.Heal()
+
+	event = waitPeerEvent(t, events, PeerJoined)
+	assert.Equal(t, servers[0].self.ID, event.Node.ID)
+	waitPeers(t, servers[0], 1)
+}
+
+func TestClusterMetadata(t *testing.T) {
+	_, servers := makeMemoryCluster(t, 3, p2p.MemoryNetworkOpts{})
+
+	data := []byte("some ehr bytes")
+	_, err := servers[0].StoreWithOpts("record", bytes.NewReader(data), StoreFileOpts{
+		ContentType: "application/fhir+json",
+		PatientID:   "patient-1",
+	})
+	assert.Nil(t, err)
+
+	// the writer knows every copy it made
+	meta, err := servers[0].Metadata("record")
+	assert.Nil(t, err)
+	assert.Equal(t, servers[0].self.ID, meta.Owner)
+	assert.Len(t, meta.Replicas, 3)
+	assert.Equal(t, ReplicationComplete, meta.ReplicationState())
+
+	// replicas index the record with the writer metadata
+	for _, s := range servers[1:] {
+		assert.Eventually(t, func() bool {
+			records, err := s.List(MetadataQuery{PatientID: "patient-1"})
+			return err == nil && len(records) == 1
+		}, 2*time.Second, 10*time.Millisecond)
+
+		meta, err := s.Metadata("record")
+		assert.Nil(t, err)
+		assert.Equal(t, "application/fhir+json", meta.ContentType)
+		assert.Equal(t, servers[0].self.ID, meta.Owner)
+		assert.Equal(t, int64(len(data)), meta.Size)
+	}
+}
+
+func TestClusterVersions(t *testing.T) {
+	_, servers := makeMemoryCluster(t, 3, p2p.MemoryNetworkOpts{}, func(opts *FileServerOpts) {
+		opts.ReplicationFactor = 1
+	})
+
+	d1, err := servers[0].Store("record", bytes.NewReader([]byte("first")))
+	assert.Nil(t, err)
+	_, err = servers[0].Store("record", bytes.NewReader([]byte("second")))
+	assert.Nil(t, err)
+
+	versions, err := servers[0].History("record")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, servers[0].self.ID, versions[1].Author)
+	assert.Equal(t, d1, versions[1].Parent)
+
+	// a node without the first version fetches it by digest
+	var reader *FileServer
+	for _, s := range servers {
+		if !holds(t, s.store, d1) {
+			reader = s
+		}
+	}
+	assert.NotNil(t, reader)
+
+	_, r, err := reader.GetVersion("record", 1)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, []byte("first"), b)
+
+	_, _, err = reader.GetVersion("record", 3)
+	assert.ErrorIs(t, err, ErrNoVersion)
+}
+
+func TestClusterChunkedTransfer(t *testing.T) {
+	_, servers := makeMemoryCluster(t, 4, p2p.MemoryNetworkOpts{Latency: 2 * time.Millisecond}, func(opts *FileServerOpts) {
+		opts.ChunkSize = 1024
+	})
+
+	// random content so no two chunks are alike
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+
+	meta, err := servers[0].store.WriteWithMetadata(Metadata{Key: "study"}, bytes.NewReader(data))
+	assert.Nil(t, err)
+	digest := meta.Digest
+
+	m, err := servers[0].store.Manifest(digest)
+	assert.Nil(t, err)
+	assert.Len(t, m.Chunks, 64)
+
+	// a pushed replica receives every chunk
+	peer, ok := servers[0].peerListeningOn(servers[1].self.Addr)
+	assert.True(t, ok)
+	assert.Nil(t, servers[0].sendFile(peer, meta.Digest, meta))
+	assert.Equal(t, uint64(len(m.Chunks)), servers[1].TransferStats().ChunksReceived)
+
+	// chunks of an interrupted download are not fetched again
+	reader := servers[3]
+	resumed := 8
+	for _, c := range m.Chunks[:resumed] {
+		_, r, err := servers[0].store.ReadChunk(digest, c.Digest)
+		assert.Nil(t, err)
+		assert.Nil(t, reader.store.WriteChunk(digest, c, m.Compression, r))
+		r.Close()
+	}
+
+	_, r, err := reader.Get("study")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, data, b)
+
+	assert.Equal(t, uint64(len(m.Chunks)-resumed), reader.TransferStats().ChunksReceived)
+
+	// both holders served part of the file
+	assert.NotZero(t, servers[1].TransferStats().ChunksSent)
+	assert.Greater(t, servers[0].TransferStats().ChunksSent, uint64(len(m.Chunks)))
+}
+
+func TestClusterCompression(t *testing.T) {
+	_, servers := makeMemoryCluster(t, 4, p2p.MemoryNetworkOpts{Latency: 2 * time.Millisecond}, func(opts *FileServerOpts) {
+		opts.ChunkSize = 1024
+		opts.Compression = CompressionGzip
+		opts.RepairInterval = -1
+	})
+
+	data := bytes.Repeat([]byte(`{"archetype_node_id":"openEHR-EHR-COMPOSITION.encounter.v1","name":"encounter"},`), 400)
+
+	meta, err := servers[0].store.WriteWithMetadata(Metadata{
+		Key:         "composition",
+		ContentType: "application/openehr+json",
+	}, bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, CompressionGzip, meta.Compression)
+
+	// a pushed replica receives the chunks compressed
+	peer, ok := servers[0].peerListeningOn(servers[1].self.Addr)
+	assert.True(t, ok)
+	assert.Nil(t, servers[0].sendFile(peer, meta.Digest, meta))
+
+	stats := servers[1].TransferStats()
+	assert.NotZero(t, stats.ChunksReceived)
+	assert.Less(t, stats.BytesReceived, uint64(len(data))/4)
+
+	m, err := servers[1].store.Manifest(meta.Digest)
+	assert.Nil(t, err)
+	assert.Equal(t, CompressionGzip, m.Compression)
+
+	// a holder storing the content as is serves the same chunks
+	servers[2].store.Compression = CompressionNone
+	_, err = servers[2].store.WriteDigest(meta.Digest, bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	m, err = servers[2].store.Manifest(meta.Digest)
+	assert.Nil(t, err)
+	assert.Equal(t, CompressionNone, m.Compression)
+
+	reader := servers[3]
+	assert.Nil(t, reader.fetch("", meta.Digest, reader.connectedPeers()))
+
+	_, r, err := reader.store.ReadDigest(meta.Digest)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, data, b)
+
+	_, err = reader.store.verify(meta.Digest, func(r io.Reader) io.Reader { return r })
+	assert.Nil(t, err)
+
+	// both holders served part of the file
+	assert.NotZero(t, servers[2].TransferStats().ChunksSent)
+}
+
+func TestClusterCapacity(t *testing.T) {
+	_, servers := makeMemoryCluster(t, 4, p2p.MemoryNetworkOpts{}, func(opts *FileServerOpts) {
+		opts.Capacity = 4096
+		opts.OwnerQuota = 1536
+		opts.RepairInterval = -1
+	})
+	owner := "0x00000000000000000000000000000000000000aa"
+
+	// fill a node up and let it tell its peers
+	full := servers[1]
+	filler := make([]byte, 4000)
+	rand.Read(filler)
+	_, _, err := full.store.Write("filler", bytes.NewReader(filler))
+	assert.Nil(t, err)
+	full.announceUsage()
+
+	writer := servers[0]
+	assert.Eventually(t, func() bool {
+		writer.peerLock.Lock()
+		defer writer.peerLock.Unlock()
+		for _, node := range writer.nodes {
+			if node.ID == full.self.ID {
+				return node.Used == int64(len(filler))
+			}
+		}
+		return false
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// the full node is passed over by placement
+	data := make([]byte, 1024)
+	rand.Read(data)
+	digest, err := writer.StoreWithOpts("record", bytes.NewReader(data), StoreFileOpts{Owner: owner, Replicas: 3})
+	assert.Nil(t, err)
+
+	holders := holdersOf(t, servers, digest)
+	assert.Len(t, holders, 3)
+	assert.NotContains(t, holders, full)
+
+	// the writer did not prove to be the owner so it is charged
+	n, err := servers[2].store.OwnerUsage(owner)
+	assert.Nil(t, err)
+	assert.Zero(t, n)
+	n, err = servers[2].store.OwnerUsage(writer.self.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	// and refuses files pushed to it
+	meta, err := writer.store.Metadata("record")
+	assert.Nil(t, err)
+
+	peer, ok := writer.peerListeningOn(full.self.Addr)
+	assert.True(t, ok)
+	assert.ErrorIs(t, writer.sendFile(peer, digest, meta), ErrCapacityExceeded)
+
+	// nodes cannot go over their quota on a node by writing
+	// records in the name of other owners
+	other := make([]byte, 1024)
+	rand.Read(other)
+	second, err := writer.store.WriteWithMetadata(Metadata{Key: "second", Owner: owner}, bytes.NewReader(other))
+	assert.Nil(t, err)
+
+	peer, ok = writer.peerListeningOn(servers[2].self.Addr)
+	assert.True(t, ok)
+	assert.ErrorIs(t, writer.sendFile(peer, second.Digest, second), ErrQuotaExceeded)
+
+	// and so are records without owner
+	unowned, err := writer.store.WriteWithMetadata(Metadata{Key: "unowned"}, bytes.NewReader(filler[:2000]))
+	assert.Nil(t, err)
+	assert.ErrorIs(t, writer.sendFile(peer, unowned.Digest, unowned), ErrQuotaExceeded)
+
+	// chunks of files the node took no room for are refused
+	m, err := writer.store.Manifest(unowned.Digest)
+	assert.Nil(t, err)
+	assert.NotNil(t, writer.sendChunk(peer, m, m.Chunks[0]))
+	assert.False(t, holds(t, servers[2].store, unowned.Digest))
+
+	// content held already takes no more room
+	assert.Nil(t, writer.sendFile(peer, digest, meta))
+}
+
+func TestClusterScrubRepair(t *testing.T) {
+	_, servers := makeMemoryCluster(t, 3, p2p.MemoryNetworkOpts{}, func(opts *FileServerOpts) {
+		opts.ChunkSize = 1024
+	})
+
+	data := bytes.Repeat([]byte("some dicom bytes "), 300)
+	digest, err := servers[0].Store("study", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	damaged := servers[2]
+	assert.Eventually(t, func() bool {
+		return damaged.store.Has("study")
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// bit rot on one replica
+	m, err := damaged.store.Manifest(digest)
+	assert.Nil(t, err)
+	path := damaged.store.Root + "/" + chunkKeyOf(t, damaged.store, digest, m.Chunks[0].Digest)
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	b[0] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, b, 0o644))
+
+	damaged.Scrub()
+
+	stats := damaged.ScrubStats()
+	assert.Equal(t, uint64(1), stats.Corrupt)
+	assert.Equal(t, uint64(1), stats.Repaired)
+	assert.Equal(t, uint64(0), stats.Failures)
+
+	// the healthy copy was fetched from the other replicas
+	_, r, err := damaged.store.Read("study")
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(r)
+	assert.Equal(t, data, b)
+}
+
+func TestClusterErasureCoding(t *testing.T) {
+	joined := make(map[string]*joinedNodes)
+	_, servers := makeMemoryCluster(t, 6, p2p.MemoryNetworkOpts{}, func(opts *FileServerOpts) {
+		opts.RepairInterval = -1
+
+		j := newJoinedNodes()
+		joined[opts.Transport.Addr()] = j
+		opts.OnPeerEvent = j.observe
+	})
+
+	// more than one stripe with a partial last one
+	data := make([]byte, 300*1024)
+	rand.Read(data)
+
+	digest, err := servers[0].StoreWithOpts("scan", bytes.NewReader(data), StoreFileOpts{
+		DataShards:   3,
+		ParityShards: 2,
+	})
+	assert.Nil(t, err)
+
+	meta, err := servers[0].Metadata("scan")
+	assert.Nil(t, err)
+	assert.NotNil(t, meta.Erasure)
+	assert.Equal(t, digest, meta.Digest)
+	assert.Len(t, meta.Erasure.Shards, 5)
+	assert.Len(t, meta.Replicas, 5)
+
+	// every shard on its own node and no full copy anywhere
+	assert.Empty(t, holdersOf(t, servers, digest))
+	seen := map[*FileServer]bool{}
+	for _, shard := range meta.Erasure.Shards {
+		held := holdersOf(t, servers, shard)
+		assert.Len(t, held, 1)
+		seen[held[0]] = true
+	}
+	assert.Len(t, seen, 5)
+
+	// a node without any shard rebuilds the record from the others
+	// after the holders of two data shards left
+	var reader *FileServer
+	for _, s := range servers {
+		if !seen[s] {
+			reader = s
+		}
+	}
+	assert.NotNil(t, reader)
+
+	lost := []*FileServer{
+		holdersOf(t, servers, meta.Erasure.Shards[0])[0],
+		holdersOf(t, servers, meta.Erasure.Shards[1])[0],
+	}
+	for _, s := range lost {
+		s.Stop()
+	}
+
+	remaining := []*FileServer{}
+	for _, s := range servers {
+		if s != lost[0] && s != lost[1] {
+			remaining = append(remaining, s)
+		}
+	}
+	// every remaining node places shards on the same nodes
+	// once it saw both holders leave
+	for _, s := range remaining {
+		joined[s.self.Addr].wait(t, func(nodes map[string]bool) bool {
+			return !nodes[lost[0].self.Addr] && !nodes[lost[1].self.Addr]
+		})
+	}
+
+	_, r, err := reader.Get("scan")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, data, b)
+
+	f, _, err := reader.Open("scan")
+	assert.Nil(t, err)
+	_, err = f.Seek(200*1024, io.SeekStart)
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(f)
+	assert.Equal(t, data[200*1024:], b)
+	f.Close()
+
+	// shards fetched to rebuild the record are only kept
+	// if they are placed on the reader now that nodes left
+	ids, _ := reader.placeShards(digest, 5)
+	for i, shard := range meta.Erasure.Shards {
+		if i >= len(ids) || ids[i] != reader.self.ID {
+			assert.False(t, holds(t, reader.store, shard))
+		}
+	}
+
+	// repair moves the shards to the nodes now responsible for them
+	// and regenerates the lost ones
+	for round := 0; round < 2; round++ {
+		for _, s := range remaining {
+			s.repair()
+		}
+	}
+
+	repaired := uint64(0)
+	for _, s := range remaining {
+		repaired += s.RepairStats().ShardsRepaired
+	}
+	assert.NotZero(t, repaired)
+
+	for i, id := range ids {
+		held := holdersOf(t, remaining, meta.Erasure.Shards[i])
+		assert.Len(t, held, 1)
+		if len(held) == 1 {
+			assert.Equal(t, id, held[0].self.ID)
+		}
+	}
+
+	// shards go with the record
+	_, err = remaining[0].Delete("scan", "right to erasure request")
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool {
+		for _, shard := range append(meta.Erasure.Shards, digest) {
+			if len(holdersOf(t, remaining, shard)) != 0 {
+				return false
+			}
+		}
+		for _, s := range remaining {
+			if _, ok := s.store.Tombstone(nameOf("scan")); !ok {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+
+	for _, s := range remaining {
+		_, err := s.Metadata("scan")
+		assert.ErrorIs(t, err, ErrNoMetadata)
+	}
+}
+
+func TestClusterRepairScope(t *testing.T) {
+	_, servers := makeMemoryCluster(t, 4, p2p.MemoryNetworkOpts{}, func(opts *FileServerOpts) {
+		opts.ReplicationFactor = 2
+		opts.RepairInterval = -1
+	})
+
+	data := []byte("ehr bytes two nodes are responsible for")
+	digest, _, err := servers[0].store.Write("record", bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Nil(t, servers[0].store.Delete("record"))
+
+	responsible, others := []*FileServer{}, []*FileServer{}
+	for _, s := range servers {
+		if s.responsibleFor(digest) {
+			responsible = append(responsible, s)
+		} else {
+			others = append(others, s)
+		}
+	}
+	assert.Len(t, responsible, 2)
+
+	// held by one responsible node and one that is not
+	for _, s := range []*FileServer{responsible[0], others[0]} {
+		_, _, err := s.store.Write("record", bytes.NewReader(data))
+		assert.Nil(t, err)
+	}
+
+	// objects are only compared between nodes responsible for them
+	objects, err := others[0].store.Names()
+	assert.Nil(t, err)
+	for _, s := range servers {
+		assert.NotContains(t, others[0].sharedObjects(objects, s.self.ID), digest)
+	}
+
+	for _, s := range servers {
+		s.repair()
+	}
+	assert.True(t, holds(t, responsible[1].store, digest))
+	assert.False(t, holds(t, others[1].store, digest))
+
+	// sync requests beyond the ones answered at once are refused
+	for range maxSyncTreeRequests {
+		responsible[0].syncSlots <- struct{}{}
+	}
+	peer, ok := responsible[1].peerListeningOn(responsible[0].self.Addr)
+	assert.True(t, ok)
+	_, err = responsible[1].syncTree(peer, MessageSyncTree{Nodes: []int{0}})
+	assert.ErrorContains(t, err, "too many sync requests")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// compression algorithms objects are stored with
+// the algorithm of an object is recorded in its manifest
+const (
+	// content stored as is
+	CompressionNone = ""
+
+	// content compressed with gzip
+	CompressionGzip = "gzip"
+)
+
+// media types whose content is compressed already
+// compressing them again costs cpu and saves nothing
+var compressedTypes = map[string]bool{
+	"application/gzip":            true,
+	"application/x-gzip":          true,
+	"application/zip":             true,
+	"application/zstd":            true,
+	"application/x-7z-compressed": true,
+	"application/x-bzip2":         true,
+	"application/x-xz":            true,
+	"application/vnd.rar":         true,
+}
+
+// prefixes of the DICOM transfer syntaxes with compressed pixel data
+// JPEG, JPEG-LS, JPEG 2000, MPEG and HEVC (1.2.840.10008.1.2.4.*)
+// and RLE (1.2.840.10008.1.2.5)
+var compressedTransferSyntaxes = []string{
+	"1.2.840.10008.1.2.4.",
+	"1.2.840.10008.1.2.5",
+}
+
+// reports whether content of contentType is worth compressing
+// unknown content is compressed
+func compressible(contentType string) bool {
+	if len(contentType) == 0 {
+		return true
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+
+	switch {
+	case compressedTypes[mediaType]:
+		return false
+
+	// images, audio and video are encoded with lossy or
+	// lossless compression | svg is text
+	case strings.HasPrefix(mediaType, "image/"):
+		return mediaType == "image/svg+xml" || mediaType == "image/bmp" || mediaType == "image/tiff"
+	case strings.HasPrefix(mediaType, "audio/"), strings.HasPrefix(mediaType, "video/"):
+		return false
+
+	// DICOM objects carry their transfer syntax as a parameter
+	case mediaType == "application/dicom":
+		syntax := params["transfer-syntax"]
+		for _, prefix := range compressedTransferSyntaxes {
+			if strings.HasPrefix(syntax, prefix) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// returns the compression content of contentType is stored with
+func (s *Store) compressionFor(contentType string) string {
+	if !compressible(contentType) {
+		return CompressionNone
+	}
+	return s.Compression
+}
+
+// reports an unknown compression algorithm
+func checkCompression(compression string) error {
+	switch compression {
+	case CompressionNone, CompressionGzip:
+		return nil
+	}
+	return fmt.Errorf("unsupported compression (%s)", compression)
+}
+
+// returns writer compressing everything written to it into w
+// closing it flushes the compressed stream and leaves w open
+func compress(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	}
+	return nil, checkCompression(compression)
+}
+
+// returns reader over the decompressed content of r
+// closing it leaves r open
+func decompress(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	}
+	return nil, checkCompression(compression)
+}
+
+// returns reader over the content of r compressed with from
+// compressed with to instead
+func recompress(r io.Reader, from, to string) (io.Reader, error) {
+	if from == to {
+		return r, nil
+	}
+
+	plain, err := decompress(r, from)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer plain.Close()
+
+		w, err := compress(pw, to)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(w, plain); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(w.Close())
+	}()
+
+	return pr, nil
+}
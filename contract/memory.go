@@ -0,0 +1,80 @@
+package contract
+
+import (
+	"crypto/ecdsa"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// MemoryRegistry is an in memory allowlist of nodes standing in
+// for the on chain verifier contract in tests and local clusters
+type MemoryRegistry struct {
+	lock sync.Mutex
+
+	// listen addresses each node address is registered for
+	nodes map[common.Address]map[string]bool
+}
+
+// NewMemoryRegistry creates an empty registry
+// returns *MemoryRegistry
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		nodes: make(map[common.Address]map[string]bool),
+	}
+}
+
+// Allow registers node address for listen address ip
+func (r *MemoryRegistry) Allow(address common.Address, ip string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.nodes[address] == nil {
+		r.nodes[address] = make(map[string]bool)
+	}
+	r.nodes[address][ip] = true
+}
+
+// Revoke removes the registration of node address for ip
+func (r *MemoryRegistry) Revoke(address common.Address, ip string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.nodes[address], ip)
+}
+
+// Contract returns the Contract of the node with key
+// backed by the registry
+func (r *MemoryRegistry) Contract(key *ecdsa.PublicKey) *MemoryContract {
+	return &MemoryContract{
+		registry: r,
+		key:      key,
+	}
+}
+
+// MemoryContract implements Contract for a single node over a MemoryRegistry
+type MemoryContract struct {
+	registry *MemoryRegistry
+	key      *ecdsa.PublicKey
+}
+
+func (c *MemoryContract) VerifyNode(address common.Address, ip string) (bool, error) {
+	c.registry.lock.Lock()
+	defer c.registry.lock.Unlock()
+
+	return c.registry.nodes[address][ip], nil
+}
+
+func (c *MemoryContract) IsAdded(ip string) (bool, error) {
+	return c.VerifyNode(crypto.PubkeyToAddress(*c.key), ip)
+}
+
+func (c *MemoryContract) AddNode(ip string) error {
+	c.registry.Allow(crypto.PubkeyToAddress(*c.key), ip)
+	return nil
+}
+
+func (c *MemoryContract) GetPublicKey() (*ecdsa.PublicKey, error) {
+	return c.key, nil
+}
@@ -0,0 +1,131 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+)
+
+// magic bytes at the start of every record sealed to a recipient
+var sealedMagic = []byte("EHRX")
+
+// sealed record format version
+const sealedVersion = 1
+
+// ErrNotRecipient is returned when a sealed record is opened
+// with a key it was not sealed to
+var ErrNotRecipient = errors.New("not the recipient of sealed record")
+
+// SealedHeader describes who a sealed record is encrypted to
+type SealedHeader struct {
+	// address of the recipient public key
+	Recipient common.Address
+
+	// record data key encrypted to the recipient with ECIES
+	wrappedKey []byte
+}
+
+// size of the header on the wire
+func (h *SealedHeader) size() int64 {
+	return int64(len(sealedMagic) + 1 + common.AddressLength + 2 + len(h.wrappedKey))
+}
+
+// SealTo returns a writer that encrypts everything written to it to the
+// recipient secp256k1 public key and writes the sealed record to w
+// the record is only complete once the writer is closed
+func SealTo(w io.Writer, recipient *ecdsa.PublicKey) (io.WriteCloser, error) {
+	// generate record data key
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	// encrypt data key to recipient
+	wrapped, err := ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic(recipient), dataKey, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := ethcrypto.PubkeyToAddress(*recipient)
+
+	header := append([]byte{}, sealedMagic...)
+	header = append(header, sealedVersion)
+	header = append(header, addr.Bytes()...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return NewSealWriter(w, dataKey)
+}
+
+// SealedRecipient reports whether r starts with a sealed record header
+// and who it is sealed to without consuming it
+func SealedRecipient(r *bufio.Reader) (common.Address, bool) {
+	b, err := r.Peek(len(sealedMagic) + 1 + common.AddressLength)
+	if err != nil || !bytes.Equal(b[:len(sealedMagic)], sealedMagic) {
+		return common.Address{}, false
+	}
+	return common.BytesToAddress(b[len(sealedMagic)+1:]), true
+}
+
+// ReadSealedHeader reads the header of a sealed record from r
+// returns *SealedHeader | error
+func ReadSealedHeader(r io.Reader) (*SealedHeader, error) {
+	prefix := make([]byte, len(sealedMagic)+1+common.AddressLength+2)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(prefix[:len(sealedMagic)], sealedMagic) {
+		return nil, errors.New("record is not sealed")
+	}
+
+	if v := prefix[len(sealedMagic)]; v != sealedVersion {
+		return nil, fmt.Errorf("unsupported sealed record version %d", v)
+	}
+
+	addr := prefix[len(sealedMagic)+1 : len(sealedMagic)+1+common.AddressLength]
+	size := binary.BigEndian.Uint16(prefix[len(prefix)-2:])
+
+	wrapped := make([]byte, size)
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return nil, err
+	}
+
+	return &SealedHeader{
+		Recipient:  common.BytesToAddress(addr),
+		wrappedKey: wrapped,
+	}, nil
+}
+
+// Open returns a reader over the plaintext of the sealed record body r
+// fails with ErrNotRecipient if key is not the recipient key
+func (h *SealedHeader) Open(r io.Reader, key *ecdsa.PrivateKey) (io.Reader, error) {
+	if ethcrypto.PubkeyToAddress(key.PublicKey) != h.Recipient {
+		return nil, ErrNotRecipient
+	}
+
+	dataKey, err := ecies.ImportECDSA(key).Decrypt(h.wrappedKey, nil, nil)
+	if err != nil {
+		return nil, ErrTampered
+	}
+
+	return NewOpenReader(r, dataKey)
+}
+
+// PlainSize returns the plaintext size of a sealed record of n bytes
+func (h *SealedHeader) PlainSize(n int64) int64 {
+	return OpenedSize(n - h.size())
+}
@@ -41,6 +41,18 @@ func NewKeystore(opts KeystoreOpts) (*Keystore, error) {
 
 func (ks *Keystore) GetPublicKey() (*ecdsa.PublicKey, error) {
 
+	key, err := ks.PrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &key.PublicKey, nil
+
+}
+
+// PrivateKey decrypts the wallet file and returns the node private key
+func (ks *Keystore) PrivateKey() (*ecdsa.PrivateKey, error) {
+
 	jsonBytes, err := os.ReadFile(ks.WalletPath)
 	if err != nil {
 		return nil, err
@@ -50,8 +62,7 @@ func (ks *Keystore) GetPublicKey() (*ecdsa.PublicKey, error) {
 		return nil, err
 	}
 
-	return &key.PrivateKey.PublicKey, nil
-
+	return key.PrivateKey, nil
 }
 
 func (ks *Keystore) Address() common.Address {
@@ -0,0 +1,204 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// SegmentSize is the plaintext size of every sealed segment but the last
+	SegmentSize = 64 * 1024
+
+	// size of the random nonce prefix written at the start of a stream
+	noncePrefixSize = 7
+
+	// size of the GCM authentication tag appended to every segment
+	tagSize = 16
+)
+
+// ErrTampered is returned when a sealed stream fails authentication
+var ErrTampered = errors.New("sealed stream has been tampered with")
+
+// SealedSize returns the size of a sealed stream carrying n plaintext bytes
+func SealedSize(n int64) int64 {
+	// an empty stream still carries one sealed segment
+	segments := (n + SegmentSize - 1) / SegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return noncePrefixSize + n + segments*tagSize
+}
+
+// OpenedSize returns the plaintext size carried by a sealed stream of n bytes
+func OpenedSize(n int64) int64 {
+	n -= noncePrefixSize
+	if n < tagSize {
+		return 0
+	}
+
+	segments := (n + SegmentSize + tagSize - 1) / (SegmentSize + tagSize)
+	return n - segments*tagSize
+}
+
+// segment nonce is the stream prefix followed by the segment
+// index and a flag marking the last segment of the stream
+// so segments can neither be reordered nor truncated
+func segmentNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealWriter encrypts written data into segments of SegmentSize
+type sealWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	buf    []byte
+}
+
+// NewSealWriter returns a writer that seals everything written to it
+// with AES-256-GCM under key and writes the sealed stream to w
+// the stream is only complete once the writer is closed
+func NewSealWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+
+	return &sealWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, 0, SegmentSize),
+	}, nil
+}
+
+func (s *sealWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		// a full segment is only sealed once more data arrives
+		// since the last segment must carry the last flag
+		if len(s.buf) == SegmentSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(s.buf[len(s.buf):SegmentSize], b)
+		s.buf = s.buf[:len(s.buf)+n]
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last segment
+func (s *sealWriter) Close() error {
+	return s.seal(true)
+}
+
+func (s *sealWriter) seal(last bool) error {
+	nonce := segmentNonce(s.prefix, s.index, last)
+	if _, err := s.w.Write(s.aead.Seal(nil, nonce, s.buf, nil)); err != nil {
+		return err
+	}
+	s.index++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// openReader decrypts a sealed stream segment by segment
+type openReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	buf    []byte
+	done   bool
+}
+
+// NewOpenReader returns a reader over the plaintext of the sealed stream r
+// reads fail with ErrTampered if any segment does not authenticate
+func NewOpenReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, ErrTampered
+	}
+
+	return &openReader{
+		r:      bufio.NewReaderSize(r, SegmentSize+tagSize+1),
+		aead:   aead,
+		prefix: prefix,
+	}, nil
+}
+
+func (o *openReader) Read(b []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+func (o *openReader) open() error {
+	segment := make([]byte, SegmentSize+tagSize)
+	n, err := io.ReadFull(o.r, segment)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		// a stream always ends with a sealed last segment
+		return ErrTampered
+	}
+
+	// the segment is the last one if nothing follows it
+	_, peekErr := o.r.Peek(1)
+	last := peekErr == io.EOF
+
+	plain, err := o.aead.Open(segment[:0], segmentNonce(o.prefix, o.index, last), segment[:n], nil)
+	if err != nil {
+		return ErrTampered
+	}
+
+	o.index++
+	o.buf = plain
+	o.done = last
+	return nil
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/luqxus/dstore/dht"
+	"github.com/luqxus/dstore/p2p"
+)
+
+// MessageFindNode asks the receiver for the contacts
+// it knows closest to Target
+type MessageFindNode struct {
+
+	// sender contact
+	From dht.Contact
+
+	// id looked up
+	Target dht.ID
+}
+
+// MessageFindValue asks the receiver for the providers of Key
+// or the contacts it knows closest to Key
+type MessageFindValue struct {
+
+	// sender contact
+	From dht.Contact
+
+	// key looked up
+	Key dht.ID
+}
+
+// MessageProvide tells the receiver that Provider holds Key
+type MessageProvide struct {
+
+	// sender contact
+	From dht.Contact
+
+	// provided key
+	Key dht.ID
+
+	// node holding the value of key
+	Provider dht.Contact
+}
+
+// MessageDHTReply answers MessageFindNode, MessageFindValue and MessageProvide
+type MessageDHTReply struct {
+
+	// contacts closest to the looked up id
+	Contacts []dht.Contact
+
+	// providers of the looked up key
+	Providers []dht.Contact
+}
+
+// returns the DHT contact of node
+// nodes identified by an Ethereum address derive their id from it
+func contactOf(node NodeInfo) dht.Contact {
+	id := dht.NewID([]byte(node.ID))
+	if common.IsHexAddress(node.ID) {
+		id = dht.NewID(common.HexToAddress(node.ID).Bytes())
+	}
+
+	return dht.Contact{
+		ID:   id,
+		Addr: node.Addr,
+	}
+}
+
+// dhtNetwork implements dht.Network over the FileServer transport
+type dhtNetwork struct {
+	s *FileServer
+}
+
+func (n dhtNetwork) FindNode(ctx context.Context, to dht.Contact, target dht.ID) ([]dht.Contact, error) {
+	r, err := n.s.dhtRequest(ctx, to, MessageFindNode{
+		From:   contactOf(n.s.self),
+		Target: target,
+	})
+	return r.Contacts, err
+}
+
+func (n dhtNetwork) FindValue(ctx context.Context, to dht.Contact, key dht.ID) ([]dht.Contact, []dht.Contact, error) {
+	r, err := n.s.dhtRequest(ctx, to, MessageFindValue{
+		From: contactOf(n.s.self),
+		Key:  key,
+	})
+	return r.Providers, r.Contacts, err
+}
+
+func (n dhtNetwork) Provide(ctx context.Context, to dht.Contact, key dht.ID, provider dht.Contact) error {
+	_, err := n.s.dhtRequest(ctx, to, MessageProvide{
+		From:     contactOf(n.s.self),
+		Key:      key,
+		Provider: provider,
+	})
+	return err
+}
+
+// send DHT request payload to contact and wait for its reply
+// returns MessageDHTReply | error
+func (s *FileServer) dhtRequest(ctx context.Context, to dht.Contact, payload any) (MessageDHTReply, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.RequestTimeout)
+	defer cancel()
+
+	peer, err := s.connect(ctx, to.Addr)
+	if err != nil {
+		return MessageDHTReply{}, err
+	}
+
+	r, err := s.request(ctx, peer, payload)
+	if err != nil {
+		return MessageDHTReply{}, fmt.Errorf("dht request to (%s): %w", to.Addr, err)
+	}
+
+	reply, ok := r.(MessageDHTReply)
+	if !ok {
+		return MessageDHTReply{}, fmt.Errorf("unexpected reply %T from (%s)", r, to.Addr)
+	}
+
+	return reply, nil
+}
+
+// returns connected peer listening on addr
+// dialing it if it is not connected yet
+func (s *FileServer) connect(ctx context.Context, addr string) (p2p.Peer, error) {
+	if addr == s.self.Addr {
+		return nil, fmt.Errorf("refusing to connect to self (%s)", addr)
+	}
+
+	// concurrent lookups share a single dial so two connections
+	// to the same address never replace each other in the peers map
+	peer, dial := s.startDial(addr)
+	if peer != nil {
+		return peer, nil
+	}
+
+	if dial {
+		if err := s.Transport.Dial(addr); err != nil {
+			s.endDial(addr)
+			return nil, err
+		}
+	}
+
+	// the peer is usable once it announced itself
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if peer, ok := s.peerListeningOn(addr); ok {
+				return peer, nil
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("connecting to (%s): %w", addr, ctx.Err())
+		}
+	}
+}
+
+// marks addr as being dialed unless it is connected already
+// or another dial to addr is in flight
+// a dial stays in flight until its handshake could have timed out
+// so callers giving up early do not cause a second connection
+// returns connected peer listening on addr | whether to dial
+func (s *FileServer) startDial(addr string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if peer, ok := s.listeningOn(addr); ok {
+		delete(s.dialing, addr)
+		return peer, false
+	}
+
+	if timeout, ok := s.dialing[addr]; ok && time.Now().Before(timeout) {
+		return nil, false
+	}
+
+	s.dialing[addr] = time.Now().Add(p2p.DefaultHandshakeTimeout)
+	return nil, true
+}
+
+func (s *FileServer) endDial(addr string) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	delete(s.dialing, addr)
+}
+
+// returns connected peer that announced listen address addr
+func (s *FileServer) peerListeningOn(addr string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	return s.listeningOn(addr)
+}
+
+// caller must hold peerLock
+func (s *FileServer) listeningOn(addr string) (p2p.Peer, bool) {
+	for remote, node := range s.nodes {
+		if node.Addr == addr {
+			peer, ok := s.peers[remote]
+			return peer, ok
+		}
+	}
+
+	return nil, false
+}
+
+// announce this node as provider of digest on the DHT
+func (s *FileServer) provide(digest string) {
+	key, err := dht.KeyFromDigest(digest)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4*s.RequestTimeout)
+	defer cancel()
+
+	if err := s.dht.Provide(ctx, key); err != nil {
+		log.Printf("providing (%s): %s", digest, err)
+	}
+}
+
+// Locate returns the listen addresses of the nodes holding
+// content with digest anywhere in the network
+func (s *FileServer) Locate(digest string) ([]string, error) {
+	key, err := dht.KeyFromDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4*s.RequestTimeout)
+	defer cancel()
+
+	addrs := []string{}
+	for _, c := range s.dht.FindProviders(ctx, key) {
+		addrs = append(addrs, c.Addr)
+	}
+
+	return addrs, nil
+}
+
+// fetch file with digest from the nodes the DHT locates
+// returns error
+func (s *FileServer) fetchLocated(key string, digest string) error {
+	addrs, err := s.Locate(digest)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	peers := []p2p.Peer{}
+	for _, addr := range addrs {
+		if addr == s.self.Addr {
+			continue
+		}
+
+		peer, err := s.connect(ctx, addr)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+
+	if len(peers) == 0 {
+		return ErrFileNotFound
+	}
+
+	return s.fetch(key, digest, peers)
+}
+
+// returns the DHT contact of the node announced on connection from
+// whose id is bound to the identity the peer proved in the handshake
+// a contact other than claimed is refused and a node that did not
+// announce itself yet is answered without joining the routing table
+// returns dht.Contact | error
+func (s *FileServer) senderContact(from string, claimed dht.Contact) (dht.Contact, error) {
+	s.peerLock.Lock()
+	node, ok := s.nodes[from]
+	s.peerLock.Unlock()
+
+	if !ok {
+		return dht.Contact{}, nil
+	}
+
+	contact := contactOf(node)
+	if claimed != contact {
+		return dht.Contact{}, fmt.Errorf("peer (%s) is (%s) but claimed to be (%s)", from, contact.ID, claimed.ID)
+	}
+
+	return contact, nil
+}
+
+// handle MessageFindNode message from peer
+func (s *FileServer) handleMessageFindNode(from string, id string, msg MessageFindNode) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	sender, err := s.senderContact(from, msg.From)
+	if err != nil {
+		return err
+	}
+
+	return s.send(peer, &Message{
+		ID: id,
+		Payload: MessageDHTReply{
+			Contacts: s.dht.HandleFindNode(sender, msg.Target),
+		},
+	})
+}
+
+// handle MessageFindValue message from peer
+func (s *FileServer) handleMessageFindValue(from string, id string, msg MessageFindValue) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	sender, err := s.senderContact(from, msg.From)
+	if err != nil {
+		return err
+	}
+
+	providers, closer := s.dht.HandleFindValue(sender, msg.Key)
+
+	return s.send(peer, &Message{
+		ID: id,
+		Payload: MessageDHTReply{
+			Contacts:  closer,
+			Providers: providers,
+		},
+	})
+}
+
+// handle MessageProvide message from peer
+func (s *FileServer) handleMessageProvide(from string, id string, msg MessageProvide) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	sender, err := s.senderContact(from, msg.From)
+	if err != nil {
+		return err
+	}
+
+	// nodes only announce the content they hold themselves
+	if len(sender.Addr) == 0 || msg.Provider != sender {
+		return fmt.Errorf("peer (%s) cannot provide for (%s)", from, msg.Provider.ID)
+	}
+
+	s.dht.HandleProvide(sender, msg.Key, msg.Provider)
+
+	return s.send(peer, &Message{
+		ID:      id,
+		Payload: MessageDHTReply{},
+	})
+}
+
+// handle MessageDHTReply message from peer
+func (s *FileServer) handleMessageDHTReply(from string, id string, msg MessageDHTReply) error {
+	if !s.deliverReply(from, id, msg) {
+		return fmt.Errorf("reply (%s) from peer (%s) to unknown request", id, from)
+	}
+	return nil
+}
@@ -0,0 +1,548 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// IDSize is the size of node and key ids in bytes
+	IDSize = sha256.Size
+
+	// default bucket size and number of nodes a key is stored on
+	DefaultK = 20
+
+	// default number of concurrent requests of an iterative lookup
+	DefaultAlpha = 3
+
+	// default time a provider record is kept without being refreshed
+	DefaultProviderTTL = 24 * time.Hour
+
+	// default number of keys provider records are kept for
+	DefaultMaxProviderKeys = 1 << 16
+
+	// time between two sweeps of expired provider records
+	providerSweepInterval = time.Minute
+)
+
+// ID identifies nodes and keys in the same 256 bit space
+type ID [IDSize]byte
+
+// NewID derives an id by hashing b
+// nodes derive their id from their Ethereum address
+func NewID(b []byte) ID {
+	return ID(sha256.Sum256(b))
+}
+
+// KeyFromDigest returns the id of a hex encoded SHA-256 content digest
+// content digests are used as keys as is
+func KeyFromDigest(digest string) (ID, error) {
+	b, err := hex.DecodeString(digest)
+	if err != nil {
+		return ID{}, err
+	}
+
+	if len(b) != IDSize {
+		return ID{}, fmt.Errorf("digest must be %d bytes, got %d", IDSize, len(b))
+	}
+
+	return ID(b), nil
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance returns the XOR distance between two ids
+func (id ID) Distance(other ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// returns index of the bucket other belongs to as seen from id
+// the index is the length of the common prefix of both ids
+func (id ID) bucket(other ID) int {
+	d := id.Distance(other)
+	for i, b := range d {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return IDSize*8 - 1
+}
+
+// Contact is a node reachable on the network
+type Contact struct {
+
+	// node id
+	ID ID
+
+	// address the node listens on
+	Addr string
+}
+
+// Network sends DHT requests to remote nodes
+type Network interface {
+
+	// FindNode asks to for the contacts it knows closest to target
+	FindNode(ctx context.Context, to Contact, target ID) ([]Contact, error)
+
+	// FindValue asks to for the providers of key
+	// or the contacts it knows closest to key if it has none
+	FindValue(ctx context.Context, to Contact, key ID) (providers []Contact, closer []Contact, err error)
+
+	// Provide tells to that provider holds the value of key
+	Provide(ctx context.Context, to Contact, key ID, provider Contact) error
+}
+
+// DHTOpts configures a DHT
+type DHTOpts struct {
+
+	// this node
+	Self Contact
+
+	// transport for DHT requests
+	Network Network
+
+	// bucket size | DefaultK if zero
+	K int
+
+	// lookup concurrency | DefaultAlpha if zero
+	Alpha int
+
+	// lifetime of provider records | DefaultProviderTTL if zero
+	ProviderTTL time.Duration
+
+	// keys provider records are kept for | the least recently
+	// provided keys are dropped first | DefaultMaxProviderKeys if zero
+	MaxProviderKeys int
+}
+
+// provider of a key and when its record expires
+type provider struct {
+	contact Contact
+	expires time.Time
+}
+
+// DHT is a Kademlia distributed hash table mapping keys
+// to the nodes providing them
+type DHT struct {
+	DHTOpts
+
+	// routing table lock
+	lock sync.Mutex
+
+	// k-buckets indexed by common prefix length with this node
+	// least recently seen contact first
+	buckets [IDSize * 8][]Contact
+
+	// providers lock
+	providerLock sync.Mutex
+
+	// provider records this node is responsible for
+	// least recently provided first | at most K per key
+	providers map[ID][]provider
+
+	// when expired provider records are swept next
+	nextSweep time.Time
+}
+
+// NewDHT creates a DHT from opts
+// returns *DHT
+func NewDHT(opts DHTOpts) *DHT {
+	if opts.K == 0 {
+		opts.K = DefaultK
+	}
+
+	if opts.Alpha == 0 {
+		opts.Alpha = DefaultAlpha
+	}
+
+	if opts.ProviderTTL == 0 {
+		opts.ProviderTTL = DefaultProviderTTL
+	}
+
+	if opts.MaxProviderKeys == 0 {
+		opts.MaxProviderKeys = DefaultMaxProviderKeys
+	}
+
+	return &DHT{
+		DHTOpts:   opts,
+		providers: make(map[ID][]provider),
+	}
+}
+
+// Update records that contact was seen
+// a full bucket keeps its contacts since long lived nodes
+// are more likely to stay online
+func (d *DHT) Update(c Contact) {
+	if c.ID == d.Self.ID || len(c.Addr) == 0 {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	i := d.Self.ID.bucket(c.ID)
+	bucket := d.buckets[i]
+
+	for j, known := range bucket {
+		if known.ID == c.ID {
+			// move contact to the most recently seen end
+			bucket = append(bucket[:j], bucket[j+1:]...)
+			d.buckets[i] = append(bucket, c)
+			return
+		}
+	}
+
+	if len(bucket) < d.K {
+		d.buckets[i] = append(bucket, c)
+	}
+}
+
+// Remove drops an unresponsive contact from the routing table
+func (d *DHT) Remove(id ID) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	i := d.Self.ID.bucket(id)
+	for j, known := range d.buckets[i] {
+		if known.ID == id {
+			d.buckets[i] = append(d.buckets[i][:j], d.buckets[i][j+1:]...)
+			return
+		}
+	}
+}
+
+// Closest returns up to n known contacts closest to target
+func (d *DHT) Closest(target ID, n int) []Contact {
+	d.lock.Lock()
+	contacts := []Contact{}
+	for _, bucket := range d.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	d.lock.Unlock()
+
+	sortByDistance(contacts, target)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+// Size returns the number of contacts in the routing table
+func (d *DHT) Size() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	n := 0
+	for _, bucket := range d.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+func sortByDistance(contacts []Contact, target ID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		di, dj := contacts[i].ID.Distance(target), contacts[j].ID.Distance(target)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
+
+// HandleFindNode answers a FIND_NODE request from a remote node
+func (d *DHT) HandleFindNode(from Contact, target ID) []Contact {
+	d.Update(from)
+	return d.Closest(target, d.K)
+}
+
+// HandleFindValue answers a FIND_VALUE request from a remote node
+func (d *DHT) HandleFindValue(from Contact, key ID) ([]Contact, []Contact) {
+	d.Update(from)
+
+	if providers := d.localProviders(key); len(providers) != 0 {
+		return providers, nil
+	}
+
+	return nil, d.Closest(key, d.K)
+}
+
+// HandleProvide answers a STORE request from a remote node
+func (d *DHT) HandleProvide(from Contact, key ID, p Contact) {
+	d.Update(from)
+	d.addProvider(key, p)
+}
+
+// record that c provides key | a key keeps its K most recently
+// provided records and the least recently provided keys are
+// dropped once MaxProviderKeys keys have records
+func (d *DHT) addProvider(key ID, c Contact) {
+	d.providerLock.Lock()
+	defer d.providerLock.Unlock()
+
+	now := time.Now()
+	if now.After(d.nextSweep) {
+		d.sweepProviders(now)
+		d.nextSweep = now.Add(providerSweepInterval)
+	}
+
+	records, ok := d.providers[key]
+	if !ok && len(d.providers) >= d.MaxProviderKeys {
+		d.sweepProviders(now)
+		if len(d.providers) >= d.MaxProviderKeys {
+			d.dropOldestKey()
+		}
+	}
+
+	// a refreshed record moves to the most recently provided end
+	for i, p := range records {
+		if p.contact.ID == c.ID {
+			records = append(records[:i], records[i+1:]...)
+			break
+		}
+	}
+
+	if len(records) >= d.K {
+		records = records[len(records)-d.K+1:]
+	}
+
+	d.providers[key] = append(records, provider{contact: c, expires: now.Add(d.ProviderTTL)})
+}
+
+// drop the expired provider records | providerLock must be held
+func (d *DHT) sweepProviders(now time.Time) {
+	for key, records := range d.providers {
+		live := records[:0]
+		for _, p := range records {
+			if p.expires.After(now) {
+				live = append(live, p)
+			}
+		}
+
+		if len(live) == 0 {
+			delete(d.providers, key)
+		} else {
+			d.providers[key] = live
+		}
+	}
+}
+
+// drop the records of the key provided least recently
+// providerLock must be held
+func (d *DHT) dropOldestKey() {
+	var (
+		oldest  ID
+		expires time.Time
+	)
+
+	for key, records := range d.providers {
+		// the last record of a key is its most recently provided one
+		last := records[len(records)-1].expires
+		if expires.IsZero() || last.Before(expires) {
+			oldest, expires = key, last
+		}
+	}
+
+	delete(d.providers, oldest)
+}
+
+// returns unexpired providers of key known to this node
+func (d *DHT) localProviders(key ID) []Contact {
+	d.providerLock.Lock()
+	defer d.providerLock.Unlock()
+
+	now := time.Now()
+	live := d.providers[key][:0]
+	contacts := []Contact{}
+	for _, p := range d.providers[key] {
+		if p.expires.After(now) {
+			live = append(live, p)
+			contacts = append(contacts, p.contact)
+		}
+	}
+
+	if len(live) == 0 {
+		delete(d.providers, key)
+	} else {
+		d.providers[key] = live
+	}
+
+	return contacts
+}
+
+// Bootstrap joins the network through the contacts already in the
+// routing table by looking up this node's own id
+func (d *DHT) Bootstrap(ctx context.Context) {
+	d.Lookup(ctx, d.Self.ID)
+}
+
+// Lookup iteratively queries the network for the k contacts closest to target
+func (d *DHT) Lookup(ctx context.Context, target ID) []Contact {
+	closest, _ := d.iterate(ctx, target, false)
+	return closest
+}
+
+// FindProviders iteratively queries the network for the providers of key
+func (d *DHT) FindProviders(ctx context.Context, key ID) []Contact {
+	if providers := d.localProviders(key); len(providers) != 0 {
+		return providers
+	}
+
+	_, providers := d.iterate(ctx, key, true)
+	return providers
+}
+
+// Provide announces this node as provider of key to the
+// k nodes closest to key
+func (d *DHT) Provide(ctx context.Context, key ID) error {
+	closest := d.Lookup(ctx, key)
+
+	// this node keeps a record too if it is among the closest
+	if len(closest) < d.K || closer(d.Self.ID, closest[len(closest)-1].ID, key) {
+		d.addProvider(key, d.Self)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		errLock sync.Mutex
+		stored  int
+		lastErr error
+	)
+
+	for _, c := range closest {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+
+			err := d.Network.Provide(ctx, c, key, d.Self)
+
+			errLock.Lock()
+			defer errLock.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			stored++
+		}(c)
+	}
+	wg.Wait()
+
+	if len(closest) != 0 && stored == 0 {
+		return fmt.Errorf("provide (%s): no node stored the record: %w", key, lastErr)
+	}
+
+	return nil
+}
+
+// reports whether a is closer to target than b
+func closer(a ID, b ID, target ID) bool {
+	da, db := a.Distance(target), b.Distance(target)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// result of a single lookup request
+type response struct {
+	from      Contact
+	contacts  []Contact
+	providers []Contact
+	err       error
+}
+
+// iterate runs an iterative lookup towards target
+// querying alpha contacts at a time until the k closest
+// contacts seen have all been queried
+// if findValue is set the lookup stops at the first providers found
+func (d *DHT) iterate(ctx context.Context, target ID, findValue bool) ([]Contact, []Contact) {
+	shortlist := d.Closest(target, d.K)
+	seen := map[ID]bool{d.Self.ID: true}
+	for _, c := range shortlist {
+		seen[c.ID] = true
+	}
+
+	queried := map[ID]bool{}
+	failed := map[ID]bool{}
+	responses := make(chan response, d.Alpha)
+	inflight := 0
+
+	for {
+		// query the closest contacts not queried yet
+		for _, c := range shortlist {
+			if inflight == d.Alpha {
+				break
+			}
+			if queried[c.ID] {
+				continue
+			}
+			queried[c.ID] = true
+			inflight++
+			go d.query(ctx, c, target, findValue, responses)
+		}
+
+		// every contact in the shortlist answered
+		if inflight == 0 {
+			break
+		}
+
+		r := <-responses
+		inflight--
+
+		if r.err != nil {
+			failed[r.from.ID] = true
+			d.Remove(r.from.ID)
+			continue
+		}
+
+		d.Update(r.from)
+
+		if findValue && len(r.providers) != 0 {
+			// let outstanding queries finish in the background
+			go func(n int) {
+				for ; n > 0; n-- {
+					<-responses
+				}
+			}(inflight)
+			return nil, r.providers
+		}
+
+		for _, c := range r.contacts {
+			if !seen[c.ID] {
+				seen[c.ID] = true
+				shortlist = append(shortlist, c)
+			}
+		}
+
+		// keep the k closest contacts that did not fail
+		live := shortlist[:0]
+		for _, c := range shortlist {
+			if !failed[c.ID] {
+				live = append(live, c)
+			}
+		}
+		shortlist = live
+		sortByDistance(shortlist, target)
+		if len(shortlist) > d.K {
+			shortlist = shortlist[:d.K]
+		}
+	}
+
+	return shortlist, nil
+}
+
+func (d *DHT) query(ctx context.Context, c Contact, target ID, findValue bool, out chan<- response) {
+	r := response{from: c}
+	if findValue {
+		r.providers, r.contacts, r.err = d.Network.FindValue(ctx, c, target)
+	} else {
+		r.contacts, r.err = d.Network.FindNode(ctx, c, target)
+	}
+	out <- r
+}
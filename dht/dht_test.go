@@ -0,0 +1,173 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testNetwork delivers requests directly to in process nodes
+type testNetwork struct {
+	lock  sync.Mutex
+	nodes map[string]*DHT
+
+	// addresses of nodes that do not answer
+	down map[string]bool
+}
+
+func (n *testNetwork) node(c Contact) (*DHT, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.down[c.Addr] {
+		return nil, fmt.Errorf("node (%s) unreachable", c.Addr)
+	}
+	return n.nodes[c.Addr], nil
+}
+
+type testTransport struct {
+	net  *testNetwork
+	self Contact
+}
+
+func (t testTransport) FindNode(ctx context.Context, to Contact, target ID) ([]Contact, error) {
+	d, err := t.net.node(to)
+	if err != nil {
+		return nil, err
+	}
+	return d.HandleFindNode(t.self, target), nil
+}
+
+func (t testTransport) FindValue(ctx context.Context, to Contact, key ID) ([]Contact, []Contact, error) {
+	d, err := t.net.node(to)
+	if err != nil {
+		return nil, nil, err
+	}
+	providers, closer := d.HandleFindValue(t.self, key)
+	return providers, closer, nil
+}
+
+func (t testTransport) Provide(ctx context.Context, to Contact, key ID, p Contact) error {
+	d, err := t.net.node(to)
+	if err != nil {
+		return err
+	}
+	d.HandleProvide(t.self, key, p)
+	return nil
+}
+
+// creates n nodes that all bootstrap through the first one
+func testCluster(n int) (*testNetwork, []*DHT) {
+	net := &testNetwork{
+		nodes: make(map[string]*DHT),
+		down:  make(map[string]bool),
+	}
+
+	nodes := make([]*DHT, n)
+	for i := range nodes {
+		addr := fmt.Sprintf("node-%d", i)
+		self := Contact{ID: NewID([]byte(addr)), Addr: addr}
+		nodes[i] = NewDHT(DHTOpts{
+			Self:    self,
+			Network: testTransport{net: net, self: self},
+			K:       8,
+		})
+		net.nodes[addr] = nodes[i]
+	}
+
+	for _, d := range nodes[1:] {
+		d.Update(nodes[0].Self)
+		d.Bootstrap(context.Background())
+	}
+
+	return net, nodes
+}
+
+func TestDHTBucket(t *testing.T) {
+	var a, b ID
+	b[0] = 0x80
+	assert.Equal(t, 0, a.bucket(b))
+
+	b[0] = 0x01
+	assert.Equal(t, 7, a.bucket(b))
+
+	b[0], b[1] = 0, 0x40
+	assert.Equal(t, 9, a.bucket(b))
+}
+
+func TestDHTLookup(t *testing.T) {
+	_, nodes := testCluster(50)
+
+	// every node learned about more than its bootstrap node
+	for _, d := range nodes {
+		assert.Greater(t, d.Size(), 1)
+	}
+
+	// an iterative lookup finds the node with the target id
+	target := nodes[37].Self
+	closest := nodes[12].Lookup(context.Background(), target.ID)
+	assert.NotEmpty(t, closest)
+	assert.Equal(t, target, closest[0])
+}
+
+func TestDHTProviders(t *testing.T) {
+	net, nodes := testCluster(50)
+
+	key, err := KeyFromDigest("b159a9f0a78305c07dbce386598952bfa30b6aabb46a98b072c9195348abf9ea")
+	assert.Nil(t, err)
+
+	assert.Nil(t, nodes[3].Provide(context.Background(), key))
+
+	// any node locates the provider without a full mesh
+	for _, d := range []*DHT{nodes[0], nodes[21], nodes[49]} {
+		providers := d.FindProviders(context.Background(), key)
+		assert.Contains(t, providers, nodes[3].Self)
+	}
+
+	// lookups route around nodes that are down
+	net.lock.Lock()
+	for _, addr := range []string{"node-0", "node-1", "node-2"} {
+		net.down[addr] = true
+	}
+	net.lock.Unlock()
+
+	providers := nodes[30].FindProviders(context.Background(), key)
+	assert.Contains(t, providers, nodes[3].Self)
+}
+
+func TestDHTProviderLimits(t *testing.T) {
+	d := NewDHT(DHTOpts{
+		Self:            Contact{ID: NewID([]byte("self")), Addr: "self"},
+		K:               2,
+		MaxProviderKeys: 2,
+	})
+
+	contact := func(addr string) Contact {
+		return Contact{ID: NewID([]byte(addr)), Addr: addr}
+	}
+
+	// a key keeps its k most recently provided records
+	key := NewID([]byte("key"))
+	d.addProvider(key, contact("node-1"))
+	d.addProvider(key, contact("node-2"))
+	d.addProvider(key, contact("node-1"))
+	d.addProvider(key, contact("node-3"))
+	assert.Equal(t, []Contact{contact("node-1"), contact("node-3")}, d.localProviders(key))
+
+	// the least recently provided key goes first
+	other := NewID([]byte("other"))
+	d.addProvider(other, contact("node-1"))
+	d.addProvider(NewID([]byte("third")), contact("node-1"))
+	assert.Empty(t, d.localProviders(key))
+	assert.Len(t, d.localProviders(other), 1)
+
+	// records expire unless they are provided again
+	d.ProviderTTL = time.Millisecond
+	d.addProvider(key, contact("node-1"))
+	time.Sleep(5 * time.Millisecond)
+	assert.Empty(t, d.localProviders(key))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/luqxus/dstore/crypto"
+)
+
+// magic bytes at the start of every envelope encrypted object
+var envelopeMagic = []byte("EHRE")
+
+const (
+	// envelope format version
+	envelopeVersion = 1
+
+	// size of a data encryption key
+	dataKeySize = 32
+)
+
+// Encryptor encrypts objects before they are written to disk
+// and decrypts them when they are read back
+type Encryptor interface {
+	// Encrypt returns a writer that encrypts everything written to it into w
+	// the encrypted object is only complete once the writer is closed
+	Encrypt(w io.Writer) (io.WriteCloser, error)
+
+	// Decrypt returns a reader over the decrypted content of r
+	// reads fail if the object has been tampered with
+	Decrypt(r io.Reader) (io.Reader, error)
+
+	// PlainSize returns the content size of an encrypted object of n bytes
+	PlainSize(n int64) int64
+}
+
+// EnvelopeEncryptor implements Encryptor with AES-256-GCM envelope encryption
+// every object is sealed with a fresh data key which is stored
+// next to the object wrapped by the node master key
+type EnvelopeEncryptor struct {
+	master cipher.AEAD
+}
+
+// NewEnvelopeEncryptor takes a 32 byte node master key
+// returns *EnvelopeEncryptor | error
+func NewEnvelopeEncryptor(masterKey []byte) (*EnvelopeEncryptor, error) {
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(masterKey))
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	master, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EnvelopeEncryptor{
+		master: master,
+	}, nil
+}
+
+// envelope header is magic | version | wrap nonce | wrapped data key
+func (e *EnvelopeEncryptor) headerSize() int64 {
+	return int64(len(envelopeMagic) + 1 + e.master.NonceSize() + dataKeySize + e.master.Overhead())
+}
+
+func (e *EnvelopeEncryptor) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	// generate per object data key
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, e.master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{}, envelopeMagic...)
+	header = append(header, envelopeVersion)
+
+	// wrap data key with node master key
+	// header prefix is authenticated so it cannot be altered
+	wrapped := e.master.Seal(nil, nonce, dataKey, header)
+
+	header = append(header, nonce...)
+	header = append(header, wrapped...)
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return crypto.NewSealWriter(w, dataKey)
+}
+
+func (e *EnvelopeEncryptor) Decrypt(r io.Reader) (io.Reader, error) {
+	header := make([]byte, e.headerSize())
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, crypto.ErrTampered
+	}
+
+	prefix := header[:len(envelopeMagic)+1]
+	if !bytes.Equal(prefix[:len(envelopeMagic)], envelopeMagic) {
+		return nil, errors.New("object is not envelope encrypted")
+	}
+
+	if prefix[len(envelopeMagic)] != envelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", prefix[len(envelopeMagic)])
+	}
+
+	nonce := header[len(prefix) : len(prefix)+e.master.NonceSize()]
+	wrapped := header[len(prefix)+e.master.NonceSize():]
+
+	// unwrap data key with node master key
+	dataKey, err := e.master.Open(nil, nonce, wrapped, prefix)
+	if err != nil {
+		return nil, crypto.ErrTampered
+	}
+
+	return crypto.NewOpenReader(r, dataKey)
+}
+
+func (e *EnvelopeEncryptor) PlainSize(n int64) int64 {
+	return crypto.OpenedSize(n - e.headerSize())
+}
@@ -0,0 +1,333 @@
+// Package erasure implements systematic Reed-Solomon coding over GF(2^8)
+// data is split into data shards and parity shards are computed
+// so the data can be rebuilt from any data shards of the total
+package erasure
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxShards is the largest number of data and parity shards
+// every shard needs its own element of GF(2^8)
+const MaxShards = 256
+
+// ErrTooFewShards is returned when fewer shards than
+// data shards are available to rebuild from
+var ErrTooFewShards = errors.New("too few shards")
+
+// Coder encodes and rebuilds shards
+type Coder struct {
+	data   int
+	parity int
+
+	// (data + parity) x data encoding matrix
+	// the top data rows are the identity so data shards hold the data as is
+	matrix matrix
+}
+
+// New returns a Coder splitting data into data shards
+// protected by parity shards
+// returns *Coder | error
+func New(data, parity int) (*Coder, error) {
+	if data <= 0 || parity < 0 || data+parity > MaxShards {
+		return nil, fmt.Errorf("invalid shard counts %d + %d", data, parity)
+	}
+
+	// any data rows of a Vandermonde matrix are invertible and stay so
+	// once the matrix is multiplied by the inverse of its top rows
+	v := vandermonde(data+parity, data)
+	top, err := v[:data].invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Coder{
+		data:   data,
+		parity: parity,
+		matrix: v.mul(top),
+	}, nil
+}
+
+// DataShards returns the number of data shards
+func (c *Coder) DataShards() int {
+	return c.data
+}
+
+// ParityShards returns the number of parity shards
+func (c *Coder) ParityShards() int {
+	return c.parity
+}
+
+// Encode computes the parity shards from the data shards
+// shards holds data + parity shards of the same size
+// parity shards are overwritten
+func (c *Coder) Encode(shards [][]byte) error {
+	if err := c.check(shards); err != nil {
+		return err
+	}
+
+	for p := c.data; p < len(shards); p++ {
+		clear(shards[p])
+		for d := 0; d < c.data; d++ {
+			mulAdd(c.matrix[p][d], shards[d], shards[p])
+		}
+	}
+
+	return nil
+}
+
+// Reconstruct fills the missing shards from the ones present
+// missing shards are nil and are allocated
+// fails with ErrTooFewShards if fewer than data shards are present
+func (c *Coder) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.data+c.parity {
+		return fmt.Errorf("%d shards instead of %d", len(shards), c.data+c.parity)
+	}
+
+	// rows of the shards rebuilt from
+	present := []int{}
+	size := 0
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if len(present) != 0 && len(shard) != size {
+			return errors.New("shards differ in size")
+		}
+		size = len(shard)
+		present = append(present, i)
+	}
+
+	if len(present) < c.data {
+		return fmt.Errorf("%w: %d of %d", ErrTooFewShards, len(present), c.data)
+	}
+	if len(present) == len(shards) {
+		return nil
+	}
+
+	// the data is rebuilt if any data shard is missing
+	missingData := false
+	for d := 0; d < c.data; d++ {
+		missingData = missingData || shards[d] == nil
+	}
+
+	if missingData {
+		present = present[:c.data]
+
+		// the present shards are the encoding rows times the data
+		// so the data is the inverse of those rows times the shards
+		sub := make(matrix, c.data)
+		for i, row := range present {
+			sub[i] = c.matrix[row]
+		}
+
+		decode, err := sub.invert()
+		if err != nil {
+			return err
+		}
+
+		for d := 0; d < c.data; d++ {
+			if shards[d] != nil {
+				continue
+			}
+
+			out := make([]byte, size)
+			for i, row := range present {
+				mulAdd(decode[d][i], shards[row], out)
+			}
+			shards[d] = out
+		}
+	}
+
+	// missing parity is encoded again from the data
+	for p := c.data; p < len(shards); p++ {
+		if shards[p] != nil {
+			continue
+		}
+
+		out := make([]byte, size)
+		for d := 0; d < c.data; d++ {
+			mulAdd(c.matrix[p][d], shards[d], out)
+		}
+		shards[p] = out
+	}
+
+	return nil
+}
+
+// checks that shards are data + parity shards of the same size
+func (c *Coder) check(shards [][]byte) error {
+	if len(shards) != c.data+c.parity {
+		return fmt.Errorf("%d shards instead of %d", len(shards), c.data+c.parity)
+	}
+
+	for _, shard := range shards {
+		if len(shard) != len(shards[0]) {
+			return errors.New("shards differ in size")
+		}
+	}
+
+	return nil
+}
+
+// Split reads r to its end and writes it to the data shards
+// and its parity to the parity shards stripe by stripe
+// every stripe is blockSize bytes of every shard
+// the last stripe is padded with zeros
+// returns bytes read from r (int64) | error
+func (c *Coder) Split(r io.Reader, shards []io.Writer, blockSize int) (int64, error) {
+	if len(shards) != c.data+c.parity {
+		return 0, fmt.Errorf("%d shards instead of %d", len(shards), c.data+c.parity)
+	}
+
+	blocks := c.blocks(blockSize)
+
+	var n int64
+	for {
+		// data blocks are read in order
+		// blocks after the end of r are zeros
+		read := 0
+		var err error
+		for d := 0; d < c.data; d++ {
+			m := 0
+			if err == nil {
+				m, err = io.ReadFull(r, blocks[d])
+			}
+			clear(blocks[d][m:])
+			read += m
+		}
+
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return n, err
+		}
+
+		if read == 0 {
+			return n, nil
+		}
+		n += int64(read)
+
+		if err := c.Encode(blocks); err != nil {
+			return n, err
+		}
+
+		for i, w := range shards {
+			if _, err := w.Write(blocks[i]); err != nil {
+				return n, err
+			}
+		}
+
+		// a short stripe is the last one
+		if err != nil {
+			return n, nil
+		}
+	}
+}
+
+// Join writes the first size bytes of the data split into shards to w
+// missing shards are nil and data shards among them are rebuilt
+// from the others stripe by stripe
+func (c *Coder) Join(w io.Writer, shards []io.Reader, blockSize int, size int64) error {
+	if len(shards) != c.data+c.parity {
+		return fmt.Errorf("%d shards instead of %d", len(shards), c.data+c.parity)
+	}
+
+	// rebuilding starts from the data shards
+	readers := make([]io.Reader, len(shards))
+	present := 0
+	for i, r := range shards {
+		if r != nil && present < c.data {
+			readers[i] = r
+			present++
+		}
+	}
+
+	stripe := int64(c.data) * int64(blockSize)
+	for left := size; left > 0; left -= stripe {
+		blocks, err := c.readStripe(readers, blockSize)
+		if err != nil {
+			return err
+		}
+
+		for d := 0; d < c.data && left > 0; d++ {
+			b := blocks[d]
+			if rest := left - int64(d)*int64(blockSize); rest < int64(len(b)) {
+				b = b[:max(rest, 0)]
+			}
+
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Rebuild writes the shards missing from shards to out
+// for every out[i] that is not nil | shards are nil when missing
+// stripes is the number of blockSize blocks in every shard
+func (c *Coder) Rebuild(out []io.Writer, shards []io.Reader, blockSize int, stripes int64) error {
+	if len(shards) != c.data+c.parity || len(out) != len(shards) {
+		return fmt.Errorf("%d shards instead of %d", len(shards), c.data+c.parity)
+	}
+
+	readers := make([]io.Reader, len(shards))
+	present := 0
+	for i, r := range shards {
+		if r != nil && present < c.data {
+			readers[i] = r
+			present++
+		}
+	}
+
+	for ; stripes > 0; stripes-- {
+		blocks, err := c.readStripe(readers, blockSize)
+		if err != nil {
+			return err
+		}
+
+		for i, w := range out {
+			if w == nil {
+				continue
+			}
+			if _, err := w.Write(blocks[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// read the next block of every reader that is not nil
+// and reconstruct the blocks of the others
+func (c *Coder) readStripe(readers []io.Reader, blockSize int) ([][]byte, error) {
+	blocks := make([][]byte, len(readers))
+	for i, r := range readers {
+		if r == nil {
+			continue
+		}
+
+		blocks[i] = make([]byte, blockSize)
+		if _, err := io.ReadFull(r, blocks[i]); err != nil {
+			return nil, fmt.Errorf("reading shard %d: %w", i, err)
+		}
+	}
+
+	if err := c.Reconstruct(blocks); err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// returns data + parity blocks of blockSize bytes
+func (c *Coder) blocks(blockSize int) [][]byte {
+	blocks := make([][]byte, c.data+c.parity)
+	for i := range blocks {
+		blocks[i] = make([]byte, blockSize)
+	}
+	return blocks
+}
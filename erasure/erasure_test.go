@@ -0,0 +1,98 @@
+package erasure
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGalois(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		assert.Equal(t, byte(1), mul(byte(a), inv(byte(a))))
+	}
+	assert.Equal(t, byte(0), mul(0, 7))
+	assert.Equal(t, mul(mul(3, 3), 3), pow(3, 3))
+}
+
+func TestReconstruct(t *testing.T) {
+	c, err := New(4, 2)
+	assert.Nil(t, err)
+
+	shards := make([][]byte, 6)
+	for i := range shards {
+		shards[i] = make([]byte, 100)
+		if i < 4 {
+			rand.Read(shards[i])
+		}
+	}
+	assert.Nil(t, c.Encode(shards))
+
+	// any two shards may be lost
+	for a := 0; a < len(shards); a++ {
+		for b := a + 1; b < len(shards); b++ {
+			damaged := make([][]byte, len(shards))
+			copy(damaged, shards)
+			damaged[a], damaged[b] = nil, nil
+
+			assert.Nil(t, c.Reconstruct(damaged))
+			assert.Equal(t, shards, damaged)
+		}
+	}
+
+	damaged := make([][]byte, len(shards))
+	copy(damaged, shards)
+	damaged[0], damaged[1], damaged[5] = nil, nil, nil
+	assert.ErrorIs(t, c.Reconstruct(damaged), ErrTooFewShards)
+
+	_, err = New(200, 57)
+	assert.NotNil(t, err)
+}
+
+func TestSplitJoin(t *testing.T) {
+	c, err := New(3, 2)
+	assert.Nil(t, err)
+
+	// the last stripe is partial
+	data := make([]byte, 10000)
+	rand.Read(data)
+
+	bufs := make([]*bytes.Buffer, 5)
+	writers := make([]io.Writer, 5)
+	for i := range bufs {
+		bufs[i] = new(bytes.Buffer)
+		writers[i] = bufs[i]
+	}
+
+	n, err := c.Split(bytes.NewReader(data), writers, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	// 4 stripes of 1024 bytes in every shard
+	for _, b := range bufs {
+		assert.Equal(t, 4096, b.Len())
+	}
+
+	// a data and a parity shard are lost
+	readers := make([]io.Reader, 5)
+	for _, i := range []int{0, 2, 3} {
+		readers[i] = bytes.NewReader(bufs[i].Bytes())
+	}
+
+	out := new(bytes.Buffer)
+	assert.Nil(t, c.Join(out, readers, 1024, int64(len(data))))
+	assert.Equal(t, data, out.Bytes())
+
+	// the lost shards are written again
+	for _, i := range []int{0, 2, 3} {
+		readers[i] = bytes.NewReader(bufs[i].Bytes())
+	}
+
+	rebuilt := []*bytes.Buffer{nil, new(bytes.Buffer), nil, nil, new(bytes.Buffer)}
+	outs := []io.Writer{nil, rebuilt[1], nil, nil, rebuilt[4]}
+	assert.Nil(t, c.Rebuild(outs, readers, 1024, 4))
+	assert.Equal(t, bufs[1].Bytes(), rebuilt[1].Bytes())
+	assert.Equal(t, bufs[4].Bytes(), rebuilt[4].Bytes())
+}
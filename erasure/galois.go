@@ -0,0 +1,156 @@
+package erasure
+
+import "errors"
+
+// arithmetic in GF(2^8) with the reducing polynomial
+// x^8 + x^4 + x^3 + x^2 + 1 and generator 2
+// addition and subtraction are both XOR
+const polynomial = 0x11d
+
+var (
+	// expTable[i] is 2^i | doubled so products need no reduction
+	expTable [510]byte
+
+	// logTable[x] is the i with 2^i = x | undefined for 0
+	logTable [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= polynomial
+		}
+	}
+}
+
+// returns a * b
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// returns the inverse of a | a must not be 0
+func inv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// returns a^n
+func pow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])*n)%255]
+}
+
+// adds c * in to out
+func mulAdd(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+
+	lc := int(logTable[c])
+	for i, x := range in {
+		if x != 0 {
+			out[i] ^= expTable[lc+int(logTable[x])]
+		}
+	}
+}
+
+// errSingular is returned when a matrix has no inverse
+var errSingular = errors.New("matrix is singular")
+
+// matrix of GF(2^8) elements stored row by row
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+// returns the rows x cols Vandermonde matrix with m[r][c] = r^c
+// any cols of its rows are linearly independent
+func vandermonde(rows, cols int) matrix {
+	m := newMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = pow(byte(r), c)
+		}
+	}
+	return m
+}
+
+// returns m * other
+func (m matrix) mul(other matrix) matrix {
+	out := newMatrix(len(m), len(other[0]))
+	for r := range m {
+		for c := range out[r] {
+			var x byte
+			for i := range other {
+				x ^= mul(m[r][i], other[i][c])
+			}
+			out[r][c] = x
+		}
+	}
+	return out
+}
+
+// returns the inverse of square matrix m by Gauss-Jordan elimination
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+
+	// m is reduced to the identity while the same
+	// operations turn the identity into the inverse
+	work := newMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		// a row with a non zero pivot
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errSingular
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		// scale the pivot to 1
+		if x := work[c][c]; x != 1 {
+			scale := inv(x)
+			for i := range work[c] {
+				work[c][i] = mul(work[c][i], scale)
+			}
+		}
+
+		// clear the column in every other row
+		for r := 0; r < n; r++ {
+			if r != c {
+				mulAdd(work[r][c], work[c], work[r])
+			}
+		}
+	}
+
+	out := newMatrix(n, n)
+	for r := range out {
+		copy(out[r], work[r][n:])
+	}
+
+	return out, nil
+}
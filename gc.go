@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// default time between two garbage collections
+	defaultGCInterval = 6 * time.Hour
+
+	// default time objects are kept after they were written
+	// or linked even if no record refers to them yet
+	defaultGCGrace = time.Hour
+)
+
+// garbage collection options
+type GCOpts struct {
+
+	// versions of every record whose content is kept
+	// the latest ones | all if zero
+	KeepVersions int
+
+	// objects written or linked less than Grace ago are kept
+	// so writes in progress are never collected
+	// defaultGCGrace if zero | none if negative
+	Grace time.Duration
+
+	// report what would be removed without removing it
+	DryRun bool
+}
+
+// GCReport tells what a garbage collection removed
+// or would remove on a dry run
+type GCReport struct {
+	DryRun bool
+
+	// digests of the objects no record refers to
+	Objects []string
+
+	// content bytes of Objects
+	Bytes int64
+
+	// chunks no held object lists
+	Chunks int
+
+	// folders holding no blobs | on a dry run only the ones
+	// that were empty before anything was removed
+	Dirs []string
+
+	// unreferenced objects kept as they were written
+	// or linked less than the grace period ago
+	Kept int
+}
+
+// CollectGarbage removes the objects no record refers to
+// the chunks no held object lists and the folders left empty
+// objects are referenced by key mappings and by the versions of
+// every record | the latest opts.KeepVersions if it is set
+func (s *Store) CollectGarbage(opts GCOpts) (GCReport, error) {
+	if opts.Grace == 0 {
+		opts.Grace = defaultGCGrace
+	}
+
+	report := GCReport{DryRun: opts.DryRun, Objects: []string{}}
+
+	// objects are listed before the references are so an
+	// object written meanwhile is either referenced or fresh
+	digests, err := s.Objects()
+	if err != nil {
+		return report, err
+	}
+
+	referenced, err := s.referenced(opts.KeepVersions)
+	if err != nil {
+		return report, err
+	}
+
+	// no object is committed while garbage is swept
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+
+	swept := make(map[string]bool)
+	for _, digest := range digests {
+		if referenced[digest] {
+			continue
+		}
+
+		m, err := s.Manifest(digest)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+
+		if time.Since(m.Written) <= opts.Grace {
+			report.Kept++
+			continue
+		}
+
+		report.Objects = append(report.Objects, digest)
+		report.Bytes += m.Size
+		swept[digest] = true
+
+		if opts.DryRun {
+			continue
+		}
+
+		if err := s.removeObject(digest); err != nil {
+			return report, err
+		}
+	}
+
+	chunks, err := s.orphanChunks(swept)
+	if err != nil {
+		return report, err
+	}
+	report.Chunks = len(chunks)
+
+	if !opts.DryRun {
+		for _, key := range chunks {
+			if err := s.Blobs.Delete(key); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	// empty folders are left behind by removed blobs
+	if pruner, ok := s.Blobs.(blobDirPruner); ok {
+		report.Dirs, err = pruner.PruneDirs(s.ownsDir, opts.DryRun)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// returns the digests referenced by key mappings and by the
+// versions of every record | the latest keep versions if keep
+// is not zero | shards of erasure coded records included
+func (s *Store) referenced(keep int) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+
+	// names of deleted keys are removed with their metadata
+	// but names restored by repair have none
+	entries, err := readDir(s.Root + "/" + namesFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		// skip mappings that are still being written
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+
+		b, err := os.ReadFile(s.Root + "/" + namesFolder + "/" + entry.Name())
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		referenced[string(b)] = true
+	}
+
+	idx, err := s.index()
+	if err != nil {
+		return nil, err
+	}
+
+	err = idx.Walk(func(versions []Metadata) error {
+		if keep > 0 && len(versions) > keep {
+			versions = versions[len(versions)-keep:]
+		}
+
+		for _, meta := range versions {
+			referenced[meta.Digest] = true
+			if meta.Erasure != nil {
+				for _, shard := range meta.Erasure.Shards {
+					referenced[shard] = true
+				}
+			}
+		}
+		return nil
+	})
+
+	return referenced, err
+}
+
+// returns the keys of the chunks no held object lists
+// objects in swept are about to be removed with their chunks
+// commitLock must be held
+func (s *Store) orphanChunks(swept map[string]bool) ([]string, error) {
+	keys, err := s.Blobs.List(chunksFolder + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	// chunks listed by the manifest of every object seen
+	listed := make(map[string]map[string]bool)
+
+	orphans := []string{}
+	for _, key := range keys {
+		digest, chunk := path.Base(path.Dir(key)), path.Base(key)
+		if !isSHA256Hex(digest) || swept[digest] {
+			continue
+		}
+		if expected, err := s.chunkKey(digest, chunk); err != nil || key != expected {
+			continue
+		}
+
+		if _, ok := listed[digest]; !ok {
+			listed[digest] = make(map[string]bool)
+
+			m, err := s.Manifest(digest)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			for _, c := range m.Chunks {
+				listed[digest][c.Digest] = true
+			}
+		}
+
+		if !listed[digest][chunk] {
+			orphans = append(orphans, key)
+		}
+	}
+
+	return orphans, nil
+}
+
+// reports whether the folder with key dir holds blobs of the store
+// and no files written next to them
+func (s *Store) ownsDir(dir string) bool {
+	top, _, _ := strings.Cut(dir, "/")
+	switch top {
+	case namesFolder, tmpFolder, tombstonesFolder, metadataFolder, quarantineFolder:
+		return false
+	}
+	return true
+}
+
+// record in its manifest that the object with digest was written
+// again so garbage collection keeps it for the grace period
+// even if the node restarts meanwhile
+func (s *Store) touch(digest string) error {
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+
+	return s.touchLocked(digest)
+}
+
+// touch with commitLock held
+func (s *Store) touchLocked(digest string) error {
+	m, err := s.Manifest(digest)
+	if err != nil {
+		return err
+	}
+
+	key, err := s.manifestKey(digest)
+	if err != nil {
+		return err
+	}
+
+	m.Written = time.Now().UTC()
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return s.writeBlob(key, b)
+}
+
+// CollectGarbage removes the objects no record held by this node
+// refers to | the node KeepVersions latest versions of every record
+// keep their content
+// returns GCReport | error
+func (s *FileServer) CollectGarbage(dryRun bool) (GCReport, error) {
+	report, err := s.store.CollectGarbage(GCOpts{
+		KeepVersions: s.KeepVersions,
+		DryRun:       dryRun,
+	})
+	if err != nil {
+		return report, fmt.Errorf("collecting garbage: %w", err)
+	}
+
+	if !dryRun {
+		s.announceUsage()
+	}
+
+	return report, nil
+}
+
+// run garbage collection every GCInterval until the server stops
+func (s *FileServer) gcLoop() {
+	ticker := time.NewTicker(s.GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			report, err := s.CollectGarbage(false)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if len(report.Objects) != 0 || report.Chunks != 0 {
+				log.Printf("collected (%d) objects (%d bytes) and (%d) chunks", len(report.Objects), report.Bytes, report.Chunks)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// blob keys are stored under blobPrefix so the database
+// may hold other data next to them
+const blobPrefix = "blob/"
+
+// writes reach the disk before they return like files
+// written by the filesystem blob store
+var syncWrites = &opt.WriteOptions{Sync: true}
+
+// KVBlobStore keeps every blob as a value of an embedded
+// key-value database | blobs are read and written whole
+// which suits the chunks objects are split into
+type KVBlobStore struct {
+	db *leveldb.DB
+}
+
+// open or create the key-value blob store at path
+// returns *KVBlobStore | error
+func OpenKVBlobStore(path string) (*KVBlobStore, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KVBlobStore{db: db}, nil
+}
+
+// Close closes the database
+func (b *KVBlobStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *KVBlobStore) Has(key string) (bool, error) {
+	return b.db.Has([]byte(blobPrefix+key), nil)
+}
+
+func (b *KVBlobStore) Stat(key string) (BlobInfo, error) {
+	value, err := b.get(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	return BlobInfo{Key: key, Size: int64(len(value))}, nil
+}
+
+func (b *KVBlobStore) Open(key string) (io.ReadCloser, error) {
+	value, err := b.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(value)), nil
+}
+
+// returns the value of the blob with key
+func (b *KVBlobStore) get(key string) ([]byte, error) {
+	value, err := b.db.Get([]byte(blobPrefix+key), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, fmt.Errorf("blob (%s): %w", key, os.ErrNotExist)
+	}
+	return value, err
+}
+
+func (b *KVBlobStore) Write(key string, r io.Reader) (int64, error) {
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(value)), err
+	}
+
+	err = b.db.Put([]byte(blobPrefix+key), value, syncWrites)
+	return int64(len(value)), err
+}
+
+func (b *KVBlobStore) Delete(key string) error {
+	return b.db.Delete([]byte(blobPrefix+key), syncWrites)
+}
+
+func (b *KVBlobStore) DeletePrefix(prefix string) error {
+	batch := new(leveldb.Batch)
+
+	iter := b.db.NewIterator(util.BytesPrefix([]byte(blobPrefix+prefix)), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	iter.Release()
+
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return b.db.Write(batch, syncWrites)
+}
+
+func (b *KVBlobStore) List(prefix string) ([]string, error) {
+	keys := []string{}
+
+	iter := b.db.NewIterator(util.BytesPrefix([]byte(blobPrefix+prefix)), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		keys = append(keys, string(iter.Key()[len(blobPrefix):]))
+	}
+
+	return keys, iter.Error()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/hex"
 	"log"
 	"math/big"
 	"os"
@@ -58,19 +59,43 @@ func makeServer(listenAddr string, walletPath string, tmp string, nodes ...strin
 		log.Fatal(err)
 	}
 
+	// objects are encrypted at rest when a node master key is configured
+	var encryption Encryptor
+	if masterKey := os.Getenv("STORAGE_MASTER_KEY"); masterKey != "" {
+		key, err := hex.DecodeString(masterKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		encryption, err = NewEnvelopeEncryptor(key)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Println("STORAGE_MASTER_KEY not found, objects are stored unencrypted")
+	}
+
+	root := listenAddr + "_network"
+
 	tcpOpts := p2p.TCPTransportOpts{
 		ListenAddr:    listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder:       p2p.DefaultDecoder{},
+		HandshakeFunc: p2p.DefaultHandshakeFunc,
+		Decoder:       p2p.FrameDecoder{},
+		Encoder:       p2p.FrameEncoder{},
 		OnPeer:        OnPeer,
 		Contract:      contract,
+		Keystore:      ks,
 	}
 
 	tr := p2p.NewTCPTransport(tcpOpts)
 
 	fileServerOpts := FileServerOpts{
-		StorageRoot:       listenAddr + "_network",
+		StorageRoot:       root,
 		PathTransformFunc: CASPathTransformFunc,
+		Encryption:        encryption,
+		Compression:       CompressionGzip,
+		BlobStore:         makeBlobStore(root),
+		Keystore:          ks,
 		Transport:         tr,
 		BootstrapNodes:    nodes,
 	}
@@ -78,10 +103,45 @@ func makeServer(listenAddr string, walletPath string, tmp string, nodes ...strin
 	server := NewFileServer(fileServerOpts)
 
 	tr.OnPeer = server.OnPeer
+	tr.OnPeerDisconnect = server.OnPeerDisconnect
 
 	return server
 }
 
+// returns the blob store selected by STORAGE_BACKEND
+// objects are kept under root if it is not set
+func makeBlobStore(root string) BlobStore {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "fs":
+		return nil
+
+	case "kv":
+		blobs, err := OpenKVBlobStore(root + "/blobs")
+		if err != nil {
+			log.Fatal(err)
+		}
+		return blobs
+
+	case "s3":
+		blobs, err := NewS3BlobStore(S3BlobStoreOpts{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Prefix:    os.Getenv("S3_PREFIX"),
+			Region:    os.Getenv("S3_REGION"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return blobs
+
+	default:
+		log.Fatalf("unknown STORAGE_BACKEND (%s)", backend)
+		return nil
+	}
+}
+
 func main() {
 
 	err := godotenv.Load(".env")
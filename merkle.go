@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+)
+
+// number of leaves of a MerkleTree
+// objects are bucketed into leaves by the first byte of their digest
+const merkleLeaves = 256
+
+// number of nodes of a MerkleTree
+const merkleNodes = 2*merkleLeaves - 1
+
+// SyncEntry is an object in a node object set
+type SyncEntry struct {
+
+	// content digest
+	Digest string
+
+	// hashed keys mapped to the digest | sorted
+	Names []string
+}
+
+// MerkleTree summarizes a node object set
+// two nodes hold the same objects if their roots match and
+// differing subtrees narrow down the objects that differ
+//
+// nodes are stored heap ordered | the root is node 0
+// and the children of node i are 2i+1 and 2i+2
+type MerkleTree struct {
+	hashes  [merkleNodes][]byte
+	buckets [merkleLeaves][]SyncEntry
+}
+
+// NewMerkleTree builds the tree summarizing objects
+// objects maps content digests to the names mapped to them
+// returns *MerkleTree
+func NewMerkleTree(objects map[string][]string) *MerkleTree {
+	t := &MerkleTree{}
+
+	for digest, names := range objects {
+		b, err := hex.DecodeString(digest[:2])
+		if err != nil {
+			continue
+		}
+
+		names = append([]string(nil), names...)
+		sort.Strings(names)
+
+		t.buckets[b[0]] = append(t.buckets[b[0]], SyncEntry{
+			Digest: digest,
+			Names:  names,
+		})
+	}
+
+	// hash leaves over their sorted entries
+	for i, bucket := range t.buckets {
+		sort.Slice(bucket, func(a, b int) bool {
+			return bucket[a].Digest < bucket[b].Digest
+		})
+
+		h := sha256.New()
+		for _, entry := range bucket {
+			h.Write([]byte(entry.Digest))
+			for _, name := range entry.Names {
+				h.Write([]byte{'/'})
+				h.Write([]byte(name))
+			}
+			h.Write([]byte{'\n'})
+		}
+		t.hashes[merkleLeaves-1+i] = h.Sum(nil)
+	}
+
+	// hash interior nodes bottom up
+	for i := merkleLeaves - 2; i >= 0; i-- {
+		h := sha256.New()
+		h.Write(t.hashes[2*i+1])
+		h.Write(t.hashes[2*i+2])
+		t.hashes[i] = h.Sum(nil)
+	}
+
+	return t
+}
+
+// Root returns the hash summarizing the whole object set
+func (t *MerkleTree) Root() []byte {
+	return t.hashes[0]
+}
+
+// Hash returns the hash of node i | nil if i is out of range
+func (t *MerkleTree) Hash(i int) []byte {
+	if i < 0 || i >= merkleNodes {
+		return nil
+	}
+	return t.hashes[i]
+}
+
+// Entries returns the objects under leaf node i
+func (t *MerkleTree) Entries(i int) []SyncEntry {
+	if !isMerkleLeaf(i) {
+		return nil
+	}
+	return t.buckets[i-(merkleLeaves-1)]
+}
+
+// Diff returns the nodes among nodes whose hash differs from hashes
+// split into differing leaves and the children of differing interior nodes
+func (t *MerkleTree) Diff(nodes []int, hashes [][]byte) ([]int, []int) {
+	leaves, children := []int{}, []int{}
+
+	for j, i := range nodes {
+		if j < len(hashes) && bytes.Equal(t.Hash(i), hashes[j]) {
+			continue
+		}
+
+		if isMerkleLeaf(i) {
+			leaves = append(leaves, i)
+		} else {
+			children = append(children, 2*i+1, 2*i+2)
+		}
+	}
+
+	return leaves, children
+}
+
+// reports whether node i is a leaf
+func isMerkleLeaf(i int) bool {
+	return i >= merkleLeaves-1 && i < merkleNodes
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerkleTreeDiff(t *testing.T) {
+	a := map[string][]string{
+		"b159a9f0a78305c07dbce386598952bfa30b6aabb46a98b072c9195348abf9ea": {"n1"},
+		"0a01a9f0a78305c07dbce386598952bfa30b6aabb46a98b072c9195348abf9ea": {"n2"},
+	}
+	b := map[string][]string{
+		"b159a9f0a78305c07dbce386598952bfa30b6aabb46a98b072c9195348abf9ea": {"n1"},
+	}
+
+	ta, tb := NewMerkleTree(a), NewMerkleTree(b)
+	assert.NotEqual(t, ta.Root(), tb.Root())
+	assert.Equal(t, ta.Root(), NewMerkleTree(a).Root())
+
+	// descend from the root to the single differing leaf
+	nodes, leaves := []int{0}, []int{}
+	for len(nodes) != 0 {
+		hashes := [][]byte{}
+		for _, i := range nodes {
+			hashes = append(hashes, tb.Hash(i))
+		}
+
+		differing, children := ta.Diff(nodes, hashes)
+		leaves = append(leaves, differing...)
+		nodes = children
+	}
+
+	assert.Equal(t, []int{merkleLeaves - 1 + 0x0a}, leaves)
+	assert.Equal(t, []SyncEntry{{
+		Digest: "0a01a9f0a78305c07dbce386598952bfa30b6aabb46a98b072c9195348abf9ea",
+		Names:  []string{"n2"},
+	}}, ta.Entries(leaves[0]))
+}
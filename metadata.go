@@ -0,0 +1,875 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// metadataFolder holds the metadata index database
+const metadataFolder = "metadata"
+
+// default and largest number of records returned by a listing
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// index key prefixes | secondary keys end with the record key
+// so every listing is ordered by key
+const (
+	metaPrefix    = "meta/"
+	ownerPrefix   = "owner/"
+	patientPrefix = "patient/"
+	namePrefix    = "name/"
+	versionPrefix = "version/"
+	usagePrefix   = "usage/"
+	chargePrefix  = "charge/"
+	refPrefix     = "ref/"
+)
+
+// marks an index holding the references of key mappings
+// and versions to the content they map to
+const refsIndexedKey = "refs-indexed"
+
+// marks an index whose owner usage counters are kept up to date
+// with the content every owner is charged for | indexes written
+// before the charges were kept are counted again when opened
+const (
+	usageChargedKey = "usage-charged"
+	usageCountedKey = "usage-counted"
+)
+
+// ErrNoMetadata is returned when a key has no metadata
+var ErrNoMetadata = errors.New("metadata not found")
+
+// ErrVersionConflict is returned when a version of a key is recorded
+// with other content than the one it was first recorded with
+var ErrVersionConflict = errors.New("version recorded with other content")
+
+// ReplicationState summarizes how many copies of a record exist
+type ReplicationState string
+
+const (
+	// only this node is known to hold the record
+	ReplicationLocal ReplicationState = "local"
+
+	// fewer nodes than wanted are known to hold the record
+	ReplicationPartial ReplicationState = "partial"
+
+	// the record has all the copies it wants
+	ReplicationComplete ReplicationState = "complete"
+)
+
+// Metadata describes a version of a record held by the store
+// versions are immutable | amending a record adds a version
+// whose parent is the digest of the version it amends
+type Metadata struct {
+	Key string
+
+	// SHA-256 digest of the stored content
+	Digest string
+
+	// version number starting at 1
+	Version int
+
+	// digest of the previous version | empty for the first version
+	Parent string
+
+	// Ethereum address of the node or user that wrote the version
+	Author string
+
+	// content size in bytes
+	Size int64
+
+	// MIME type of the content | empty if unknown
+	ContentType string
+
+	// compression the content is stored with on this node
+	// CompressionNone if empty
+	Compression string
+
+	// when the version was written
+	CreatedAt time.Time
+
+	// Ethereum address of the node or user owning the record
+	Owner string
+
+	// Ethereum address the content of the version is charged to
+	// on this node | Owner if empty | never sent to other nodes
+	chargedTo string
+
+	// patient the health record belongs to
+	PatientID string
+
+	// ids of the nodes known to hold a copy
+	Replicas []string
+
+	// number of copies wanted including this node
+	// or number of shards if the record is erasure coded
+	ReplicationFactor int
+
+	// shards the content is split into | nil if the record is replicated
+	// erasure coded content is not mapped to the key on disk
+	Erasure *ErasureLayout
+}
+
+// ReplicationState returns the replication state of the record
+func (m Metadata) ReplicationState() ReplicationState {
+	switch {
+	case len(m.Replicas) >= m.ReplicationFactor:
+		return ReplicationComplete
+	case len(m.Replicas) > 1:
+		return ReplicationPartial
+	}
+	return ReplicationLocal
+}
+
+// MetadataQuery selects records in a listing
+// empty fields match any record
+type MetadataQuery struct {
+	Owner     string
+	PatientID string
+
+	// keys must start with Prefix
+	Prefix string
+
+	// only keys sorted after After are returned
+	// the last key of a page fetches the next page
+	After string
+
+	// at most Limit records | defaultListLimit if zero
+	Limit int
+}
+
+// returns the number of records a listing returns at most
+func (q MetadataQuery) limit() int {
+	if q.Limit <= 0 {
+		return defaultListLimit
+	}
+	return min(q.Limit, maxListLimit)
+}
+
+// MetadataIndex is an embedded database of record metadata
+// kept next to the objects it describes
+type MetadataIndex struct {
+	db *leveldb.DB
+
+	// serializes updates reading the old metadata
+	lock sync.Mutex
+}
+
+// OpenMetadataIndex opens or creates the index at path
+// returns *MetadataIndex | error
+func OpenMetadataIndex(path string) (*MetadataIndex, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MetadataIndex{db: db}, nil
+}
+
+// OwnerUsage returns the bytes of content held for owner
+// counted once for every distinct content owner is charged for
+func (idx *MetadataIndex) OwnerUsage(owner string) (int64, error) {
+	b, err := idx.db.Get(usageKey(owner), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+// adds to batch the change of the usage of owner by n bytes
+// the index lock must be held until batch is written
+func (idx *MetadataIndex) addUsage(batch *leveldb.Batch, owner string, n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	used, err := idx.OwnerUsage(owner)
+	if err != nil {
+		return err
+	}
+
+	batch.Put(usageKey(owner), []byte(strconv.FormatInt(used+n, 10)))
+	return nil
+}
+
+// Close closes the index database
+func (idx *MetadataIndex) Close() error {
+	return idx.db.Close()
+}
+
+// Get returns the metadata of key
+// returns Metadata | ErrNoMetadata if there is none
+func (idx *MetadataIndex) Get(key string) (Metadata, error) {
+	b, err := idx.db.Get([]byte(metaPrefix+key), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return Metadata{}, ErrNoMetadata
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	var meta Metadata
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return Metadata{}, err
+	}
+
+	return meta, nil
+}
+
+// GetName returns the metadata of the key with hashed name
+// returns Metadata | ErrNoMetadata if there is none
+func (idx *MetadataIndex) GetName(name string) (Metadata, error) {
+	key, err := idx.db.Get([]byte(namePrefix+name), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return Metadata{}, ErrNoMetadata
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return idx.Get(string(key))
+}
+
+// Put records meta as a version of its key
+// a zero meta.Version makes it the next version of the key
+// unless it has the content of the latest version already
+// returns the recorded Metadata | whether it is the latest version | error
+func (idx *MetadataIndex) Put(meta Metadata) (Metadata, bool, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	return idx.put(meta)
+}
+
+func (idx *MetadataIndex) put(meta Metadata) (Metadata, bool, error) {
+	old, err := idx.Get(meta.Key)
+	exists := err == nil
+	if err != nil && !errors.Is(err, ErrNoMetadata) {
+		return Metadata{}, false, err
+	}
+
+	if meta.Version == 0 {
+		switch {
+		case !exists:
+			meta.Version = 1
+		case old.Digest == meta.Digest:
+			// rewriting the same content is not an amendment
+			// and leaves who wrote the version and when untouched
+			meta.Version, meta.Parent = max(old.Version, 1), old.Parent
+			meta.Author, meta.CreatedAt = old.Author, old.CreatedAt
+		default:
+			meta.Version, meta.Parent = max(old.Version, 1)+1, old.Digest
+		}
+	}
+
+	// versions are immutable | only what is known
+	// about their replicas changes once they are recorded
+	prev, err := idx.Version(meta.Key, meta.Version)
+	recorded := err == nil
+	if err != nil && !errors.Is(err, ErrNoMetadata) {
+		return Metadata{}, false, err
+	}
+
+	if recorded {
+		if prev.Digest != meta.Digest {
+			return Metadata{}, false, fmt.Errorf("%w: %s version %d is (%s) not (%s)", ErrVersionConflict, meta.Key, meta.Version, prev.Digest, meta.Digest)
+		}
+		meta.Parent, meta.Author, meta.CreatedAt = prev.Parent, prev.Author, prev.CreatedAt
+	}
+
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return Metadata{}, false, err
+	}
+
+	// versions arriving out of order only extend the history
+	latest := !exists || meta.Version >= old.Version
+
+	// recording a version again changes nothing
+	if recorded {
+		if pb, err := json.Marshal(prev); err == nil && bytes.Equal(b, pb) {
+			return meta, latest, nil
+		}
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put(versionKey(meta.Key, meta.Version), b)
+	putRefs(batch, meta)
+
+	// every version keeps its content until it is collected
+	// so the content is charged for as long as it is held
+	// a version recorded again is charged for once more only
+	// if its content was collected and is held again
+	charge := !recorded
+	if recorded {
+		charged, err := idx.charged(meta.Digest)
+		if err != nil {
+			return Metadata{}, false, err
+		}
+		charge = !charged
+	}
+	if charge {
+		if err := idx.charge(batch, meta); err != nil {
+			return Metadata{}, false, err
+		}
+	}
+
+	if latest {
+		// drop secondary keys of the old metadata
+		if exists {
+			deleteSecondary(batch, old)
+		}
+
+		batch.Put([]byte(metaPrefix+meta.Key), b)
+		batch.Put([]byte(namePrefix+nameOf(meta.Key)), []byte(meta.Key))
+		if len(meta.Owner) != 0 {
+			batch.Put(secondaryKey(ownerPrefix, meta.Owner, meta.Key), nil)
+		}
+		if len(meta.PatientID) != 0 {
+			batch.Put(secondaryKey(patientPrefix, meta.PatientID, meta.Key), nil)
+		}
+	}
+
+	return meta, latest, idx.db.Write(batch, nil)
+}
+
+// Version returns the metadata of version of key
+// returns Metadata | ErrNoMetadata if there is no such version
+func (idx *MetadataIndex) Version(key string, version int) (Metadata, error) {
+	b, err := idx.db.Get(versionKey(key, version), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return Metadata{}, ErrNoMetadata
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	var meta Metadata
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return Metadata{}, err
+	}
+
+	return meta, nil
+}
+
+// Versions returns the history of key oldest version first
+func (idx *MetadataIndex) Versions(key string) ([]Metadata, error) {
+	iter := idx.db.NewIterator(util.BytesPrefix(versionKey(key, -1)), nil)
+	defer iter.Release()
+
+	versions := []Metadata{}
+	for iter.Next() {
+		var meta Metadata
+		if err := json.Unmarshal(iter.Value(), &meta); err != nil {
+			return nil, err
+		}
+		versions = append(versions, meta)
+	}
+
+	return versions, iter.Error()
+}
+
+// Walk calls fn with the history of every record ordered by key
+// oldest version first
+func (idx *MetadataIndex) Walk(fn func(versions []Metadata) error) error {
+	iter := idx.db.NewIterator(util.BytesPrefix([]byte(versionPrefix)), nil)
+	defer iter.Release()
+
+	key := ""
+	versions := []Metadata{}
+	for iter.Next() {
+		var meta Metadata
+		if err := json.Unmarshal(iter.Value(), &meta); err != nil {
+			return err
+		}
+
+		// versions of a key are next to each other
+		if meta.Key != key && len(versions) != 0 {
+			if err := fn(versions); err != nil {
+				return err
+			}
+			versions = []Metadata{}
+		}
+
+		key = meta.Key
+		versions = append(versions, meta)
+	}
+
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	if len(versions) == 0 {
+		return nil
+	}
+	return fn(versions)
+}
+
+// Update applies fn to the metadata of key
+// returns the updated Metadata | ErrNoMetadata if there is none
+func (idx *MetadataIndex) Update(key string, fn func(*Metadata)) (Metadata, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	meta, err := idx.Get(key)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	fn(&meta)
+	meta.Key = key
+
+	meta, _, err = idx.put(meta)
+	return meta, err
+}
+
+// Delete removes the metadata of key
+func (idx *MetadataIndex) Delete(key string) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	return idx.delete(key)
+}
+
+func (idx *MetadataIndex) delete(key string) error {
+	old, err := idx.Get(key)
+	if errors.Is(err, ErrNoMetadata) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	deleteSecondary(batch, old)
+	batch.Delete([]byte(metaPrefix + key))
+
+	// the history goes with the record | content stays charged
+	// until it is collected except the shards of erasure coded
+	// versions which are not held under the version digest
+	erasure := []string{}
+	iter := idx.db.NewIterator(util.BytesPrefix(versionKey(key, -1)), nil)
+	for iter.Next() {
+		var meta Metadata
+		if err := json.Unmarshal(iter.Value(), &meta); err != nil {
+			iter.Release()
+			return err
+		}
+		if meta.Erasure != nil {
+			erasure = append(erasure, meta.Digest)
+		}
+		deleteRefs(batch, meta)
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	if err := idx.releaseCharges(batch, erasure); err != nil {
+		return err
+	}
+
+	return idx.db.Write(batch, nil)
+}
+
+// DeleteName removes the metadata of the key with hashed name
+func (idx *MetadataIndex) DeleteName(name string) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	key, err := idx.db.Get([]byte(namePrefix+name), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return idx.delete(string(key))
+}
+
+// List returns the metadata of records matching q ordered by key
+func (idx *MetadataIndex) List(q MetadataQuery) ([]Metadata, error) {
+	// walk the narrowest index
+	prefix := metaPrefix
+	switch {
+	case len(q.Owner) != 0:
+		prefix = string(secondaryKey(ownerPrefix, q.Owner, ""))
+	case len(q.PatientID) != 0:
+		prefix = string(secondaryKey(patientPrefix, q.PatientID, ""))
+	}
+
+	r := util.BytesPrefix([]byte(prefix + q.Prefix))
+	if len(q.After) != 0 && prefix+q.After >= string(r.Start) {
+		r.Start = []byte(prefix + q.After + "\x00")
+	}
+
+	iter := idx.db.NewIterator(r, nil)
+	defer iter.Release()
+
+	records := []Metadata{}
+	for iter.Next() && len(records) < q.limit() {
+		key := strings.TrimPrefix(string(iter.Key()), prefix)
+
+		// the record may be deleted while walking
+		meta, err := idx.Get(key)
+		if errors.Is(err, ErrNoMetadata) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(q.Owner) != 0 && meta.Owner != q.Owner {
+			continue
+		}
+		if len(q.PatientID) != 0 && meta.PatientID != q.PatientID {
+			continue
+		}
+
+		records = append(records, meta)
+	}
+
+	return records, iter.Error()
+}
+
+// returns ids with id added unless it is already there
+func appendUnique(ids []string, id string) []string {
+	for _, other := range ids {
+		if other == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+// returns the index key of version of record key
+// a negative version returns the prefix of all versions
+// versions are zero padded so they sort numerically
+func versionKey(key string, version int) []byte {
+	if version < 0 {
+		return []byte(versionPrefix + key + "\x00")
+	}
+	return []byte(fmt.Sprintf("%s%s\x00%020d", versionPrefix, key, version))
+}
+
+// returns the secondary index key of record key under value
+func secondaryKey(prefix string, value string, key string) []byte {
+	return []byte(prefix + value + "\x00" + key)
+}
+
+// Refs returns what refers to the content with digest
+// namePrefix followed by the hashed name of a key mapping
+// or the version key of a record version
+func (idx *MetadataIndex) Refs(digest string) ([]string, error) {
+	prefix := refKey(digest, "")
+
+	iter := idx.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+
+	refs := []string{}
+	for iter.Next() {
+		refs = append(refs, string(iter.Key()[len(prefix):]))
+	}
+
+	return refs, iter.Error()
+}
+
+// AddNameRef records that the key with hashed name may map to digest
+func (idx *MetadataIndex) AddNameRef(name string, digest string) error {
+	return idx.db.Put(refKey(digest, namePrefix+name), nil, nil)
+}
+
+// DeleteNameRef records that the key with hashed name
+// no longer maps to digest
+func (idx *MetadataIndex) DeleteNameRef(name string, digest string) error {
+	return idx.db.Delete(refKey(digest, namePrefix+name), nil)
+}
+
+// RefsIndexed reports whether the index holds the references
+// of key mappings and versions to their content
+func (idx *MetadataIndex) RefsIndexed() (bool, error) {
+	return idx.db.Has([]byte(refsIndexedKey), nil)
+}
+
+// IndexRefs records the references of every version and of
+// names which maps hashed key names to digests
+func (idx *MetadataIndex) IndexRefs(names map[string]string) error {
+	batch := new(leveldb.Batch)
+	for name, digest := range names {
+		batch.Put(refKey(digest, namePrefix+name), nil)
+	}
+
+	iter := idx.db.NewIterator(util.BytesPrefix([]byte(versionPrefix)), nil)
+	for iter.Next() {
+		var meta Metadata
+		if err := json.Unmarshal(iter.Value(), &meta); err != nil {
+			iter.Release()
+			return err
+		}
+		putRefs(batch, meta)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	batch.Put([]byte(refsIndexedKey), nil)
+	return idx.db.Write(batch, nil)
+}
+
+// returns the key recording that source refers to digest
+func refKey(digest string, source string) []byte {
+	return []byte(refPrefix + digest + "\x00" + source)
+}
+
+// returns the digests of the content version meta refers to
+func refsOf(meta Metadata) []string {
+	digests := []string{meta.Digest}
+	if meta.Erasure != nil {
+		digests = append(digests, meta.Erasure.Shards...)
+	}
+	return digests
+}
+
+// adds to batch the references of version meta to its content
+func putRefs(batch *leveldb.Batch, meta Metadata) {
+	source := string(versionKey(meta.Key, meta.Version))
+	for _, digest := range refsOf(meta) {
+		batch.Put(refKey(digest, source), nil)
+	}
+}
+
+// adds to batch the removal of the references of version meta
+func deleteRefs(batch *leveldb.Batch, meta Metadata) {
+	source := string(versionKey(meta.Key, meta.Version))
+	for _, digest := range refsOf(meta) {
+		batch.Delete(refKey(digest, source))
+	}
+}
+
+// returns the key of the usage counter of owner
+func usageKey(owner string) []byte {
+	return []byte(usagePrefix + owner)
+}
+
+// returns the key recording that owner is charged for digest
+func chargeKey(digest string, owner string) []byte {
+	return []byte(chargePrefix + digest + "\x00" + owner)
+}
+
+// returns whom the content of version meta is charged to
+func payerOf(meta Metadata) string {
+	if len(meta.chargedTo) != 0 {
+		return meta.chargedTo
+	}
+	return meta.Owner
+}
+
+// adds to batch the charge of the content of version meta
+// unless it is charged to the same owner already
+// the index lock must be held until batch is written
+func (idx *MetadataIndex) charge(batch *leveldb.Batch, meta Metadata) error {
+	owner := payerOf(meta)
+	key := chargeKey(meta.Digest, owner)
+
+	ok, err := idx.db.Has(key, nil)
+	if err != nil || ok {
+		return err
+	}
+
+	size := heldSize(meta)
+	batch.Put(key, []byte(strconv.FormatInt(size, 10)))
+	return idx.addUsage(batch, owner, size)
+}
+
+// reports whether anyone is charged for the content with digest
+func (idx *MetadataIndex) charged(digest string) (bool, error) {
+	iter := idx.db.NewIterator(util.BytesPrefix(chargeKey(digest, "")), nil)
+	defer iter.Release()
+
+	return iter.Next(), iter.Error()
+}
+
+// ReleaseCharges gives back the room charged for digest once
+// its content is removed | versions whose shards include digest
+// are no longer charged for either
+func (idx *MetadataIndex) ReleaseCharges(digest string) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	digests := []string{digest}
+
+	refs, err := idx.Refs(digest)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		if !strings.HasPrefix(ref, versionPrefix) {
+			continue
+		}
+
+		b, err := idx.db.Get([]byte(ref), nil)
+		if errors.Is(err, leveldb.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var meta Metadata
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return err
+		}
+		if meta.Erasure != nil && meta.Digest != digest {
+			digests = append(digests, meta.Digest)
+		}
+	}
+
+	batch := new(leveldb.Batch)
+	if err := idx.releaseCharges(batch, digests); err != nil {
+		return err
+	}
+
+	return idx.db.Write(batch, nil)
+}
+
+// adds to batch the release of every charge for digests
+// the index lock must be held until batch is written
+func (idx *MetadataIndex) releaseCharges(batch *leveldb.Batch, digests []string) error {
+	// an owner may be charged for several of the digests
+	released := make(map[string]int64)
+	for _, digest := range digests {
+		prefix := chargeKey(digest, "")
+
+		iter := idx.db.NewIterator(util.BytesPrefix(prefix), nil)
+		for iter.Next() {
+			size, err := strconv.ParseInt(string(iter.Value()), 10, 64)
+			if err != nil {
+				iter.Release()
+				return err
+			}
+			released[string(iter.Key()[len(prefix):])] += size
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+
+	for owner, size := range released {
+		if err := idx.addUsage(batch, owner, -size); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UsageCharged reports whether the index keeps the charges
+// of the content held for every owner
+func (idx *MetadataIndex) UsageCharged() (bool, error) {
+	return idx.db.Has([]byte(usageChargedKey), nil)
+}
+
+// ChargeUsage counts the usage of every owner again charging
+// each owner once for every version whose content held reports
+// is still held | older counters are dropped
+func (idx *MetadataIndex) ChargeUsage(held func(meta Metadata) (bool, error)) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	batch := new(leveldb.Batch)
+	for _, prefix := range []string{usagePrefix, chargePrefix} {
+		iter := idx.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+		for iter.Next() {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+
+	usage := make(map[string]int64)
+	charged := make(map[string]bool)
+
+	iter := idx.db.NewIterator(util.BytesPrefix([]byte(versionPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var meta Metadata
+		if err := json.Unmarshal(iter.Value(), &meta); err != nil {
+			return err
+		}
+
+		key := chargeKey(meta.Digest, meta.Owner)
+		if charged[string(key)] {
+			continue
+		}
+
+		ok, err := held(meta)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		size := heldSize(meta)
+		charged[string(key)] = true
+		usage[meta.Owner] += size
+		batch.Put(key, []byte(strconv.FormatInt(size, 10)))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	for owner, n := range usage {
+		batch.Put(usageKey(owner), []byte(strconv.FormatInt(n, 10)))
+	}
+	batch.Delete([]byte(usageCountedKey))
+	batch.Put([]byte(usageChargedKey), nil)
+
+	return idx.db.Write(batch, nil)
+}
+
+// adds the removal of the secondary keys of meta to batch
+func deleteSecondary(batch *leveldb.Batch, meta Metadata) {
+	batch.Delete([]byte(namePrefix + nameOf(meta.Key)))
+	if len(meta.Owner) != 0 {
+		batch.Delete(secondaryKey(ownerPrefix, meta.Owner, meta.Key))
+	}
+	if len(meta.PatientID) != 0 {
+		batch.Delete(secondaryKey(patientPrefix, meta.PatientID, meta.Key))
+	}
+}
+
+// Metadata returns the metadata of the record with key held by this node
+// returns Metadata | ErrNoMetadata if there is none
+func (s *FileServer) Metadata(key string) (Metadata, error) {
+	return s.store.Metadata(key)
+}
+
+// List returns the metadata of the records held by this node matching q
+func (s *FileServer) List(q MetadataQuery) ([]Metadata, error) {
+	return s.store.List(q)
+}
@@ -1,10 +1,29 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 )
 
+// DefaultMaxFrameSize is the largest frame payload FrameDecoder accepts
+// if no MaxFrameSize is provided
+const DefaultMaxFrameSize = 4 * 1024 * 1024
+
+// ErrFrameTooLarge is returned when a frame announces a payload
+// larger than the decoder accepts
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// encoder interface
+type Encoder interface {
+
+	// encode payload of transmission type typ to writer
+	// returns error
+	Encode(w io.Writer, typ byte, payload []byte) error
+}
+
 // encoder interface
 type Decoder interface {
 
@@ -36,16 +55,11 @@ func (dec DefaultDecoder) Decode(r io.Reader, rpc *RPC) error {
 		return err
 	}
 
-	// check if incoming transmission is a stream
-	stream := peekBuf[0] == IncomingStream
-	if stream {
-		// if tranmission is stream
-		// set rpc.Stream to true
-		rpc.Stream = true
-
-		// return nil
-		return nil
+	// streams need framing to be multiplexed
+	if peekBuf[0] != IncomingMessage {
+		return fmt.Errorf("unsupported transmission type (%d), use FrameDecoder", peekBuf[0])
 	}
+	rpc.Type = IncomingMessage
 
 	buf := make([]byte, 1024)
 
@@ -62,3 +76,105 @@ func (dec DefaultDecoder) Decode(r io.Reader, rpc *RPC) error {
 	// return nil on success
 	return nil
 }
+
+// frame encoder implements Encoder interface
+// a frame is transmission type | uvarint payload length | payload
+type FrameEncoder struct{}
+
+// Encode writes payload as a single frame
+// returns error
+func (enc FrameEncoder) Encode(w io.Writer, typ byte, payload []byte) error {
+	frame := make([]byte, 0, 1+binary.MaxVarintLen64+len(payload))
+	frame = append(frame, typ)
+	frame = binary.AppendUvarint(frame, uint64(len(payload)))
+	frame = append(frame, payload...)
+
+	// frame is written at once so concurrent senders never interleave
+	_, err := w.Write(frame)
+	return err
+}
+
+// frame decoder implements Decoder interface
+// decodes frames written by FrameEncoder
+type FrameDecoder struct {
+
+	// largest accepted frame payload | DefaultMaxFrameSize if zero
+	MaxFrameSize int
+}
+
+// Decode reads exactly one frame from the reader
+// nothing past the frame is consumed
+// returns error
+func (dec FrameDecoder) Decode(r io.Reader, rpc *RPC) error {
+	br := byteReader{r}
+
+	// read transmission type
+	typ, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	// read payload length
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+
+	max := dec.MaxFrameSize
+	if max == 0 {
+		max = DefaultMaxFrameSize
+	}
+
+	if size > uint64(max) {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+
+	if typ != IncomingMessage && (typ < StreamOpen || typ > StreamWindow) {
+		return fmt.Errorf("unknown frame type (%d)", typ)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	rpc.Type = typ
+	rpc.Payload = payload
+
+	if typ == IncomingMessage {
+		return nil
+	}
+
+	// stream frames start with the stream id
+	id, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return fmt.Errorf("invalid stream id in frame type (%d)", typ)
+	}
+
+	rpc.StreamID = id
+	rpc.Payload = payload[n:]
+
+	return nil
+}
+
+// a frame cut short is an unexpected EOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// byteReader reads single bytes without buffering
+// so the underlying reader is never read past a frame
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r.Reader, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
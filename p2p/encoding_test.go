@@ -0,0 +1,114 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeFrames(t testing.TB, payloads ...[]byte) []byte {
+	buf := new(bytes.Buffer)
+	for _, p := range payloads {
+		if err := (FrameEncoder{}).Encode(buf, IncomingMessage, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestFrameDecoderConcatenated(t *testing.T) {
+	big := bytes.Repeat([]byte{0xab}, 5000)
+	buf := new(bytes.Buffer)
+	buf.Write(encodeFrames(t, []byte("first"), big))
+	assert.Nil(t, (FrameEncoder{}).Encode(buf, StreamData, []byte{0x07, 'o', 'k'}))
+	buf.WriteString("trailing bytes")
+
+	dec := FrameDecoder{}
+
+	rpc := RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, []byte("first"), rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, big, rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, byte(StreamData), rpc.Type)
+	assert.Equal(t, uint64(7), rpc.StreamID)
+	assert.Equal(t, []byte("ok"), rpc.Payload)
+
+	// bytes following the last frame are left untouched
+	assert.Equal(t, "trailing bytes", buf.String())
+}
+
+func TestFrameDecoderMaxFrameSize(t *testing.T) {
+	frame := encodeFrames(t, make([]byte, 100))
+
+	rpc := RPC{}
+	err := FrameDecoder{MaxFrameSize: 99}.Decode(bytes.NewReader(frame), &rpc)
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+}
+
+func FuzzFrameDecoderTruncated(f *testing.F) {
+	f.Add([]byte("hello"), []byte("world"), 3)
+	f.Add([]byte{}, bytes.Repeat([]byte{1}, 300), 130)
+	f.Add(bytes.Repeat([]byte{StreamData}, 200), []byte{0}, 0)
+
+	f.Fuzz(func(t *testing.T, a []byte, b []byte, cut int) {
+		frames := encodeFrames(t, a, b)
+		if cut < 0 {
+			cut = -(cut + 1)
+		}
+		cut %= len(frames) + 1
+
+		dec := FrameDecoder{}
+		r := bytes.NewReader(frames[:cut])
+
+		// every complete frame decodes to its payload
+		// and the first incomplete frame fails cleanly
+		for _, want := range [][]byte{a, b} {
+			rpc := RPC{}
+			err := dec.Decode(r, &rpc)
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !bytes.Equal(want, rpc.Payload) {
+				t.Fatalf("payload mismatch: want %x got %x", want, rpc.Payload)
+			}
+		}
+
+		if cut != len(frames) {
+			t.Fatalf("truncated input (%d of %d bytes) decoded fully", cut, len(frames))
+		}
+	})
+}
+
+func FuzzFrameDecoderArbitrary(f *testing.F) {
+	f.Add(encodeFrames(f, []byte("hello"), []byte("world")))
+	f.Add([]byte{IncomingMessage, 0xff, 0xff, 0xff, 0xff, 0x0f})
+	f.Add([]byte{StreamWindow, 0x00, 0x09})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dec := FrameDecoder{MaxFrameSize: 1024}
+		r := bytes.NewReader(data)
+
+		// garbage never panics and never yields oversized payloads
+		for {
+			rpc := RPC{}
+			if err := dec.Decode(r, &rpc); err != nil {
+				return
+			}
+			if len(rpc.Payload) > dec.MaxFrameSize {
+				t.Fatalf("payload of %d bytes exceeds max frame size", len(rpc.Payload))
+			}
+		}
+	})
+}
@@ -1,5 +1,36 @@
 package p2p
 
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	// ProtocolVersion is the newest protocol version this node speaks
+	// version 2 encrypts all traffic after the handshake
+	ProtocolVersion uint16 = 2
+
+	// MinProtocolVersion is the oldest protocol version this node accepts
+	MinProtocolVersion uint16 = 2
+
+	// DefaultHandshakeTimeout bounds how long a handshake may take
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	// size of handshake challenge nonces in bytes
+	nonceSize = 32
+)
+
+// ErrHandshake is returned when a peer fails to authenticate
+var ErrHandshake = errors.New("handshake failed")
+
 type HandshakeFunc func(Peer, func(Peer) error) error
 
 func NOPHandshakeFunc(peer Peer, fn func(Peer) error) error {
@@ -10,7 +41,154 @@ func DefaultHandshakeFunc(peer Peer, verifyFunc func(Peer) error) error {
 	return verifyFunc(peer)
 }
 
-// func verify() bool {
-// 	time.Sleep(time.Millisecond * 600)
-// 	return false
-// }
+// Keystore holds the node private key used to answer handshake challenges
+type Keystore interface {
+	PrivateKey() (*ecdsa.PrivateKey, error)
+}
+
+// first handshake message sent by both sides
+type handshakeHello struct {
+
+	// newest and oldest protocol versions the sender speaks
+	Version    uint16
+	MinVersion uint16
+
+	// optional features the sender supports
+	Capabilities []string
+
+	// address the sender listens on
+	ListenAddr string
+
+	// fresh random challenge the receiver must sign
+	Nonce []byte
+
+	// X25519 public key the session keys are agreed on with
+	EphemeralKey []byte
+}
+
+// second handshake message answering the peer challenge
+type handshakeAuth struct {
+
+	// uncompressed secp256k1 public key of the sender
+	PublicKey []byte
+
+	// signature over the challenge transcript
+	Signature []byte
+}
+
+// returns the hash a node signs to answer a challenge
+// binding the negotiated version, both nonces, both listen addresses
+// and both ephemeral keys so a signature is useless to anyone replaying
+// it on another connection or sitting in the middle of the key exchange
+func challengeHash(version uint16, signer handshakeHello, verifier handshakeHello) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("dstore handshake")
+	binary.Write(buf, binary.BigEndian, version)
+
+	for _, field := range [][]byte{
+		verifier.Nonce,
+		signer.Nonce,
+		[]byte(signer.ListenAddr),
+		[]byte(verifier.ListenAddr),
+		verifier.EphemeralKey,
+		signer.EphemeralKey,
+	} {
+		binary.Write(buf, binary.BigEndian, uint32(len(field)))
+		buf.Write(field)
+	}
+
+	return crypto.Keccak256(buf.Bytes())
+}
+
+// returns the highest protocol version both hellos speak
+func negotiateVersion(ours handshakeHello, theirs handshakeHello) (uint16, error) {
+	version := min(ours.Version, theirs.Version)
+	if version < max(ours.MinVersion, theirs.MinVersion) {
+		return 0, fmt.Errorf("%w: no common protocol version (ours %d-%d, theirs %d-%d)",
+			ErrHandshake, ours.MinVersion, ours.Version, theirs.MinVersion, theirs.Version)
+	}
+	return version, nil
+}
+
+// returns the capabilities both sides support in our order
+func commonCapabilities(ours []string, theirs []string) []string {
+	supported := make(map[string]bool)
+	for _, c := range theirs {
+		supported[c] = true
+	}
+
+	common := []string{}
+	for _, c := range ours {
+		if supported[c] {
+			common = append(common, c)
+		}
+	}
+	return common
+}
+
+// sign answers the challenge in verifier hello
+// returns handshakeAuth | error
+func signChallenge(key *ecdsa.PrivateKey, version uint16, signer handshakeHello, verifier handshakeHello) (handshakeAuth, error) {
+	sig, err := crypto.Sign(challengeHash(version, signer, verifier), key)
+	if err != nil {
+		return handshakeAuth{}, err
+	}
+
+	return handshakeAuth{
+		PublicKey: crypto.FromECDSAPub(&key.PublicKey),
+		Signature: sig,
+	}, nil
+}
+
+// verifies auth answers the challenge in verifier hello
+// returns the authenticated public key | error
+func verifyChallenge(auth handshakeAuth, version uint16, signer handshakeHello, verifier handshakeHello) (*ecdsa.PublicKey, error) {
+	pub, err := crypto.SigToPub(challengeHash(version, signer, verifier), auth.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid signature: %s", ErrHandshake, err)
+	}
+
+	claimed, err := crypto.UnmarshalPubkey(auth.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid public key: %s", ErrHandshake, err)
+	}
+
+	// the signature must recover to the key the peer claims
+	if crypto.PubkeyToAddress(*pub) != crypto.PubkeyToAddress(*claimed) {
+		return nil, fmt.Errorf("%w: signature does not match claimed key", ErrHandshake)
+	}
+
+	return pub, nil
+}
+
+// returns a fresh challenge nonce
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// send gob encoded handshake message v to peer
+func sendHandshake(peer Peer, v any) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	return peer.Send(buf.Bytes())
+}
+
+// receive gob encoded handshake message from peer into v
+func (t *TCPTransport) receiveHandshake(peer Peer, v any) error {
+	rpc := RPC{}
+	if err := t.Decoder.Decode(peer, &rpc); err != nil {
+		return err
+	}
+
+	if rpc.Type != IncomingMessage {
+		return fmt.Errorf("%w: unexpected stream frame", ErrHandshake)
+	}
+
+	return gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(v)
+}
@@ -0,0 +1,188 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+type testKeystore struct {
+	key *ecdsa.PrivateKey
+}
+
+func (ks testKeystore) PrivateKey() (*ecdsa.PrivateKey, error) {
+	return ks.key, nil
+}
+
+// contract allowing a fixed set of nodes
+type testContract struct {
+	lock    sync.Mutex
+	allowed map[common.Address]string
+}
+
+func (c *testContract) VerifyNode(address common.Address, ip string) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.allowed[address] == ip, nil
+}
+
+func (c *testContract) IsAdded(ip string) (bool, error)         { return false, nil }
+func (c *testContract) AddNode(ip string) error                 { return nil }
+func (c *testContract) GetPublicKey() (*ecdsa.PublicKey, error) { return nil, nil }
+
+// starts a transport authenticating with a fresh key
+// returns transport and channel of authenticated peers
+func makeTestTransport(t *testing.T, addr string, c *testContract) (*TCPTransport, *ecdsa.PrivateKey, chan *TCPPeer) {
+	key, err := crypto.GenerateKey()
+	assert.Nil(t, err)
+
+	peers := make(chan *TCPPeer, 1)
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:       addr,
+		HandshakeFunc:    DefaultHandshakeFunc,
+		Contract:         c,
+		Keystore:         testKeystore{key: key},
+		Capabilities:     []string{"streams", "dht"},
+		HandshakeTimeout: 500 * time.Millisecond,
+		OnPeer: func(p Peer) error {
+			peers <- p.(*TCPPeer)
+			return nil
+		},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func() { tr.Close() })
+
+	return tr, key, peers
+}
+
+func TestHandshakeMutualAuthentication(t *testing.T) {
+	c := &testContract{allowed: map[common.Address]string{}}
+	a, keyA, peersA := makeTestTransport(t, "127.0.0.1:39201", c)
+	b, keyB, peersB := makeTestTransport(t, "127.0.0.1:39202", c)
+	c.allowed[crypto.PubkeyToAddress(keyA.PublicKey)] = "127.0.0.1:39201"
+	c.allowed[crypto.PubkeyToAddress(keyB.PublicKey)] = "127.0.0.1:39202"
+
+	assert.Nil(t, a.Dial("127.0.0.1:39202"))
+
+	authenticated := []*TCPPeer{}
+	for _, tc := range []struct {
+		peers chan *TCPPeer
+		key   *ecdsa.PrivateKey
+		addr  string
+	}{
+		{peersA, keyB, "127.0.0.1:39202"},
+		{peersB, keyA, "127.0.0.1:39201"},
+	} {
+		select {
+		case p := <-tc.peers:
+			assert.Equal(t, crypto.PubkeyToAddress(tc.key.PublicKey), crypto.PubkeyToAddress(p.PublicKey))
+			assert.Equal(t, tc.addr, p.ListenAddr)
+			assert.Equal(t, ProtocolVersion, p.Version)
+			assert.Equal(t, []string{"streams", "dht"}, p.Capabilities)
+			authenticated = append(authenticated, p)
+		case <-time.After(2 * time.Second):
+			t.Fatal("handshake did not complete")
+		}
+	}
+
+	// messages travel over the encrypted session
+	_, ok := authenticated[0].Conn.(*secureConn)
+	assert.True(t, ok)
+	assert.Nil(t, authenticated[0].Send([]byte("some ehr bytes")))
+
+	select {
+	case rpc := <-b.Consume():
+		assert.Equal(t, []byte("some ehr bytes"), rpc.Payload)
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+func TestHandshakeRejectsUnknownNode(t *testing.T) {
+	c := &testContract{allowed: map[common.Address]string{}}
+	a, keyA, peersA := makeTestTransport(t, "127.0.0.1:39211", c)
+	_, _, peersB := makeTestTransport(t, "127.0.0.1:39212", c)
+
+	// only a is registered on chain
+	c.allowed[crypto.PubkeyToAddress(keyA.PublicKey)] = "127.0.0.1:39211"
+
+	assert.Nil(t, a.Dial("127.0.0.1:39212"))
+
+	select {
+	case <-peersA:
+		t.Fatal("unregistered node accepted")
+	case <-peersB:
+		// b accepts a but a rejects b
+	case <-time.After(time.Second):
+	}
+
+	select {
+	case <-peersA:
+		t.Fatal("unregistered node accepted")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestHandshakeReplayedSignature(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	assert.Nil(t, err)
+
+	signer := handshakeHello{ListenAddr: "127.0.0.1:1", Nonce: []byte("signer nonce")}
+	verifier := handshakeHello{ListenAddr: "127.0.0.1:2", Nonce: []byte("first nonce")}
+
+	auth, err := signChallenge(key, ProtocolVersion, signer, verifier)
+	assert.Nil(t, err)
+
+	pub, err := verifyChallenge(auth, ProtocolVersion, signer, verifier)
+	assert.Nil(t, err)
+	assert.Equal(t, crypto.PubkeyToAddress(key.PublicKey), crypto.PubkeyToAddress(*pub))
+
+	// the answer to one challenge does not answer another
+	verifier.Nonce = []byte("fresh nonce")
+	_, err = verifyChallenge(auth, ProtocolVersion, signer, verifier)
+	assert.ErrorIs(t, err, ErrHandshake)
+
+	// a signature can not be passed off for another key
+	other, _ := crypto.GenerateKey()
+	auth.PublicKey = crypto.FromECDSAPub(&other.PublicKey)
+	verifier.Nonce = []byte("first nonce")
+	_, err = verifyChallenge(auth, ProtocolVersion, signer, verifier)
+	assert.ErrorIs(t, err, ErrHandshake)
+}
+
+func TestHandshakeVersionNegotiation(t *testing.T) {
+	v, err := negotiateVersion(handshakeHello{Version: 3, MinVersion: 1}, handshakeHello{Version: 2, MinVersion: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(2), v)
+
+	_, err = negotiateVersion(handshakeHello{Version: 1, MinVersion: 1}, handshakeHello{Version: 3, MinVersion: 2})
+	assert.ErrorIs(t, err, ErrHandshake)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	c := &testContract{allowed: map[common.Address]string{}}
+	makeTestTransport(t, "127.0.0.1:39221", c)
+
+	// a peer that never answers is dropped
+	conn, err := net.Dial("tcp", "127.0.0.1:39221")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	for {
+		if _, err = conn.Read(buf); err != nil {
+			break
+		}
+	}
+
+	// closed by the transport rather than by the read deadline
+	netErr, ok := err.(net.Error)
+	assert.False(t, ok && netErr.Timeout())
+}
@@ -0,0 +1,459 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnreachable is returned when dialing an address that is not
+// listening or is cut off by a partition
+var ErrUnreachable = errors.New("address unreachable")
+
+// MemoryNetworkOpts configures a MemoryNetwork
+type MemoryNetworkOpts struct {
+
+	// delay added to every write before the remote end can read it
+	Latency time.Duration
+
+	// probability in [0, 1] that a message is lost
+	// streams are reliable like TCP and never lose data
+	DropRate float64
+
+	// seed of the drop decisions so failing runs can be replayed
+	Seed int64
+}
+
+// MemoryNetwork connects MemoryTransports in process so
+// multi-node tests need no sockets, keystores or chain endpoint
+type MemoryNetwork struct {
+	MemoryNetworkOpts
+
+	lock sync.Mutex
+
+	// listening transports keyed by address
+	listeners map[string]*MemoryTransport
+
+	// partition group of every address | nil if the network is whole
+	groups map[string]int
+
+	// drop decisions
+	rand *rand.Rand
+
+	// last connection id
+	conns int
+}
+
+// NewMemoryNetwork creates a network from opts
+// returns *MemoryNetwork
+func NewMemoryNetwork(opts MemoryNetworkOpts) *MemoryNetwork {
+	return &MemoryNetwork{
+		MemoryNetworkOpts: opts,
+		listeners:         make(map[string]*MemoryTransport),
+		rand:              rand.New(rand.NewSource(opts.Seed)),
+	}
+}
+
+// SetLatency changes the delay of every write
+func (n *MemoryNetwork) SetLatency(d time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.Latency = d
+}
+
+// SetDropRate changes the probability that a message is lost
+func (n *MemoryNetwork) SetDropRate(p float64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.DropRate = p
+}
+
+// Partition splits the network into groups of addresses that can
+// only reach addresses in the same group | unlisted addresses
+// form a group of their own
+// new connections across groups fail and traffic on existing ones
+// is held back until Heal like TCP retransmitting over a cut link
+func (n *MemoryNetwork) Partition(groups ...[]string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.groups[addr] = i
+		}
+	}
+}
+
+// Heal removes all partitions
+func (n *MemoryNetwork) Heal() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.groups = nil
+}
+
+// reports whether a and b are cut off from each other
+func (n *MemoryNetwork) partitioned(a string, b string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.groups == nil {
+		return false
+	}
+
+	groupOf := func(addr string) int {
+		if g, ok := n.groups[addr]; ok {
+			return g
+		}
+		return -1
+	}
+
+	return groupOf(a) != groupOf(b)
+}
+
+// returns delivery time of a write made now
+func (n *MemoryNetwork) deliverAt() time.Time {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return time.Now().Add(n.Latency)
+}
+
+// reports whether the next message is lost
+func (n *MemoryNetwork) drop() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.DropRate > 0 && n.rand.Float64() < n.DropRate
+}
+
+func (n *MemoryNetwork) listen(t *MemoryTransport) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.listeners[t.ListenAddr]; ok {
+		return fmt.Errorf("address (%s) already in use", t.ListenAddr)
+	}
+
+	n.listeners[t.ListenAddr] = t
+	return nil
+}
+
+func (n *MemoryNetwork) unlisten(t *MemoryTransport) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.listeners[t.ListenAddr] == t {
+		delete(n.listeners, t.ListenAddr)
+	}
+}
+
+// connect from to the transport listening on addr
+// returns dialer end | listener end | listening transport | error
+func (n *MemoryNetwork) connect(from string, addr string) (*memConn, *memConn, *MemoryTransport, error) {
+	if n.partitioned(from, addr) {
+		return nil, nil, nil, fmt.Errorf("%w: %s", ErrUnreachable, addr)
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	remote, ok := n.listeners[addr]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("%w: %s", ErrUnreachable, addr)
+	}
+
+	// the listener sees every connection from its own
+	// address like a TCP ephemeral port
+	n.conns++
+	dialerAddr := memAddr(fmt.Sprintf("%s/%d", from, n.conns))
+
+	ab, ba := newMemPipe(), newMemPipe()
+	dialer := &memConn{network: n, local: memAddr(from), remote: memAddr(addr), in: ba, out: ab}
+	listener := &memConn{network: n, local: memAddr(addr), remote: dialerAddr, in: ab, out: ba}
+
+	return dialer, listener, remote, nil
+}
+
+// MemoryTransport implements Transport over a MemoryNetwork
+// it speaks the TCPTransport protocol including the handshake
+// so servers behave exactly as they do over TCP
+type MemoryTransport struct {
+	*TCPTransport
+
+	network *MemoryNetwork
+
+	lock   sync.Mutex
+	conns  []*memConn
+	closed bool
+}
+
+// NewMemoryTransport creates a transport listening on opts.ListenAddr of network
+// returns *MemoryTransport
+func NewMemoryTransport(network *MemoryNetwork, opts TCPTransportOpts) *MemoryTransport {
+	t := &MemoryTransport{
+		TCPTransport: NewTCPTransport(opts),
+		network:      network,
+	}
+
+	t.TCPTransport.dropMessage = network.drop
+
+	return t
+}
+
+// ListenAndAccept implements the Transport interface
+func (t *MemoryTransport) ListenAndAccept() error {
+	return t.network.listen(t)
+}
+
+// Dial implements the Transport interface
+func (t *MemoryTransport) Dial(addr string) error {
+	dialer, listener, remote, err := t.network.connect(t.ListenAddr, addr)
+	if err != nil {
+		return err
+	}
+
+	if err := t.track(dialer); err != nil {
+		return err
+	}
+
+	if err := remote.track(listener); err != nil {
+		dialer.Close()
+		return err
+	}
+
+	go remote.handleConn(listener, false)
+	go t.handleConn(dialer, true)
+
+	return nil
+}
+
+// Close implements the Transport interface
+// closing every connection of the transport
+func (t *MemoryTransport) Close() error {
+	t.network.unlisten(t)
+
+	t.lock.Lock()
+	conns := t.conns
+	t.conns, t.closed = nil, true
+	t.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+// record conn so it is closed with the transport
+func (t *MemoryTransport) track(conn *memConn) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return fmt.Errorf("%w: transport (%s) closed", ErrUnreachable, t.ListenAddr)
+	}
+
+	t.conns = append(t.conns, conn)
+	return nil
+}
+
+// memAddr implements net.Addr
+type memAddr string
+
+func (a memAddr) Network() string { return "memory" }
+func (a memAddr) String() string  { return string(a) }
+
+// bytes written to a memPipe and when they may be read
+type memChunk struct {
+	data []byte
+	at   time.Time
+}
+
+// memPipe is an unbounded one way byte queue
+// writes never block so nodes may write to each other
+// from their read loops like they do over TCP
+type memPipe struct {
+	lock   sync.Mutex
+	chunks []memChunk
+	closed bool
+
+	// signaled when chunks are added or the pipe closes
+	notify chan struct{}
+}
+
+func newMemPipe() *memPipe {
+	return &memPipe{notify: make(chan struct{}, 1)}
+}
+
+func (p *memPipe) signal() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (p *memPipe) push(c memChunk) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return io.ErrClosedPipe
+	}
+
+	p.chunks = append(p.chunks, c)
+	p.signal()
+	return nil
+}
+
+func (p *memPipe) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+	p.signal()
+}
+
+// memConn implements net.Conn over two memPipes
+type memConn struct {
+	network *MemoryNetwork
+	local   memAddr
+	remote  memAddr
+
+	// pipe read from and pipe written to
+	in  *memPipe
+	out *memPipe
+
+	deadlineLock sync.Mutex
+	readDeadline time.Time
+
+	// set once this end is closed
+	closed atomic.Bool
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	for {
+		// a closed end fails at once even if the close
+		// can not reach the remote end across a partition
+		if c.closed.Load() {
+			return 0, net.ErrClosed
+		}
+
+		// poll for the partition to heal
+		if c.network.partitioned(string(c.local), c.remoteListener()) {
+			if err := c.sleep(10 * time.Millisecond); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		c.in.lock.Lock()
+		var wait time.Duration
+		if len(c.in.chunks) != 0 {
+			head := &c.in.chunks[0]
+			wait = time.Until(head.at)
+			if wait <= 0 {
+				n := copy(b, head.data)
+				head.data = head.data[n:]
+				if len(head.data) == 0 {
+					c.in.chunks = c.in.chunks[1:]
+				}
+				c.in.lock.Unlock()
+				return n, nil
+			}
+		} else if c.in.closed {
+			c.in.lock.Unlock()
+			return 0, io.EOF
+		}
+		c.in.lock.Unlock()
+
+		c.deadlineLock.Lock()
+		deadline := c.readDeadline
+		c.deadlineLock.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		// wake up for new data, the head chunk delivery or the deadline
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timeout = time.After(wait)
+		} else if !deadline.IsZero() {
+			timeout = time.After(time.Until(deadline))
+		}
+
+		select {
+		case <-c.in.notify:
+		case <-timeout:
+		}
+	}
+}
+
+// sleep for d or until the read deadline passes
+func (c *memConn) sleep(d time.Duration) error {
+	c.deadlineLock.Lock()
+	deadline := c.readDeadline
+	c.deadlineLock.Unlock()
+
+	if !deadline.IsZero() && time.Until(deadline) < d {
+		time.Sleep(time.Until(deadline))
+		return os.ErrDeadlineExceeded
+	}
+
+	time.Sleep(d)
+	return nil
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	data := append([]byte(nil), b...)
+	if err := c.out.push(memChunk{data: data, at: c.network.deliverAt()}); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// returns listen address of the remote end
+func (c *memConn) remoteListener() string {
+	addr := string(c.remote)
+	for i := len(addr) - 1; i >= 0; i-- {
+		if addr[i] == '/' {
+			return addr[:i]
+		}
+	}
+	return addr
+}
+
+func (c *memConn) Close() error {
+	c.closed.Store(true)
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	c.readDeadline = t
+	c.deadlineLock.Unlock()
+
+	// wake up a blocked read to observe the new deadline
+	c.in.signal()
+	return nil
+}
+
+// writes never block
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
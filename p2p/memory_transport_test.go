@@ -0,0 +1,141 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/luqxus/dstore/contract"
+	"github.com/stretchr/testify/assert"
+)
+
+// starts a transport on network and returns the peers it connects to
+func makeMemoryTransport(t *testing.T, network *MemoryNetwork, opts TCPTransportOpts) (*MemoryTransport, chan Peer) {
+	peers := make(chan Peer, 4)
+	if opts.HandshakeFunc == nil {
+		opts.HandshakeFunc = NOPHandshakeFunc
+	}
+	opts.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+
+	tr := NewMemoryTransport(network, opts)
+	assert.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func() { tr.Close() })
+
+	return tr, peers
+}
+
+func receive(t *testing.T, tr Transport, within time.Duration) (RPC, bool) {
+	select {
+	case rpc := <-tr.Consume():
+		return rpc, true
+	case <-time.After(within):
+		return RPC{}, false
+	}
+}
+
+func TestMemoryTransportLatency(t *testing.T) {
+	network := NewMemoryNetwork(MemoryNetworkOpts{Latency: 50 * time.Millisecond})
+	a, peersA := makeMemoryTransport(t, network, TCPTransportOpts{ListenAddr: "a"})
+	b, _ := makeMemoryTransport(t, network, TCPTransportOpts{ListenAddr: "b"})
+
+	assert.Nil(t, a.Dial("b"))
+	peer := <-peersA
+
+	start := time.Now()
+	assert.Nil(t, peer.Send([]byte("hello")))
+
+	rpc, ok := receive(t, b, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello"), rpc.Payload)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestMemoryTransportPartition(t *testing.T) {
+	network := NewMemoryNetwork(MemoryNetworkOpts{})
+	a, peersA := makeMemoryTransport(t, network, TCPTransportOpts{ListenAddr: "a"})
+	b, _ := makeMemoryTransport(t, network, TCPTransportOpts{ListenAddr: "b"})
+	makeMemoryTransport(t, network, TCPTransportOpts{ListenAddr: "c"})
+
+	assert.Nil(t, a.Dial("b"))
+	peer := <-peersA
+
+	network.Partition([]string{"a"}, []string{"b", "c"})
+
+	// nothing crosses the partition
+	assert.ErrorIs(t, a.Dial("c"), ErrUnreachable)
+	assert.Nil(t, peer.Send([]byte("held")))
+	_, ok := receive(t, b, 100*time.Millisecond)
+	assert.False(t, ok)
+
+	// held traffic arrives once the link is back
+	network.Heal()
+
+	rpc, ok := receive(t, b, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("held"), rpc.Payload)
+}
+
+func TestMemoryTransportDrops(t *testing.T) {
+	network := NewMemoryNetwork(MemoryNetworkOpts{DropRate: 1})
+	a, peersA := makeMemoryTransport(t, network, TCPTransportOpts{ListenAddr: "a"})
+	b, _ := makeMemoryTransport(t, network, TCPTransportOpts{ListenAddr: "b"})
+
+	assert.Nil(t, a.Dial("b"))
+	peer := <-peersA
+
+	assert.Nil(t, peer.Send([]byte("lost")))
+	_, ok := receive(t, b, 100*time.Millisecond)
+	assert.False(t, ok)
+
+	// messages flow again once drops stop
+	network.SetDropRate(0)
+	assert.Nil(t, peer.Send([]byte("delivered")))
+	_, ok = receive(t, b, time.Second)
+	assert.True(t, ok)
+}
+
+func TestMemoryTransportHandshake(t *testing.T) {
+	network := NewMemoryNetwork(MemoryNetworkOpts{})
+	registry := contract.NewMemoryRegistry()
+
+	keyA, _ := crypto.GenerateKey()
+	keyB, _ := crypto.GenerateKey()
+	registry.Allow(crypto.PubkeyToAddress(keyA.PublicKey), "a")
+
+	a, peersA := makeMemoryTransport(t, network, TCPTransportOpts{
+		ListenAddr:    "a",
+		HandshakeFunc: DefaultHandshakeFunc,
+		Keystore:      testKeystore{key: keyA},
+		Contract:      registry.Contract(&keyA.PublicKey),
+	})
+	_, peersB := makeMemoryTransport(t, network, TCPTransportOpts{
+		ListenAddr:    "b",
+		HandshakeFunc: DefaultHandshakeFunc,
+		Keystore:      testKeystore{key: keyB},
+		Contract:      registry.Contract(&keyB.PublicKey),
+	})
+
+	// b is not registered yet
+	assert.Nil(t, a.Dial("b"))
+	select {
+	case <-peersA:
+		t.Fatal("unregistered node accepted")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	registry.Allow(crypto.PubkeyToAddress(keyB.PublicKey), "b")
+	assert.Nil(t, a.Dial("b"))
+
+	for _, peers := range []chan Peer{peersA, peersB} {
+		select {
+		case p := <-peers:
+			_, ok := p.(*TCPPeer).Conn.(*secureConn)
+			assert.True(t, ok)
+		case <-time.After(time.Second):
+			t.Fatal("handshake did not complete")
+		}
+	}
+}
@@ -2,7 +2,13 @@ package p2p
 
 const (
 	IncomingMessage = 0x1
-	IncomingStream  = 0x2
+
+	// stream frames carry the uvarint stream id before their payload
+	StreamOpen   = 0x3
+	StreamData   = 0x4
+	StreamClose  = 0x5
+	StreamReset  = 0x6
+	StreamWindow = 0x7
 )
 
 // Message hold any arbitrary data that is being sent over
@@ -10,7 +16,11 @@ const (
 type RPC struct {
 	From string
 
-	Payload []byte
+	// transmission type
+	Type byte
 
-	Stream bool
+	// stream the frame belongs to if Type is a stream frame
+	StreamID uint64
+
+	Payload []byte
 }
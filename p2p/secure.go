@@ -0,0 +1,180 @@
+package p2p
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// largest plaintext carried by a single encrypted record
+const maxRecordSize = 16 * 1024
+
+// size of the record length prefix
+const recordHeaderSize = 4
+
+// ErrRecordTampered is returned when an encrypted record fails authentication
+var ErrRecordTampered = errors.New("encrypted record tampered with")
+
+// derives the session keys of a connection from the X25519 exchange
+// of both ephemeral keys and the handshake hellos
+// returns send key | receive key | error
+func sessionKeys(ephemeral *ecdh.PrivateKey, ours handshakeHello, theirs handshakeHello, outbound bool) ([]byte, []byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(theirs.EphemeralKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: invalid ephemeral key: %s", ErrHandshake, err)
+	}
+
+	shared, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: key exchange: %s", ErrHandshake, err)
+	}
+
+	// both sides order the hellos dialer first
+	initiator, responder := ours, theirs
+	if !outbound {
+		initiator, responder = theirs, ours
+	}
+
+	salt := sha256.New()
+	for _, field := range [][]byte{initiator.Nonce, responder.Nonce, initiator.EphemeralKey, responder.EphemeralKey} {
+		binary.Write(salt, binary.BigEndian, uint32(len(field)))
+		salt.Write(field)
+	}
+
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	kdf := hkdf.New(sha256.New, shared, salt.Sum(nil), []byte("dstore session keys"))
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		return nil, nil, err
+	}
+
+	// first key encrypts dialer to listener traffic
+	toResponder, toInitiator := keys[:chacha20poly1305.KeySize], keys[chacha20poly1305.KeySize:]
+	if outbound {
+		return toResponder, toInitiator, nil
+	}
+	return toInitiator, toResponder, nil
+}
+
+// secureConn encrypts and authenticates all traffic of a connection
+// data is sent in records of a 4 byte length followed by
+// ChaCha20-Poly1305 ciphertext sealed under a per direction counter nonce
+// so dropped, replayed or reordered records fail to open
+type secureConn struct {
+	net.Conn
+
+	// writes are serialized so records never interleave
+	writeLock sync.Mutex
+	send      cipher.AEAD
+	sendSeq   uint64
+
+	readLock sync.Mutex
+	recv     cipher.AEAD
+	recvSeq  uint64
+
+	// decrypted bytes of the last record not read yet
+	pending []byte
+}
+
+// wraps conn in a session encrypted with sendKey and recvKey
+// returns *secureConn | error
+func newSecureConn(conn net.Conn, sendKey []byte, recvKey []byte) (*secureConn, error) {
+	send, err := chacha20poly1305.New(sendKey)
+	if err != nil {
+		return nil, err
+	}
+
+	recv, err := chacha20poly1305.New(recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &secureConn{
+		Conn: conn,
+		send: send,
+		recv: recv,
+	}, nil
+}
+
+// returns the nonce of record seq
+func recordNonce(seq uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], seq)
+	return nonce
+}
+
+// Write implements net.Conn
+func (c *secureConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), maxRecordSize)]
+
+		record := make([]byte, recordHeaderSize, recordHeaderSize+len(chunk)+c.send.Overhead())
+		record = c.send.Seal(record, recordNonce(c.sendSeq), chunk, nil)
+		binary.BigEndian.PutUint32(record, uint32(len(record)-recordHeaderSize))
+
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+
+		c.sendSeq++
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// Read implements net.Conn
+func (c *secureConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if len(c.pending) == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// read and decrypt the next record into pending
+func (c *secureConn) readRecord() error {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxRecordSize+uint32(c.recv.Overhead()) {
+		return fmt.Errorf("%w: record of %d bytes", ErrFrameTooLarge, size)
+	}
+
+	record := make([]byte, size)
+	if _, err := io.ReadFull(c.Conn, record); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	plain, err := c.recv.Open(record[:0], recordNonce(c.recvSeq), record, nil)
+	if err != nil {
+		return ErrRecordTampered
+	}
+
+	c.recvSeq++
+	c.pending = plain
+	return nil
+}
@@ -0,0 +1,77 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// conn writing to and reading from an in memory buffer
+type bufferConn struct {
+	net.Conn
+	buf *bytes.Buffer
+}
+
+func (c bufferConn) Read(b []byte) (int, error)  { return c.buf.Read(b) }
+func (c bufferConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
+
+func TestSessionKeys(t *testing.T) {
+	dialer, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	listener, _ := ecdh.X25519().GenerateKey(rand.Reader)
+
+	ours := handshakeHello{Nonce: []byte("dialer nonce"), EphemeralKey: dialer.PublicKey().Bytes()}
+	theirs := handshakeHello{Nonce: []byte("listener nonce"), EphemeralKey: listener.PublicKey().Bytes()}
+
+	send, recv, err := sessionKeys(dialer, ours, theirs, true)
+	assert.Nil(t, err)
+
+	peerSend, peerRecv, err := sessionKeys(listener, theirs, ours, false)
+	assert.Nil(t, err)
+
+	assert.Equal(t, send, peerRecv)
+	assert.Equal(t, recv, peerSend)
+	assert.NotEqual(t, send, recv)
+}
+
+func TestSecureConn(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	wire := new(bytes.Buffer)
+
+	w, err := newSecureConn(bufferConn{buf: wire}, key, key)
+	assert.Nil(t, err)
+
+	data := make([]byte, 3*maxRecordSize+100)
+	rand.Read(data)
+
+	n, err := w.Write(data)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), n)
+
+	// nothing readable crosses the wire
+	assert.False(t, bytes.Contains(wire.Bytes(), data[:64]))
+
+	sealed := append([]byte(nil), wire.Bytes()...)
+
+	r, _ := newSecureConn(bufferConn{buf: wire}, key, key)
+	got, err := io.ReadAll(io.LimitReader(r, int64(len(data))))
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+
+	// flipped bits fail authentication
+	sealed[recordHeaderSize+10] ^= 1
+	r, _ = newSecureConn(bufferConn{buf: bytes.NewBuffer(sealed)}, key, key)
+	_, err = r.Read(make([]byte, 10))
+	assert.ErrorIs(t, err, ErrRecordTampered)
+
+	// records can not be dropped or reordered
+	sealed[recordHeaderSize+10] ^= 1
+	first := recordHeaderSize + maxRecordSize + w.send.Overhead()
+	r, _ = newSecureConn(bufferConn{buf: bytes.NewBuffer(sealed[first:])}, key, key)
+	_, err = r.Read(make([]byte, 10))
+	assert.ErrorIs(t, err, ErrRecordTampered)
+}
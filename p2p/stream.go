@@ -0,0 +1,417 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// bytes a stream may receive before the reader acknowledges them
+	DefaultStreamWindow = 256 * 1024
+
+	// largest data payload sent in a single stream frame
+	maxStreamFrameData = 16 * 1024
+
+	// streams opened by the remote node and not yet claimed
+	// further streams it opens are reset
+	maxPendingStreams = 64
+)
+
+// ErrStreamReset is returned by operations on a stream
+// that was reset by either side or whose connection dropped
+var ErrStreamReset = errors.New("stream reset")
+
+// ErrStreamProtocol is returned for stream frames no well behaved
+// node sends | the connection they came over is closed
+var ErrStreamProtocol = errors.New("stream protocol error")
+
+// Stream is a logical stream multiplexed over a peer connection
+type Stream interface {
+	io.ReadWriteCloser
+
+	// ID returns the stream id shared by both sides
+	ID() uint64
+
+	// Reset aborts the stream in both directions
+	Reset() error
+}
+
+// muxer multiplexes logical streams over one connection
+type muxer struct {
+	// writes frames to the connection
+	w       io.Writer
+	encoder Encoder
+
+	// streams lock
+	lock sync.Mutex
+
+	// open streams keyed by stream id
+	streams map[uint64]*stream
+
+	// streams opened by the remote node not yet claimed
+	pending int
+
+	// id of the next stream opened locally
+	// dialers use odd ids and acceptors even ids so they never collide
+	nextID uint64
+
+	// set once the connection is gone
+	closed bool
+}
+
+func newMuxer(w io.Writer, encoder Encoder, outbound bool) *muxer {
+	m := &muxer{
+		w:       w,
+		encoder: encoder,
+		streams: make(map[uint64]*stream),
+		nextID:  2,
+	}
+	if outbound {
+		m.nextID = 1
+	}
+	return m
+}
+
+// write frame of type typ for stream id
+func (m *muxer) writeFrame(typ byte, id uint64, payload []byte) error {
+	frame := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(payload)), id)
+	frame = append(frame, payload...)
+	return m.encoder.Encode(m.w, typ, frame)
+}
+
+// open a new locally initiated stream
+func (m *muxer) open() (*stream, error) {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return nil, ErrStreamReset
+	}
+
+	id := m.nextID
+	m.nextID += 2
+
+	st := newStream(m, id)
+	st.claimed = true
+	m.streams[id] = st
+	m.lock.Unlock()
+
+	if err := m.writeFrame(StreamOpen, id, nil); err != nil {
+		m.remove(id)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// claim a stream opened by the remote node
+// a stream can only be claimed once
+func (m *muxer) claim(id uint64) (*stream, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	st, ok := m.streams[id]
+	if !ok {
+		return nil, fmt.Errorf("stream (%d) not open", id)
+	}
+
+	if st.claimed {
+		return nil, fmt.Errorf("stream (%d) already claimed", id)
+	}
+
+	st.claimed = true
+	m.pending--
+	return st, nil
+}
+
+func (m *muxer) get(id uint64) *stream {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.streams[id]
+}
+
+func (m *muxer) remove(id uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if st, ok := m.streams[id]; ok && !st.claimed {
+		m.pending--
+	}
+	delete(m.streams, id)
+}
+
+// handle stream frame read from the connection
+// never blocks on stream consumers so control messages keep flowing
+func (m *muxer) handleFrame(rpc RPC) error {
+	if rpc.Type == StreamOpen {
+		return m.remoteOpen(rpc.StreamID)
+	}
+
+	st := m.get(rpc.StreamID)
+	if st == nil {
+		// frames of streams that were reset may still be in flight
+		return nil
+	}
+
+	switch rpc.Type {
+	case StreamData:
+		return st.receive(rpc.Payload)
+
+	case StreamClose:
+		st.remoteClose()
+
+	case StreamReset:
+		st.remoteReset()
+
+	case StreamWindow:
+		inc, n := binary.Uvarint(rpc.Payload)
+		if n <= 0 {
+			return fmt.Errorf("%w: invalid window update for stream (%d)", ErrStreamProtocol, rpc.StreamID)
+		}
+		return st.grow(inc)
+	}
+
+	return nil
+}
+
+// add a stream opened by the remote node
+// streams beyond maxPendingStreams waiting to be claimed are reset
+func (m *muxer) remoteOpen(id uint64) error {
+	m.lock.Lock()
+
+	// ids of remote streams have the other parity than local ones
+	if id%2 == m.nextID%2 {
+		m.lock.Unlock()
+		return fmt.Errorf("%w: stream (%d) opened with a local id", ErrStreamProtocol, id)
+	}
+
+	if _, ok := m.streams[id]; ok {
+		m.lock.Unlock()
+		return fmt.Errorf("%w: stream (%d) already open", ErrStreamProtocol, id)
+	}
+
+	if m.pending >= maxPendingStreams {
+		m.lock.Unlock()
+		m.writeFrame(StreamReset, id, nil)
+		return fmt.Errorf("stream (%d) reset: %d streams waiting to be claimed", id, maxPendingStreams)
+	}
+
+	m.streams[id] = newStream(m, id)
+	m.pending++
+	m.lock.Unlock()
+
+	return nil
+}
+
+// reset every stream once the connection is gone
+func (m *muxer) close() {
+	m.lock.Lock()
+	streams := m.streams
+	m.streams = make(map[uint64]*stream)
+	m.pending = 0
+	m.closed = true
+	m.lock.Unlock()
+
+	for _, st := range streams {
+		st.remoteReset()
+	}
+}
+
+// stream implements Stream
+type stream struct {
+	id  uint64
+	mux *muxer
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	// received bytes not yet read
+	buf []byte
+
+	// bytes read but not yet acknowledged to the sender
+	unacked int
+
+	// bytes the remote node is still willing to receive
+	sendWindow int
+
+	// claimed by a local consumer
+	claimed bool
+
+	// half close state of both directions
+	localClosed  bool
+	remoteClosed bool
+
+	// stream was aborted
+	reset bool
+}
+
+func newStream(m *muxer, id uint64) *stream {
+	st := &stream{
+		id:         id,
+		mux:        m,
+		sendWindow: DefaultStreamWindow,
+	}
+	st.cond = sync.NewCond(&st.lock)
+	return st
+}
+
+func (s *stream) ID() uint64 {
+	return s.id
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	s.lock.Lock()
+	for len(s.buf) == 0 && !s.remoteClosed && !s.reset {
+		s.cond.Wait()
+	}
+
+	if s.reset {
+		s.lock.Unlock()
+		return 0, ErrStreamReset
+	}
+
+	if len(s.buf) == 0 {
+		s.lock.Unlock()
+		return 0, io.EOF
+	}
+
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	s.unacked += n
+
+	// acknowledge read bytes once half the window is consumed
+	var inc int
+	if s.unacked >= DefaultStreamWindow/2 {
+		inc = s.unacked
+		s.unacked = 0
+	}
+	s.lock.Unlock()
+
+	if inc > 0 {
+		s.mux.writeFrame(StreamWindow, s.id, binary.AppendUvarint(nil, uint64(inc)))
+	}
+
+	return n, nil
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		s.lock.Lock()
+		for s.sendWindow == 0 && !s.reset && !s.localClosed {
+			s.cond.Wait()
+		}
+
+		if s.reset {
+			s.lock.Unlock()
+			return written, ErrStreamReset
+		}
+
+		if s.localClosed {
+			s.lock.Unlock()
+			return written, io.ErrClosedPipe
+		}
+
+		n := min(len(b), s.sendWindow, maxStreamFrameData)
+		s.sendWindow -= n
+		s.lock.Unlock()
+
+		if err := s.mux.writeFrame(StreamData, s.id, b[:n]); err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close finishes the local side of the stream
+// the remote node reads EOF once it consumed all sent data
+func (s *stream) Close() error {
+	s.lock.Lock()
+	if s.localClosed || s.reset {
+		s.lock.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	done := s.remoteClosed
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	if done {
+		s.mux.remove(s.id)
+	}
+
+	return s.mux.writeFrame(StreamClose, s.id, nil)
+}
+
+func (s *stream) Reset() error {
+	s.lock.Lock()
+	if s.reset {
+		s.lock.Unlock()
+		return nil
+	}
+	s.reset = true
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	s.mux.remove(s.id)
+	return s.mux.writeFrame(StreamReset, s.id, nil)
+}
+
+// buffer data received from the remote node
+func (s *stream) receive(data []byte) error {
+	s.lock.Lock()
+
+	// the sender must respect the window it was granted
+	if len(s.buf)+len(data) > DefaultStreamWindow {
+		s.lock.Unlock()
+		s.Reset()
+		return fmt.Errorf("stream (%d) exceeded its flow control window", s.id)
+	}
+
+	s.buf = append(s.buf, data...)
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	return nil
+}
+
+// grow the send window by inc bytes
+// the remote node never acknowledges more than it was sent
+// so the window never grows past DefaultStreamWindow
+func (s *stream) grow(inc uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if inc > uint64(DefaultStreamWindow-s.sendWindow) {
+		return fmt.Errorf("%w: window update of %d bytes overflows stream (%d)", ErrStreamProtocol, inc, s.id)
+	}
+
+	s.sendWindow += int(inc)
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *stream) remoteClose() {
+	s.lock.Lock()
+	s.remoteClosed = true
+	done := s.localClosed
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	if done {
+		s.mux.remove(s.id)
+	}
+}
+
+func (s *stream) remoteReset() {
+	s.lock.Lock()
+	s.reset = true
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	s.mux.remove(s.id)
+}
@@ -0,0 +1,165 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// connect two peers over an in memory pipe
+// returns both peers and the messages each one receives
+func pipePeers(t *testing.T) (*TCPPeer, *TCPPeer, chan RPC, chan RPC) {
+	c1, c2 := net.Pipe()
+	p1, p2 := NewTCPPeer(c1, true), NewTCPPeer(c2, false)
+	m1, m2 := make(chan RPC, 16), make(chan RPC, 16)
+
+	readLoop := func(p *TCPPeer, msgs chan RPC) {
+		defer p.mux.close()
+		for {
+			rpc := RPC{}
+			if err := (FrameDecoder{}).Decode(p.Conn, &rpc); err != nil {
+				return
+			}
+			if rpc.Type == IncomingMessage {
+				msgs <- rpc
+				continue
+			}
+			p.mux.handleFrame(rpc)
+		}
+	}
+
+	go readLoop(p1, m1)
+	go readLoop(p2, m2)
+
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+
+	return p1, p2, m1, m2
+}
+
+func TestStreamConcurrentTransfers(t *testing.T) {
+	p1, p2, _, _ := pipePeers(t)
+
+	// larger than the flow control window
+	payloads := make([][]byte, 4)
+	for i := range payloads {
+		payloads[i] = make([]byte, 3*DefaultStreamWindow+i)
+		rand.Read(payloads[i])
+	}
+
+	ids := make([]uint64, len(payloads))
+	for i := range payloads {
+		st, err := p1.OpenStream()
+		assert.Nil(t, err)
+		ids[i] = st.ID()
+
+		go func(st Stream, b []byte) {
+			st.Write(b)
+			st.Close()
+		}(st, payloads[i])
+	}
+
+	var wg sync.WaitGroup
+	for i := range payloads {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var st Stream
+			assert.Eventually(t, func() bool {
+				var err error
+				st, err = p2.Stream(ids[i])
+				return err == nil
+			}, time.Second, time.Millisecond)
+
+			b, err := io.ReadAll(st)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(payloads[i], b))
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestStreamDoesNotBlockMessages(t *testing.T) {
+	p1, _, _, m2 := pipePeers(t)
+
+	// nobody reads this stream so the writer exhausts its window
+	st, err := p1.OpenStream()
+	assert.Nil(t, err)
+	go st.Write(make([]byte, 2*DefaultStreamWindow))
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, p1.Send([]byte("control")))
+
+	select {
+	case rpc := <-m2:
+		assert.Equal(t, []byte("control"), rpc.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("message stalled behind stream")
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	p1, p2, _, _ := pipePeers(t)
+
+	st, err := p1.OpenStream()
+	assert.Nil(t, err)
+
+	var remote Stream
+	assert.Eventually(t, func() bool {
+		remote, err = p2.Stream(st.ID())
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	assert.Nil(t, remote.Reset())
+
+	assert.Eventually(t, func() bool {
+		_, err := st.Write([]byte("data"))
+		return err == ErrStreamReset
+	}, time.Second, time.Millisecond)
+}
+
+func TestStreamLimits(t *testing.T) {
+	frames := new(bytes.Buffer)
+	m := newMuxer(frames, FrameEncoder{}, false)
+
+	// the remote node dialed so its streams have odd ids
+	for i := 0; i < maxPendingStreams; i++ {
+		assert.Nil(t, m.handleFrame(RPC{Type: StreamOpen, StreamID: uint64(2*i + 1)}))
+	}
+
+	// streams nobody claims are reset beyond the cap
+	id := uint64(2*maxPendingStreams + 1)
+	assert.NotNil(t, m.handleFrame(RPC{Type: StreamOpen, StreamID: id}))
+	assert.Nil(t, m.get(id))
+
+	rpc := RPC{}
+	for frames.Len() != 0 {
+		assert.Nil(t, (FrameDecoder{}).Decode(frames, &rpc))
+	}
+	assert.Equal(t, byte(StreamReset), rpc.Type)
+
+	// claiming a stream makes room for another one
+	_, err := m.claim(1)
+	assert.Nil(t, err)
+	assert.Nil(t, m.handleFrame(RPC{Type: StreamOpen, StreamID: id}))
+
+	err = m.handleFrame(RPC{Type: StreamOpen, StreamID: 2})
+	assert.ErrorIs(t, err, ErrStreamProtocol)
+
+	// the window never grows past what the stream started with
+	st, err := m.open()
+	assert.Nil(t, err)
+	err = m.handleFrame(RPC{Type: StreamWindow, StreamID: st.ID(), Payload: binary.AppendUvarint(nil, 1<<63)})
+	assert.ErrorIs(t, err, ErrStreamProtocol)
+	assert.Equal(t, DefaultStreamWindow, st.sendWindow)
+}
@@ -1,20 +1,19 @@
 package p2p
 
 import (
-	"bytes"
+	"crypto/ecdh"
 	"crypto/ecdsa"
-	"encoding/gob"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"log"
-	"math/big"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/luqxus/dstore/contract"
 
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/crypto/secp256k1"
 )
 
 // TCPPeer represents the remote node over TCP established connection
@@ -28,52 +27,120 @@ type TCPPeer struct {
 	// if we accept and retrieve a conn => outbound => false
 	outbound bool
 
-	wg *sync.WaitGroup
+	// frames outgoing transmissions
+	encoder Encoder
+
+	// multiplexes streams over the connection
+	mux *muxer
 
 	PublicKey ecdsa.PublicKey
+
+	// address the peer listens on as signed during the handshake
+	ListenAddr string
+
+	// negotiated protocol version
+	Version uint16
+
+	// capabilities both nodes support
+	Capabilities []string
 }
 
 type TCPTransportOpts struct {
 	ListenAddr    string
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
+	Encoder       Encoder
 	OnPeer        func(Peer) error
 	Contract      contract.Contract
+
+	// called once a peer accepted by OnPeer disconnects
+	// with the error that ended the connection
+	OnPeerDisconnect func(Peer, error)
+
+	// node keystore answering handshake challenges
+	Keystore Keystore
+
+	// optional features announced during the handshake
+	Capabilities []string
+
+	// DefaultHandshakeTimeout if zero
+	HandshakeTimeout time.Duration
 }
 
 type TCPTransport struct {
 	TCPTransportOpts
 	listener net.Listener
 	rpcch    chan RPC
+
+	// node private key loaded on the first handshake
+	keyLock sync.Mutex
+	key     *ecdsa.PrivateKey
+
+	// optional hook losing incoming messages on simulated networks
+	dropMessage func() bool
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		encoder:  FrameEncoder{},
+		mux:      newMuxer(conn, FrameEncoder{}, outbound),
 	}
 }
 
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+// OpenStream implements the Peer interface
+func (p *TCPPeer) OpenStream() (Stream, error) {
+	return p.mux.open()
+}
+
+// Stream implements the Peer interface
+func (p *TCPPeer) Stream(id uint64) (Stream, error) {
+	return p.mux.claim(id)
 }
 
 func (p *TCPPeer) SetPublicKey(key ecdsa.PublicKey) {
 	p.PublicKey = key
 }
 
+// Identity implements the Peer interface
+func (p *TCPPeer) Identity() string {
+	if p.PublicKey.X == nil {
+		return ""
+	}
+	return crypto.PubkeyToAddress(p.PublicKey).Hex()
+}
+
+// Outbound implements the Peer interface
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
 // Addr implements transport interface
 func (t *TCPTransport) Addr() string {
 	return t.ListenAddr
 }
 
+// Send implements the Peer interface
+// sends b to the remote node as a single message
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
-	return err
+	return p.encoder.Encode(p.Conn, IncomingMessage, b)
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
+	// streams are multiplexed over framed connections
+	if opts.Decoder == nil {
+		opts.Decoder = FrameDecoder{}
+	}
+
+	if opts.Encoder == nil {
+		opts.Encoder = FrameEncoder{}
+	}
+
+	if opts.HandshakeTimeout == 0 {
+		opts.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcch:            make(chan RPC, 1024),
@@ -136,18 +203,33 @@ func (t *TCPTransport) startAcceptLoop() {
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	var err error
 
+	// set once OnPeer accepted the peer
+	var connected bool
+
+	peer := NewTCPPeer(conn, outbound)
+
 	defer func() {
-		fmt.Printf("dropping peer connection: %s", err.Error())
+		fmt.Printf("dropping peer connection: %s\n", err.Error())
 		conn.Close()
+
+		if connected && t.OnPeerDisconnect != nil {
+			t.OnPeerDisconnect(peer, err)
+		}
 	}()
 
-	peer := NewTCPPeer(conn, outbound)
+	peer.encoder = t.Encoder
 
 	fmt.Printf("New Connected Peer : %+v\n", peer)
 	if err = t.HandshakeFunc(peer, t.DefaultHandshakeFunc); err != nil {
 		return
 	}
 
+	// the handshake may have wrapped the connection in an encrypted session
+	peer.mux = newMuxer(peer.Conn, t.Encoder, outbound)
+
+	// streams fail once the connection is gone
+	defer peer.mux.close()
+
 	fmt.Printf("peer public key : %+v\n", peer.PublicKey)
 
 	if t.OnPeer != nil {
@@ -155,26 +237,36 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			return
 		}
 	}
+	connected = true
 
 	for {
 
 		// Read loop
 		rpc := RPC{}
-		err := t.Decoder.Decode(conn, &rpc)
+		err = t.Decoder.Decode(peer.Conn, &rpc)
 		if err != nil {
 			// log.Printf("tcp error: %s", "connection closed")
 			return
 		}
 
 		rpc.From = conn.RemoteAddr().String()
-		if rpc.Stream {
-			// fmt.Println("Waiting")
-			peer.wg.Add(1)
-			fmt.Println("incoming stream. waiting...")
-			peer.wg.Wait()
-			// fmt.Println("Done Waiting")
-			fmt.Println("stream closed. resuming read")
+
+		// stream frames are handled by the peer muxer
+		// so a transfer never blocks the read loop
+		if rpc.Type != IncomingMessage {
+			if err = peer.mux.handleFrame(rpc); errors.Is(err, ErrStreamProtocol) {
+				return
+			}
+			if err != nil {
+				log.Printf("stream error from %s: %s", rpc.From, err)
+			}
+			continue
 		}
+
+		if t.dropMessage != nil && t.dropMessage() {
+			continue
+		}
+
 		t.rpcch <- rpc
 	}
 
@@ -197,136 +289,140 @@ func (t *TCPTransport) Dial(addr string) error {
 	return nil
 }
 
+// DefaultHandshakeFunc authenticates peer with a mutual challenge-response
+// both sides exchange fresh nonces and sign them together with both
+// listen addresses so a replayed public key or signature is rejected
+// the authenticated address must then be allowed by the contract
+// all traffic after the handshake is encrypted with keys agreed on
+// through the signed ephemeral keys
 func (t *TCPTransport) DefaultHandshakeFunc(peer Peer) error {
-	// FIXME: @luqxus do not generate private key here
+	p, ok := peer.(*TCPPeer)
+	if !ok {
+		return fmt.Errorf("%w: unsupported peer %T", ErrHandshake, peer)
+	}
 
-	myKey, err := t.Contract.GetPublicKey()
+	key, err := t.privateKey()
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Our Public Key : %+v\n", toSerializablePubKey(myKey))
-
-	buf := new(bytes.Buffer)
-	err = gob.NewEncoder(buf).Encode(&myKey)
+	// fresh key per connection so past sessions stay secret
+	// if the node key leaks
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
 	if err != nil {
 		return err
 	}
 
-	if err := peer.Send(buf.Bytes()); err != nil {
+	// bound the whole exchange so a silent peer can not hold the connection
+	if err := peer.SetDeadline(time.Now().Add(t.HandshakeTimeout)); err != nil {
 		return err
 	}
+	defer peer.SetDeadline(time.Time{})
 
-	// timeout := 40 * time.Second
-	// done := make(chan bool, 1)
-	// var keyCh chan ecdsa.PublicKey
-	// go func() {
-
-	b, err := receivePeerPublicKey(peer)
+	nonce, err := newNonce()
 	if err != nil {
-		// done <- false
-		log.Printf("handshake error : %s\n", err.Error())
 		return err
 	}
 
-	var serializablePubKey SerializablePubKey
+	ours := handshakeHello{
+		Version:      ProtocolVersion,
+		MinVersion:   MinProtocolVersion,
+		Capabilities: t.Capabilities,
+		ListenAddr:   t.ListenAddr,
+		Nonce:        nonce,
+		EphemeralKey: ephemeral.PublicKey().Bytes(),
+	}
 
-	err = gob.NewDecoder(bytes.NewBuffer(b)).Decode(&serializablePubKey)
-	if err != nil {
-		// done <- false
-		log.Printf("handshake error. error decoding: %s", err.Error())
+	if err := sendHandshake(peer, ours); err != nil {
 		return err
 	}
 
-	fmt.Printf("skdjklasjdlkjaskldklas %+v\n", serializablePubKey)
+	var theirs handshakeHello
+	if err := t.receiveHandshake(peer, &theirs); err != nil {
+		return fmt.Errorf("%w: reading hello: %s", ErrHandshake, err)
+	}
+
+	if len(theirs.Nonce) != nonceSize {
+		return fmt.Errorf("%w: invalid nonce", ErrHandshake)
+	}
 
-	pubKey, err := fromSerializablePubKey(serializablePubKey)
+	version, err := negotiateVersion(ours, theirs)
 	if err != nil {
-		log.Printf("handshake error. error decoding: %s", err.Error())
 		return err
 	}
 
-	fmt.Printf("Received Public Key : %+v\n", pubKey)
-
-	// keyCh <- pubKey
-	fmt.Printf("Address Verified : %s\n", peer.LocalAddr().Network())
-	ok, err := t.Contract.VerifyNode(crypto.PubkeyToAddress(*pubKey), peer.LocalAddr().Network())
+	// answer the peer challenge
+	auth, err := signChallenge(key, version, ours, theirs)
 	if err != nil {
-		// done <- false
-		log.Printf("handshake error :  invalid public key")
 		return err
 	}
 
-	fmt.Printf("Decoded Address : %s\n", crypto.PubkeyToAddress(*pubKey).Hex())
-
-	if !ok {
-		return fmt.Errorf("handshake error : node not validated")
+	if err := sendHandshake(peer, auth); err != nil {
+		return err
 	}
 
-	// done <- ok
+	// check the peer answer to our challenge
+	var theirAuth handshakeAuth
+	if err := t.receiveHandshake(peer, &theirAuth); err != nil {
+		return fmt.Errorf("%w: reading auth: %s", ErrHandshake, err)
+	}
 
-	// }()
+	pubKey, err := verifyChallenge(theirAuth, version, theirs, ours)
+	if err != nil {
+		return err
+	}
 
-	// select {
-	// case success := <-done:
-	// 	if !success {
-	// 		<-keyCh
-	// 		return fmt.Errorf("handshake error : failed to verify peer's public key")
-	// 	}
-	peer.SetPublicKey(*pubKey)
-	// 	return nil
+	address := crypto.PubkeyToAddress(*pubKey)
 
-	// case <-time.After(timeout):
-	// 	return fmt.Errorf("handshake error: timeout")
-	// }
+	// the authenticated node must be registered on chain for its listen address
+	if t.Contract != nil {
+		ok, err := t.Contract.VerifyNode(address, theirs.ListenAddr)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		if !ok {
+			return fmt.Errorf("%w: node (%s) not validated", ErrHandshake, address.Hex())
+		}
+	}
 
-}
+	sendKey, recvKey, err := sessionKeys(ephemeral, ours, theirs, p.outbound)
+	if err != nil {
+		return err
+	}
 
-func receivePeerPublicKey(peer Peer) ([]byte, error) {
-	b := make([]byte, 512)
-	n, err := peer.Read(b)
+	// everything after the handshake goes through the encrypted session
+	p.Conn, err = newSecureConn(p.Conn, sendKey, recvKey)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	fmt.Printf("number kdsjfkdsfkldslfksdf : %d\n", n)
+	p.SetPublicKey(*pubKey)
+	p.ListenAddr = theirs.ListenAddr
+	p.Version = version
+	p.Capabilities = commonCapabilities(t.Capabilities, theirs.Capabilities)
 
-	return b[:n], err
+	return nil
 }
 
-func init() {
-	gob.Register(ecdsa.PublicKey{})
-	gob.Register(secp256k1.BitCurve{})
-}
+// returns the node private key loading it from the keystore once
+func (t *TCPTransport) privateKey() (*ecdsa.PrivateKey, error) {
+	t.keyLock.Lock()
+	defer t.keyLock.Unlock()
 
-type SerializablePubKey struct {
-	CurveName string // Name of the curve
-	X, Y      *big.Int
-}
+	if t.key != nil {
+		return t.key, nil
+	}
 
-// toSerializablePubKey converts ecdsa.PublicKey to SerializablePubKey
-func toSerializablePubKey(pubKey *ecdsa.PublicKey) SerializablePubKey {
-	return SerializablePubKey{
-		CurveName: "secp256k1", // Use the name for the specific curve
-		X:         pubKey.X,
-		Y:         pubKey.Y,
+	if t.Keystore == nil {
+		return nil, fmt.Errorf("%w: transport has no keystore", ErrHandshake)
 	}
-}
 
-// fromSerializablePubKey converts SerializablePubKey back to ecdsa.PublicKey
-func fromSerializablePubKey(s SerializablePubKey) (*ecdsa.PublicKey, error) {
-	// var curve elliptic.Curve
-	// if s.CurveName == "secp256k1" {
-	// 	curve = secp256k1.S256() // Assign the secp256k1 curve
-	// } else {
-	// 	return nil, log.Output(0, "Unsupported curve")
-	// }
+	key, err := t.Keystore.PrivateKey()
+	if err != nil {
+		return nil, err
+	}
 
-	return &ecdsa.PublicKey{
-		Curve: secp256k1.S256(),
-		X:     s.X,
-		Y:     s.Y,
-	}, nil
+	t.key = key
+	return key, nil
 }
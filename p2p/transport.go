@@ -9,8 +9,20 @@ import (
 type Peer interface {
 	net.Conn
 	Send([]byte) error
+
+	// OpenStream opens a new logical stream to the remote node
+	OpenStream() (Stream, error)
+
+	// Stream returns the stream with id opened by the remote node
+	Stream(id uint64) (Stream, error)
 	SetPublicKey(ecdsa.PublicKey)
-	CloseStream()
+
+	// Identity returns the address of the key the remote node
+	// proved it holds during the handshake | empty if it proved none
+	Identity() string
+
+	// Outbound reports whether this node dialed the connection
+	Outbound() bool
 }
 
 // Transport handles communication between nodes in the network.
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/luqxus/dstore/p2p"
+)
+
+const (
+	// default time between two heartbeats sent to every peer
+	defaultHeartbeatInterval = 15 * time.Second
+
+	// consecutive unanswered heartbeats after which
+	// a connection is considered half open and closed
+	heartbeatMisses = 3
+
+	// default delay before the first redial of a lost peer
+	defaultRedialBackoff = time.Second
+
+	// default upper bound of the delay between two redials
+	defaultMaxRedialBackoff = time.Minute
+
+	// redials of a lost peer before giving up on it
+	// bootstrap nodes are redialed until they are back
+	maxRedialAttempts = 10
+)
+
+// PeerEventType tells whether a peer joined or left
+type PeerEventType int
+
+const (
+	// PeerJoined is emitted once a connected peer announced itself
+	// a second connection to the same node is not reported
+	PeerJoined PeerEventType = iota
+
+	// PeerLeft is emitted once the last connection to a peer
+	// that announced itself is gone
+	PeerLeft
+)
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerJoined:
+		return "joined"
+	case PeerLeft:
+		return "left"
+	}
+	return fmt.Sprintf("PeerEventType(%d)", int(t))
+}
+
+// PeerEvent describes a peer joining or leaving
+type PeerEvent struct {
+	Type PeerEventType
+
+	// remote address of the connection | key of the peers map
+	Addr string
+
+	// placement info the peer announced | zero if it never did
+	Node NodeInfo
+
+	// error that ended the connection of a leaving peer
+	Err error
+}
+
+// MessagePing is a heartbeat a peer answers with MessagePong
+type MessagePing struct {
+	Sent time.Time
+}
+
+// MessagePong answers MessagePing
+type MessagePong struct {
+
+	// send time of the ping answered
+	Sent time.Time
+}
+
+// implements OnPeerDisconnect transport interface
+// removes the peer and redials it if this node is the one
+// keeping the connection up
+func (s *FileServer) OnPeerDisconnect(peer p2p.Peer, err error) {
+	addr := peer.RemoteAddr().String()
+
+	s.peerLock.Lock()
+
+	// the connection may have been replaced already
+	if s.peers[addr] != peer {
+		s.peerLock.Unlock()
+		return
+	}
+
+	node, announced := s.nodes[addr]
+	delete(s.peers, addr)
+	delete(s.nodes, addr)
+	delete(s.misses, addr)
+
+	// another connection to the same node keeps it reachable
+	reachable := false
+	if announced {
+		for _, other := range s.nodes {
+			if other.ID == node.ID {
+				reachable = true
+				break
+			}
+		}
+	}
+
+	s.peerLock.Unlock()
+
+	log.Printf("peer (%s) disconnected: %s", addr, err)
+
+	if announced && !reachable {
+		s.dht.Remove(contactOf(node).ID)
+	}
+
+	if reachable {
+		return
+	}
+
+	// only nodes reported joining are reported leaving
+	if announced {
+		s.emit(PeerEvent{Type: PeerLeft, Addr: addr, Node: node, Err: err})
+	}
+
+	// the dialing side redials so both sides never race to reconnect
+	// an outbound connection that never announced is redialed on
+	// the address it was dialed on
+	redialAddr := node.Addr
+	if !announced && peer.Outbound() {
+		redialAddr = addr
+	}
+
+	switch {
+	case len(redialAddr) == 0:
+	case s.isBootstrapNode(redialAddr):
+		go s.redial(redialAddr, 0)
+	case peer.Outbound():
+		go s.redial(redialAddr, maxRedialAttempts)
+	}
+}
+
+// reports whether addr is one of the configured bootstrap nodes
+func (s *FileServer) isBootstrapNode(addr string) bool {
+	for _, node := range s.BootstrapNodes {
+		if node == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// calls the OnPeerEvent hook with event
+func (s *FileServer) emit(event PeerEvent) {
+	if s.OnPeerEvent != nil {
+		s.OnPeerEvent(event)
+	}
+}
+
+// redial addr with exponential backoff and jitter until it is
+// connected again | gives up after attempts tries unless attempts is zero
+func (s *FileServer) redial(addr string, attempts int) {
+	// a single redial loop per address
+	s.peerLock.Lock()
+	if s.redialing[addr] {
+		s.peerLock.Unlock()
+		return
+	}
+	s.redialing[addr] = true
+	s.peerLock.Unlock()
+
+	defer func() {
+		s.peerLock.Lock()
+		delete(s.redialing, addr)
+		s.peerLock.Unlock()
+	}()
+
+	backoff := s.RedialBackoff
+	for attempt := 1; attempts == 0 || attempt <= attempts; attempt++ {
+		select {
+		case <-time.After(jitter(backoff)):
+		case <-s.quitch:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+		_, err := s.connect(ctx, addr)
+		cancel()
+
+		if err == nil {
+			log.Printf("reconnected to (%s) after %d attempts", addr, attempt)
+			return
+		}
+
+		log.Printf("redial (%s) attempt %d failed: %s", addr, attempt, err)
+
+		backoff = min(2*backoff, s.MaxRedialBackoff)
+	}
+
+	log.Printf("giving up on peer (%s)", addr)
+}
+
+// returns d randomized to [d/2, 3d/2) so nodes losing
+// the same peer do not redial it in lockstep
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// heartbeat loop
+// pings every peer to detect half open connections
+func (s *FileServer) heartbeatLoop() {
+	ticker := time.NewTicker(s.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.heartbeat()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// pings every connected peer once
+// closing connections that missed heartbeatMisses pings in a row
+func (s *FileServer) heartbeat() {
+	// usage drops as files are deleted
+	s.announceUsage()
+
+	s.peerLock.Lock()
+	peers := make(map[string]p2p.Peer, len(s.peers))
+	for addr, peer := range s.peers {
+		peers[addr] = peer
+	}
+	s.peerLock.Unlock()
+
+	var wg sync.WaitGroup
+	for addr, peer := range peers {
+		wg.Add(1)
+		go func(addr string, peer p2p.Peer) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+			defer cancel()
+
+			_, err := s.request(ctx, peer, MessagePing{Sent: time.Now()})
+			if s.missedHeartbeat(addr, peer, err) {
+				log.Printf("peer (%s) missed %d heartbeats, closing connection", addr, heartbeatMisses)
+				peer.Close()
+			}
+		}(addr, peer)
+	}
+
+	wg.Wait()
+}
+
+// records the heartbeat outcome err of peer
+// returns true if the peer missed too many heartbeats
+func (s *FileServer) missedHeartbeat(addr string, peer p2p.Peer, err error) bool {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if s.peers[addr] != peer {
+		return false
+	}
+
+	if err == nil {
+		delete(s.misses, addr)
+		return false
+	}
+
+	s.misses[addr]++
+	if s.misses[addr] < heartbeatMisses {
+		return false
+	}
+
+	delete(s.misses, addr)
+	return true
+}
+
+// handle MessagePing message from peer
+func (s *FileServer) handleMessagePing(from string, id string, msg MessagePing) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	return s.send(peer, &Message{ID: id, Payload: MessagePong{Sent: msg.Sent}})
+}
+
+// handle MessagePong message from peer
+func (s *FileServer) handleMessagePong(from string, id string, msg MessagePong) error {
+	if !s.deliverReply(from, id, msg) {
+		return fmt.Errorf("reply (%s) from peer (%s) to unknown request", id, from)
+	}
+	return nil
+}
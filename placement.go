@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// default number of virtual nodes per node on the hash ring
+const defaultVirtualNodes = 64
+
+// NodeInfo describes a node taking part in placement
+type NodeInfo struct {
+
+	// stable node id | the node Ethereum address if known
+	ID string
+
+	// address the node listens on
+	Addr string
+
+	// optional site (clinic, data center) the node runs in
+	Site string
+
+	// optional rack within the site
+	Rack string
+
+	// bytes of content the node holds at most | unlimited if zero
+	Capacity int64
+
+	// bytes of content the node held when it announced itself
+	Used int64
+}
+
+// reports whether the node announced room for size more bytes
+func (n NodeInfo) hasRoom(size int64) bool {
+	return n.Capacity <= 0 || n.Used+size <= n.Capacity
+}
+
+// Placement picks the nodes responsible for holding an object
+type Placement interface {
+
+	// Place returns up to n of nodes responsible for digest
+	// most responsible node first
+	Place(digest string, nodes []NodeInfo, n int) []NodeInfo
+}
+
+// HashRingPlacement implements Placement with consistent hashing
+// nodes on other sites and racks are preferred so copies
+// survive the loss of a whole site or rack
+type HashRingPlacement struct {
+
+	// virtual nodes per node | defaultVirtualNodes if zero
+	VirtualNodes int
+}
+
+// point on the hash ring owned by a node
+type ringPoint struct {
+	hash uint64
+	node int
+}
+
+func ringHash(s string) uint64 {
+	h := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+func (p HashRingPlacement) Place(digest string, nodes []NodeInfo, n int) []NodeInfo {
+	if n <= 0 || len(nodes) == 0 {
+		return nil
+	}
+
+	vnodes := p.VirtualNodes
+	if vnodes == 0 {
+		vnodes = defaultVirtualNodes
+	}
+
+	// build ring from the virtual nodes of every node
+	ring := make([]ringPoint, 0, len(nodes)*vnodes)
+	for i, node := range nodes {
+		for v := 0; v < vnodes; v++ {
+			ring = append(ring, ringPoint{
+				hash: ringHash(node.ID + "#" + strconv.Itoa(v)),
+				node: i,
+			})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	// walk the ring clockwise from the object position
+	// collecting distinct nodes in ring order
+	start := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= ringHash(digest)
+	})
+
+	seen := make(map[int]bool)
+	order := make([]int, 0, len(nodes))
+	for i := 0; i < len(ring) && len(order) < len(nodes); i++ {
+		point := ring[(start+i)%len(ring)]
+		if !seen[point.node] {
+			seen[point.node] = true
+			order = append(order, point.node)
+		}
+	}
+
+	// pick nodes on unused sites first then unused racks
+	// then fill up with whatever is left in ring order
+	picked := make([]NodeInfo, 0, n)
+	taken := make(map[int]bool)
+	sites := make(map[string]bool)
+	racks := make(map[string]bool)
+
+	pick := func(accept func(NodeInfo) bool) {
+		for _, i := range order {
+			if len(picked) == n {
+				return
+			}
+			if taken[i] || !accept(nodes[i]) {
+				continue
+			}
+			taken[i] = true
+			picked = append(picked, nodes[i])
+			sites[nodes[i].Site] = true
+			racks[nodes[i].Site+"/"+nodes[i].Rack] = true
+		}
+	}
+
+	pick(func(node NodeInfo) bool { return !sites[node.Site] })
+	pick(func(node NodeInfo) bool { return !racks[node.Site+"/"+node.Rack] })
+	pick(func(node NodeInfo) bool { return true })
+
+	return picked
+}
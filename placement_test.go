@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testNodes(n int) []NodeInfo {
+	nodes := make([]NodeInfo, n)
+	for i := range nodes {
+		nodes[i] = NodeInfo{ID: fmt.Sprintf("node-%d", i)}
+	}
+	return nodes
+}
+
+func TestHashRingPlacement(t *testing.T) {
+	p := HashRingPlacement{}
+	nodes := testNodes(10)
+
+	placed := p.Place("b159a9f0a78305c07dbce386598952bfa30b6aabb46a98b072c9195348abf9ea", nodes, 3)
+	assert.Len(t, placed, 3)
+
+	// placement is deterministic and independent of node order
+	reversed := make([]NodeInfo, len(nodes))
+	for i, node := range nodes {
+		reversed[len(nodes)-1-i] = node
+	}
+	assert.Equal(t, placed, p.Place("b159a9f0a78305c07dbce386598952bfa30b6aabb46a98b072c9195348abf9ea", reversed, 3))
+
+	// never more copies than nodes
+	assert.Len(t, p.Place("digest", nodes[:2], 3), 2)
+}
+
+func TestHashRingPlacementStability(t *testing.T) {
+	p := HashRingPlacement{}
+	nodes := testNodes(20)
+
+	// adding a node only moves the objects it becomes responsible for
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		digest := fmt.Sprintf("object-%d", i)
+		before := p.Place(digest, nodes, 1)[0]
+		after := p.Place(digest, append(nodes, NodeInfo{ID: "node-new"}), 1)[0]
+		if before != after {
+			assert.Equal(t, "node-new", after.ID)
+			moved++
+		}
+	}
+	assert.Less(t, moved, 150)
+}
+
+func TestHashRingPlacementSites(t *testing.T) {
+	p := HashRingPlacement{}
+	nodes := testNodes(9)
+	for i := range nodes {
+		nodes[i].Site = fmt.Sprintf("site-%d", i%3)
+	}
+
+	// copies are spread over distinct sites first
+	for i := 0; i < 100; i++ {
+		sites := make(map[string]bool)
+		for _, node := range p.Place(fmt.Sprintf("object-%d", i), nodes, 3) {
+			sites[node.Site] = true
+		}
+		assert.Len(t, sites, 3)
+	}
+}
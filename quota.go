@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// ErrCapacityExceeded is returned when a node has no room left for a file
+var ErrCapacityExceeded = errors.New("node capacity exceeded")
+
+// ErrQuotaExceeded is returned when a file would take its owner
+// over the quota the owner has on a node
+var ErrQuotaExceeded = errors.New("owner quota exceeded")
+
+// RejectReason tells why a node refused to store a file
+type RejectReason int
+
+const (
+	// the file was not refused
+	RejectNone RejectReason = iota
+
+	// the node has no room left for the file
+	RejectCapacity
+
+	// the file would take its owner over quota on the node
+	RejectQuota
+)
+
+// returns the error a rejection is reported with | nil if there is none
+func (r RejectReason) err() error {
+	switch r {
+	case RejectCapacity:
+		return ErrCapacityExceeded
+	case RejectQuota:
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// returns the reason err refused a file | RejectNone if it did not
+func rejectReason(err error) RejectReason {
+	switch {
+	case errors.Is(err, ErrCapacityExceeded):
+		return RejectCapacity
+	case errors.Is(err, ErrQuotaExceeded):
+		return RejectQuota
+	}
+	return RejectNone
+}
+
+// room reserved for an object is released when nothing
+// was received for it for reservationTimeout
+const reservationTimeout = 10 * time.Minute
+
+// room set aside for an object being received
+type reservation struct {
+	owner   string
+	size    int64
+	expires time.Time
+}
+
+// Usage returns the bytes of content held
+// computed by reading every manifest on first use
+func (s *Store) Usage() (int64, error) {
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+
+	return s.usageLocked()
+}
+
+// Usage with commitLock held
+func (s *Store) usageLocked() (int64, error) {
+	if s.usageKnown {
+		return s.usage, nil
+	}
+
+	digests, err := s.Objects()
+	if err != nil {
+		return 0, err
+	}
+
+	var usage int64
+	for _, digest := range digests {
+		m, err := s.Manifest(digest)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		usage += m.Size
+	}
+
+	s.usage, s.usageKnown = usage, true
+	return usage, nil
+}
+
+// subtract the size of the object with digest from the usage
+// before the object is removed | commitLock must be held
+func (s *Store) dropUsage(digest string) {
+	if !s.usageKnown {
+		return
+	}
+
+	m, err := s.Manifest(digest)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+
+	// a damaged manifest no longer tells the object size
+	if err != nil {
+		s.usageKnown = false
+		return
+	}
+
+	s.usage -= m.Size
+}
+
+// OwnerUsage returns the bytes of content held for owner
+// counted once for every distinct content owner is charged for
+// until it is collected | records without owner count for ""
+func (s *Store) OwnerUsage(owner string) (int64, error) {
+	idx, err := s.index()
+	if err != nil {
+		return 0, err
+	}
+
+	return idx.OwnerUsage(owner)
+}
+
+// Reserve sets size bytes aside for the object with digest of owner
+// until Release is called or it expires | fits is called with the
+// bytes held and reserved overall and for owner and fails if size
+// more bytes do not fit | an object reserved already is kept longer
+func (s *Store) Reserve(digest string, owner string, size int64, fits func(used int64, ownerUsed int64) error) error {
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+
+	if s.extendReservation(digest) {
+		return nil
+	}
+
+	used, err := s.usageLocked()
+	if err != nil {
+		return err
+	}
+
+	ownerUsed, err := s.OwnerUsage(owner)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range s.reserved {
+		used += r.size
+		if r.owner == owner {
+			ownerUsed += r.size
+		}
+	}
+
+	if err := fits(used, ownerUsed); err != nil {
+		return err
+	}
+
+	if s.reserved == nil {
+		s.reserved = make(map[string]reservation)
+	}
+	s.reserved[digest] = reservation{owner: owner, size: size, expires: time.Now().Add(reservationTimeout)}
+
+	return nil
+}
+
+// Reserved reports whether room is set aside for the object with
+// digest and keeps it reserved longer if it is
+func (s *Store) Reserved(digest string) bool {
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+
+	return s.extendReservation(digest)
+}
+
+// Release gives back the room reserved for the object with digest
+func (s *Store) Release(digest string) {
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+
+	delete(s.reserved, digest)
+}
+
+// drop expired reservations and keep the one of the object
+// with digest longer | commitLock must be held
+// returns true if the object has room reserved
+func (s *Store) extendReservation(digest string) bool {
+	now := time.Now()
+	for d, r := range s.reserved {
+		if now.After(r.expires) {
+			delete(s.reserved, d)
+		}
+	}
+
+	r, ok := s.reserved[digest]
+	if ok {
+		r.expires = now.Add(reservationTimeout)
+		s.reserved[digest] = r
+	}
+	return ok
+}
+
+// returns the bytes of the content of meta a node holds
+// one shard of the content if the record is erasure coded
+func heldSize(meta Metadata) int64 {
+	if l := meta.Erasure; l != nil && l.DataShards > 0 {
+		data := int64(l.DataShards)
+		return (meta.Size + data - 1) / data
+	}
+	return meta.Size
+}
+
+// returns the quota of owner on this node | zero if unlimited
+func (s *FileServer) quotaOf(owner string) int64 {
+	if quota, ok := s.OwnerQuotas[owner]; ok {
+		return quota
+	}
+	return s.OwnerQuota
+}
+
+// sets room aside for size bytes of the object with digest of owner
+// until it is released | records without owner share the default quota
+func (s *FileServer) reserveRoom(digest string, owner string, size int64) error {
+	return s.store.Reserve(digest, owner, size, func(used int64, ownerUsed int64) error {
+		return s.checkRoom(owner, size, used, ownerUsed)
+	})
+}
+
+// fails with ErrCapacityExceeded if this node has no room for size
+// more bytes on top of used | ErrQuotaExceeded if they take owner
+// over its quota on top of ownerUsed
+func (s *FileServer) checkRoom(owner string, size int64, used int64, ownerUsed int64) error {
+	if s.Capacity > 0 && used+size > s.Capacity {
+		return fmt.Errorf("%w: %d of %d bytes used, %d more asked for", ErrCapacityExceeded, used, s.Capacity, size)
+	}
+
+	if quota := s.quotaOf(owner); quota > 0 && ownerUsed+size > quota {
+		return fmt.Errorf("%w: owner (%s) uses %d of %d bytes, %d more asked for", ErrQuotaExceeded, owner, ownerUsed, quota, size)
+	}
+
+	return nil
+}
+
+// returns placement info of this node with the bytes it holds
+func (s *FileServer) nodeInfo() NodeInfo {
+	node := s.self
+	if node.Capacity <= 0 {
+		return node
+	}
+
+	used, err := s.store.Usage()
+	if err != nil {
+		// a node that cannot tell its usage takes no more files
+		log.Printf("computing storage usage: %s", err)
+		used = node.Capacity
+	}
+	node.Used = used
+
+	return node
+}
+
+// tell peers how much room this node has left if it changed
+// since it was last told | nodes without a capacity never fill up
+func (s *FileServer) announceUsage() {
+	if s.Capacity <= 0 {
+		return
+	}
+
+	node := s.nodeInfo()
+	if s.announcedUsage.Swap(node.Used) == node.Used {
+		return
+	}
+
+	if err := s.broadcast(&Message{Payload: MessageAnnounce{Node: node}}); err != nil {
+		log.Printf("announcing storage usage: %s", err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// chunks of an interrupted transfer untouched for longer
+// than partialRetention are dropped on recovery
+const partialRetention = 24 * time.Hour
+
+// Recover removes what writes interrupted by a crash left behind
+// temporary files | half written name mappings and tombstones |
+// chunk folders whose manifest was never written
+// verified chunks of interrupted transfers are kept so they resume
+// must run before the store is used
+// returns number of removed files and folders (int) | error
+func (s *Store) Recover() (int, error) {
+	removed := 0
+
+	remove := func(path string) error {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	}
+
+	// every write in progress is in tmpFolder
+	tmp := s.Root + "/" + tmpFolder
+	entries, err := readDir(tmp)
+	if err != nil {
+		return removed, err
+	}
+
+	for _, entry := range entries {
+		if entry.Name() == partialFolder {
+			continue
+		}
+		if err := remove(tmp + "/" + entry.Name()); err != nil {
+			return removed, err
+		}
+	}
+
+	n, err := s.recoverPartial()
+	removed += n
+	if err != nil {
+		return removed, err
+	}
+
+	// mappings and tombstones are replaced through a .tmp file
+	for _, folder := range []string{namesFolder, tombstonesFolder} {
+		entries, err := readDir(s.Root + "/" + folder)
+		if err != nil {
+			return removed, err
+		}
+
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".tmp") {
+				continue
+			}
+			if err := remove(s.Root + "/" + folder + "/" + entry.Name()); err != nil {
+				return removed, err
+			}
+		}
+	}
+
+	// chunks are stored before the manifest is written
+	// and deleted after it is removed
+	keys, err := s.Blobs.List(chunksFolder + "/")
+	if err != nil {
+		return removed, err
+	}
+
+	checked := make(map[string]bool)
+	for _, key := range keys {
+		// chunks are stored under the object digest
+		digest := path.Base(path.Dir(key))
+		if checked[digest] || !isSHA256Hex(digest) {
+			continue
+		}
+		checked[digest] = true
+
+		held, err := s.HasDigest(digest)
+		if err != nil {
+			return removed, err
+		}
+		if held {
+			continue
+		}
+
+		prefix, err := s.chunkPrefix(digest)
+		if err != nil {
+			return removed, err
+		}
+
+		if err := s.deletePrefix(prefix); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// remove temporary chunk files of interrupted transfers
+// and transfers untouched for longer than partialRetention
+// returns number of removed files and folders (int) | error
+func (s *Store) recoverPartial() (int, error) {
+	partial := s.Root + "/" + tmpFolder + "/" + partialFolder
+	entries, err := readDir(partial)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		dir := partial + "/" + entry.Name()
+
+		info, err := entry.Info()
+		if err != nil {
+			return removed, err
+		}
+
+		if !entry.IsDir() || time.Since(info.ModTime()) > partialRetention {
+			if err := os.RemoveAll(dir); err != nil {
+				return removed, err
+			}
+			removed++
+			continue
+		}
+
+		chunks, err := os.ReadDir(dir)
+		if err != nil {
+			return removed, err
+		}
+
+		// only chunks renamed to their digest were verified
+		for _, chunk := range chunks {
+			if isSHA256Hex(chunk.Name()) {
+				continue
+			}
+			if err := os.RemoveAll(dir + "/" + chunk.Name()); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// returns the entries of folder path | none if it does not exist
+func readDir(path string) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return entries, err
+}
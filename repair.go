@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/luqxus/dstore/p2p"
+)
+
+const (
+	// default time between two anti-entropy repair rounds
+	defaultRepairInterval = 10 * time.Minute
+
+	// sync tree requests of peers answered at once
+	maxSyncTreeRequests = 4
+
+	// time the tree a peer walks is kept between its requests
+	syncTreeTTL = time.Minute
+)
+
+// MessageSyncTree asks a peer for parts of the
+// Merkle tree summarizing its object set
+type MessageSyncTree struct {
+
+	// tree nodes whose hashes are requested
+	Nodes []int
+
+	// leaf nodes whose objects are requested
+	Leaves []int
+}
+
+// MessageSyncTreeReply answers MessageSyncTree
+type MessageSyncTreeReply struct {
+
+	// hashes of the requested nodes in request order
+	Hashes [][]byte
+
+	// objects under the requested leaves
+	Entries []SyncEntry
+
+	// set if the peer failed to summarize its objects
+	Error string
+}
+
+// RepairStats counts the work done by anti-entropy repair
+type RepairStats struct {
+
+	// completed repair rounds
+	Rounds uint64
+
+	// peers whose object sets were compared
+	PeersSynced uint64
+
+	// objects pulled from peers
+	ObjectsRepaired uint64
+
+	// key mappings restored from peers
+	NamesRepaired uint64
+
+	// shards of erasure coded records fetched or regenerated
+	ShardsRepaired uint64
+
+	// failed peer syncs and object pulls
+	Failures uint64
+}
+
+// repair counters updated concurrently
+type repairMetrics struct {
+	rounds   atomic.Uint64
+	peers    atomic.Uint64
+	objects  atomic.Uint64
+	names    atomic.Uint64
+	shards   atomic.Uint64
+	failures atomic.Uint64
+}
+
+// RepairStats returns the anti-entropy repair metrics
+func (s *FileServer) RepairStats() RepairStats {
+	return RepairStats{
+		Rounds:          s.repairs.rounds.Load(),
+		PeersSynced:     s.repairs.peers.Load(),
+		ObjectsRepaired: s.repairs.objects.Load(),
+		NamesRepaired:   s.repairs.names.Load(),
+		ShardsRepaired:  s.repairs.shards.Load(),
+		Failures:        s.repairs.failures.Load(),
+	}
+}
+
+// run repair rounds every RepairInterval until the server stops
+func (s *FileServer) repairLoop() {
+	ticker := time.NewTicker(s.RepairInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.repair()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// Merkle tree summarizing the objects a node and a peer walking
+// it are both responsible for | kept while the walk lasts
+type syncTree struct {
+	tree    *MerkleTree
+	expires time.Time
+}
+
+// repair compares the objects this node and every placed peer are
+// both responsible for and pulls the ones this node misses
+// then restores the shards of the erasure coded records it knows
+func (s *FileServer) repair() {
+	// tombstones must outlive the repairs that could resurrect their records
+	s.purgeTombstones()
+
+	// the object set is read once a round
+	objects, err := s.store.Names()
+	if err != nil {
+		log.Printf("listing objects to repair: %s", err)
+		s.repairs.failures.Add(1)
+	} else {
+		for id, peer := range s.syncPeers() {
+			if err := s.syncWith(peer, s.sharedObjects(objects, id)); err != nil {
+				log.Printf("repair with peer (%s): %s", peer.RemoteAddr(), err)
+				s.repairs.failures.Add(1)
+				continue
+			}
+			s.repairs.peers.Add(1)
+		}
+	}
+
+	// shards are not mapped to keys and are placed on their own
+	s.repairShards()
+
+	s.repairs.rounds.Add(1)
+}
+
+// returns the placed peers keyed by node id that may be responsible
+// for objects along with this node | none if objects have one copy
+func (s *FileServer) syncPeers() map[string]p2p.Peer {
+	if s.ReplicationFactor < 2 {
+		return nil
+	}
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	_, byID := s.placementNodes()
+	return byID
+}
+
+// returns the objects of objects both this node and
+// the node with id are responsible for
+func (s *FileServer) sharedObjects(objects map[string][]string, id string) map[string][]string {
+	s.peerLock.Lock()
+	nodes, _ := s.placementNodes()
+	s.peerLock.Unlock()
+
+	shared := make(map[string][]string)
+	for digest, names := range objects {
+		self, other := false, false
+		for _, node := range s.Placement.Place(digest, nodes, s.ReplicationFactor) {
+			self = self || node.ID == s.self.ID
+			other = other || node.ID == id
+		}
+
+		if self && other {
+			shared[digest] = names
+		}
+	}
+
+	return shared
+}
+
+// walk the Merkle trees of the objects this node and peer are
+// both responsible for down to the leaves that differ and repair
+// the objects under them | objects are the ones held locally
+// returns error
+func (s *FileServer) syncWith(peer p2p.Peer, objects map[string][]string) error {
+	local := NewMerkleTree(objects)
+
+	// descend level by level from the root
+	nodes, leaves := []int{0}, []int{}
+	for len(nodes) != 0 {
+		r, err := s.syncTree(peer, MessageSyncTree{Nodes: nodes})
+		if err != nil {
+			return err
+		}
+
+		differing, children := local.Diff(nodes, r.Hashes)
+		leaves = append(leaves, differing...)
+		nodes = children
+	}
+
+	if len(leaves) == 0 {
+		return nil
+	}
+
+	r, err := s.syncTree(peer, MessageSyncTree{Leaves: leaves})
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range r.Entries {
+		s.repairEntry(peer, entry)
+	}
+
+	return nil
+}
+
+// pull object entry from peer if this node is responsible for it
+// and restore the key mappings it misses
+// deleted keys are not restored and their tombstones are sent to peer
+func (s *FileServer) repairEntry(peer p2p.Peer, entry SyncEntry) {
+	if !isSHA256Hex(entry.Digest) {
+		return
+	}
+
+	names := []string{}
+	for _, name := range entry.Names {
+		t, ok := s.tombstoned(name, entry.Digest)
+		if !ok {
+			names = append(names, name)
+			continue
+		}
+
+		if err := s.send(peer, &Message{Payload: MessageDeleteFile{Tombstone: t}}); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// every key of the object was deleted
+	if len(names) == 0 {
+		return
+	}
+
+	held, err := s.store.HasDigest(entry.Digest)
+	if err != nil {
+		log.Printf("repairing (%s): %s", entry.Digest, err)
+		s.repairs.failures.Add(1)
+		return
+	}
+
+	if !held {
+		if !s.responsibleFor(entry.Digest) {
+			return
+		}
+
+		if err := s.fetch("", entry.Digest, []p2p.Peer{peer}); err != nil {
+			log.Printf("repairing (%s): %s", entry.Digest, err)
+			s.repairs.failures.Add(1)
+			return
+		}
+		s.repairs.objects.Add(1)
+	}
+
+	for _, name := range names {
+		linked, err := s.store.LinkName(name, entry.Digest)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if linked {
+			s.repairs.names.Add(1)
+		}
+	}
+}
+
+// send MessageSyncTree to peer and wait for its reply
+// returns MessageSyncTreeReply | error
+func (s *FileServer) syncTree(peer p2p.Peer, msg MessageSyncTree) (MessageSyncTreeReply, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	r, err := s.request(ctx, peer, msg)
+	if err != nil {
+		return MessageSyncTreeReply{}, err
+	}
+
+	reply, ok := r.(MessageSyncTreeReply)
+	if !ok {
+		return MessageSyncTreeReply{}, fmt.Errorf("unexpected reply %T", r)
+	}
+
+	if len(reply.Error) != 0 {
+		return MessageSyncTreeReply{}, fmt.Errorf("peer failed to summarize objects: %s", reply.Error)
+	}
+
+	return reply, nil
+}
+
+// handle MessageSyncTree message from peer
+// summarizes the local object set without blocking the read loop
+func (s *FileServer) handleMessageSyncTree(from string, id string, msg MessageSyncTree) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	// requests beyond the ones answered at once are refused
+	select {
+	case s.syncSlots <- struct{}{}:
+	default:
+		return s.send(peer, &Message{
+			ID:      id,
+			Payload: MessageSyncTreeReply{Error: "too many sync requests"},
+		})
+	}
+
+	go func() {
+		defer func() { <-s.syncSlots }()
+
+		reply := MessageSyncTreeReply{}
+
+		// a walk starts at the root and sees the same tree to its leaves
+		tree, err := s.syncTreeOf(from, slices.Contains(msg.Nodes, 0))
+		if err != nil {
+			reply.Error = err.Error()
+		} else {
+			for _, i := range msg.Nodes {
+				reply.Hashes = append(reply.Hashes, tree.Hash(i))
+			}
+			for _, i := range msg.Leaves {
+				reply.Entries = append(reply.Entries, tree.Entries(i)...)
+			}
+		}
+
+		if err := s.send(peer, &Message{ID: id, Payload: reply}); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	return nil
+}
+
+// returns the tree of the objects this node and the peer connected
+// as from are both responsible for | the tree built for the walk of
+// the peer unless fresh is set or it expired
+// returns *MerkleTree | error
+func (s *FileServer) syncTreeOf(from string, fresh bool) (*MerkleTree, error) {
+	now := time.Now()
+
+	s.syncLock.Lock()
+	for addr, t := range s.syncTrees {
+		if now.After(t.expires) {
+			delete(s.syncTrees, addr)
+		}
+	}
+	cached, ok := s.syncTrees[from]
+	s.syncLock.Unlock()
+
+	if ok && !fresh {
+		return cached.tree, nil
+	}
+
+	s.peerLock.Lock()
+	node, ok := s.nodes[from]
+	s.peerLock.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("peer (%s) did not announce itself", from)
+	}
+
+	objects, err := s.store.Names()
+	if err != nil {
+		return nil, err
+	}
+	tree := NewMerkleTree(s.sharedObjects(objects, node.ID))
+
+	s.syncLock.Lock()
+	s.syncTrees[from] = syncTree{tree: tree, expires: now.Add(syncTreeTTL)}
+	s.syncLock.Unlock()
+
+	return tree, nil
+}
+
+// handle MessageSyncTreeReply message from peer
+func (s *FileServer) handleMessageSyncTreeReply(from string, id string, msg MessageSyncTreeReply) error {
+	if !s.deliverReply(from, id, msg) {
+		return fmt.Errorf("reply (%s) from peer (%s) to unknown request", id, from)
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// region requests are signed for if none is set
+// S3 compatible services like MinIO accept it by default
+const defaultS3Region = "us-east-1"
+
+// S3 blob store options
+type S3BlobStoreOpts struct {
+
+	// base URL of the service | http://localhost:9000
+	// buckets are addressed by path
+	Endpoint string
+
+	// bucket blobs are stored in | must exist
+	Bucket string
+
+	// prepended to every blob key so stores can share a bucket
+	Prefix string
+
+	// region requests are signed for | defaultS3Region if empty
+	Region string
+
+	// credentials requests are signed with
+	AccessKey string
+	SecretKey string
+
+	// http.DefaultClient if nil
+	Client *http.Client
+}
+
+// S3BlobStore keeps every blob as an object of a bucket
+// of an S3 compatible object storage service
+type S3BlobStore struct {
+	S3BlobStoreOpts
+
+	// parsed endpoint
+	endpoint *url.URL
+}
+
+// create new S3 blob store
+// returns *S3BlobStore | error
+func NewS3BlobStore(opts S3BlobStoreOpts) (*S3BlobStore, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(opts.Endpoint, "/"))
+	if err != nil || len(endpoint.Host) == 0 {
+		return nil, fmt.Errorf("invalid S3 endpoint (%s)", opts.Endpoint)
+	}
+
+	if len(opts.Bucket) == 0 {
+		return nil, errors.New("S3 bucket not set")
+	}
+
+	if len(opts.Region) == 0 {
+		opts.Region = defaultS3Region
+	}
+
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+
+	return &S3BlobStore{
+		S3BlobStoreOpts: opts,
+		endpoint:        endpoint,
+	}, nil
+}
+
+func (b *S3BlobStore) Has(key string) (bool, error) {
+	_, err := b.Stat(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *S3BlobStore) Stat(key string) (BlobInfo, error) {
+	res, err := b.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	res.Body.Close()
+
+	return BlobInfo{Key: key, Size: res.ContentLength}, nil
+}
+
+func (b *S3BlobStore) Open(key string) (io.ReadCloser, error) {
+	res, err := b.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (b *S3BlobStore) Write(key string, r io.Reader) (int64, error) {
+	// the payload is signed so it is read whole before it is sent
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(body)), err
+	}
+
+	res, err := b.do(http.MethodPut, key, nil, body)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	return int64(len(body)), nil
+}
+
+func (b *S3BlobStore) Delete(key string) error {
+	res, err := b.do(http.MethodDelete, key, nil, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// listing returned by ListObjectsV2
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (b *S3BlobStore) List(prefix string) ([]string, error) {
+	keys := []string{}
+
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", b.Prefix+prefix)
+
+	// a listing is returned a page at a time
+	for {
+		res, err := b.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var page s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading S3 listing: %w", err)
+		}
+
+		for _, c := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, b.Prefix))
+		}
+
+		if !page.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// error document returned by S3
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// send a signed request for the object with key | the bucket if key is empty
+// fails with os.ErrNotExist if the service answers 404
+// returns the response of a successful request (*http.Response) | error
+func (b *S3BlobStore) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *b.endpoint
+	u.Path += "/" + b.Bucket + "/"
+	u.RawPath = u.Path
+	if len(key) != 0 {
+		u.Path += b.Prefix + key
+		u.RawPath += s3Escape(b.Prefix+key, false)
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(body)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(hash[:]))
+	signV4(req, b.AccessKey, b.SecretKey, b.Region, time.Now())
+
+	res, err := b.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("S3 object (%s): %w", key, os.ErrNotExist)
+	}
+
+	// HEAD responses carry no error document
+	var e s3Error
+	xml.NewDecoder(res.Body).Decode(&e)
+
+	return nil, fmt.Errorf("S3 %s (%s): %s %s %s", method, key, res.Status, e.Code, e.Message)
+}
+
+// sign req with AWS signature version 4 for the s3 service
+// every header set on req is signed | x-amz-content-sha256
+// must be set to the hex SHA-256 of the payload
+func signV4(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", now.Format("20060102T150405Z"))
+
+	host := req.Host
+	if len(host) == 0 {
+		host = req.URL.Host
+	}
+
+	// lowercase header names with their trimmed values
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "authorization" {
+			continue
+		}
+
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		req.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	// the signing key is derived from the secret for the day region and service
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// returns query sorted and escaped as signature version 4 expects
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	params := []string{}
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// percent encodes every byte of s but unreserved characters
+// slashes are kept unless escapeSlash is set
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
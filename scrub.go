@@ -0,0 +1,560 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// default time between two scrub passes
+	defaultScrubInterval = 24 * time.Hour
+
+	// default bytes read per second while scrubbing
+	// so scrubbing does not starve reads and writes
+	defaultScrubRate = 32 << 20
+
+	// quarantineFolder holds corrupted objects moved out of the store
+	quarantineFolder = "quarantine"
+)
+
+// ErrCorrupt is returned when stored content no longer
+// hashes to the digest it was written under
+var ErrCorrupt = errors.New("object corrupt")
+
+// scrubber options
+type ScrubberOpts struct {
+
+	// store whose objects are scrubbed
+	Store *Store
+
+	// bytes read per second
+	// defaultScrubRate if zero | unlimited if negative
+	Rate int64
+
+	// optional func fetching a healthy copy of a quarantined object
+	Repair func(digest string) error
+}
+
+// Scrubber periodically checks that the objects on disk
+// still hash to their digest and quarantines the ones that do not
+type Scrubber struct {
+
+	// scrubber options
+	ScrubberOpts
+
+	// one pass at a time
+	passLock sync.Mutex
+
+	// scrub metrics
+	passes   atomic.Uint64
+	objects  atomic.Uint64
+	bytes    atomic.Uint64
+	corrupt  atomic.Uint64
+	repaired atomic.Uint64
+	failures atomic.Uint64
+
+	// end of the last pass in unix nanoseconds
+	last atomic.Int64
+}
+
+// ScrubStats reports the work done by the scrubber
+type ScrubStats struct {
+
+	// completed scrub passes
+	Passes uint64
+
+	// objects and bytes checked
+	ObjectsScrubbed uint64
+	BytesScrubbed   uint64
+
+	// objects that did not match their digest and were quarantined
+	Corrupt uint64
+
+	// quarantined objects fetched again from replicas
+	Repaired uint64
+
+	// objects that could not be checked or fetched again
+	Failures uint64
+
+	// end of the last pass | zero if none completed
+	LastPass time.Time
+}
+
+// create new scrubber
+// return *Scrubber
+func NewScrubber(opts ScrubberOpts) *Scrubber {
+	if opts.Rate == 0 {
+		opts.Rate = defaultScrubRate
+	}
+
+	return &Scrubber{
+		ScrubberOpts: opts,
+	}
+}
+
+// Stats returns the scrub metrics
+func (s *Scrubber) Stats() ScrubStats {
+	stats := ScrubStats{
+		Passes:          s.passes.Load(),
+		ObjectsScrubbed: s.objects.Load(),
+		BytesScrubbed:   s.bytes.Load(),
+		Corrupt:         s.corrupt.Load(),
+		Repaired:        s.repaired.Load(),
+		Failures:        s.failures.Load(),
+	}
+
+	if last := s.last.Load(); last != 0 {
+		stats.LastPass = time.Unix(0, last)
+	}
+
+	return stats
+}
+
+// Scrub checks every object of the store once
+// corrupted objects are quarantined and repaired
+// the pass stops early when quit is closed
+func (s *Scrubber) Scrub(quit <-chan struct{}) {
+	s.passLock.Lock()
+	defer s.passLock.Unlock()
+
+	digests, err := s.Store.Objects()
+	if err != nil {
+		log.Printf("listing objects to scrub: %s", err)
+		s.failures.Add(1)
+		return
+	}
+
+	// one budget for the whole pass
+	limiter := newRateLimiter(s.Rate, quit)
+
+	for _, digest := range digests {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		n, err := s.Store.verify(digest, limiter.reader)
+		s.bytes.Add(uint64(n))
+
+		switch {
+		case err == nil:
+			s.objects.Add(1)
+
+		case errors.Is(err, os.ErrNotExist):
+			// deleted since the listing
+
+		case errors.Is(err, ErrCorrupt):
+			s.objects.Add(1)
+			s.corrupt.Add(1)
+			log.Printf("scrubbing (%s): %s", digest, err)
+			s.quarantine(digest)
+
+		default:
+			log.Printf("scrubbing (%s): %s", digest, err)
+			s.failures.Add(1)
+		}
+	}
+
+	s.passes.Add(1)
+	s.last.Store(time.Now().UnixNano())
+}
+
+// move corrupted object with digest out of the store
+// and fetch a healthy copy
+func (s *Scrubber) quarantine(digest string) {
+	if err := s.Store.Quarantine(digest); err != nil {
+		log.Printf("quarantining (%s): %s", digest, err)
+		s.failures.Add(1)
+		return
+	}
+
+	if s.Repair == nil {
+		return
+	}
+
+	if err := s.Repair(digest); err != nil {
+		log.Printf("fetching (%s) again: %s", digest, err)
+		s.failures.Add(1)
+		return
+	}
+
+	s.repaired.Add(1)
+}
+
+// Objects returns the digests of every object held
+func (s *Store) Objects() ([]string, error) {
+	keys, err := s.Blobs.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	digests := []string{}
+	for _, key := range keys {
+		// manifests are named after the object digest
+		digest := path.Base(key)
+		if !isSHA256Hex(digest) {
+			continue
+		}
+		if manifest, err := s.manifestKey(digest); err == nil && key == manifest {
+			digests = append(digests, digest)
+		}
+	}
+
+	return digests, nil
+}
+
+// verify that the object with digest and each of its chunks
+// hash to the digest they are stored under
+// wrap is applied to every file read
+// returns read bytes (int64) | ErrCorrupt if the object is damaged
+// | error if it could not be read
+func (s *Store) verify(digest string, wrap func(io.Reader) io.Reader) (int64, error) {
+	key, err := s.manifestKey(digest)
+	if err != nil {
+		return 0, err
+	}
+
+	r, err := s.openVerified(key, CompressionNone)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return 0, r.failure(err)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return 0, fmt.Errorf("%w: manifest: %w", ErrCorrupt, err)
+	}
+
+	if m.Digest != digest {
+		return 0, fmt.Errorf("%w: manifest of (%s) describes (%s)", ErrCorrupt, digest, m.Digest)
+	}
+
+	if err := m.validate(); err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+
+	hash := sha256.New()
+
+	var read int64
+	for _, c := range m.Chunks {
+		n, err := s.verifyChunk(digest, m.Compression, c, hash, wrap)
+		read += n
+		if err == nil {
+			continue
+		}
+
+		// a chunk is only missing from an object still held
+		if errors.Is(err, os.ErrNotExist) {
+			if held, herr := s.HasDigest(digest); herr == nil && held {
+				return read, fmt.Errorf("%w: chunk (%s) missing", ErrCorrupt, c.Digest)
+			}
+		}
+		return read, fmt.Errorf("chunk (%s): %w", c.Digest, err)
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != digest {
+		return read, fmt.Errorf("%w: content hashes to %s", ErrCorrupt, sum)
+	}
+
+	return read, nil
+}
+
+// verify that chunk c of the object with digest stored with
+// compression has the content listed as c writing the content to w
+// returns read bytes (int64) | ErrCorrupt if the chunk is damaged
+// | error if it could not be read
+func (s *Store) verifyChunk(digest string, compression string, c Chunk, w io.Writer, wrap func(io.Reader) io.Reader) (int64, error) {
+	key, err := s.chunkKey(digest, c.Digest)
+	if err != nil {
+		return 0, err
+	}
+
+	r, err := s.openVerified(key, compression)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(hash, w), wrap(r))
+	if err != nil {
+		return n, r.failure(err)
+	}
+
+	if n != c.Size {
+		return n, fmt.Errorf("%w: %d bytes instead of %d", ErrCorrupt, n, c.Size)
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != c.Digest {
+		return n, fmt.Errorf("%w: content hashes to %s", ErrCorrupt, sum)
+	}
+
+	return n, nil
+}
+
+// reader over the content of a blob being verified which tells
+// the blob store failing to read the blob from the stored bytes
+// failing to decrypt or decompress
+type verifiedReader struct {
+	io.Closer
+
+	// reads the stored bytes | decrypted and decompressed
+	blob    *errReader
+	content *errReader
+}
+
+func (r *verifiedReader) Read(b []byte) (int, error) {
+	return r.content.Read(b)
+}
+
+// returns err reading the content as ErrCorrupt unless the blob
+// could not be read or reading did not fail on the content
+func (r *verifiedReader) failure(err error) error {
+	if r.blob.err != nil {
+		return r.blob.err
+	}
+	if r.content.err == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrCorrupt, err)
+}
+
+// open the blob with key decrypting and decompressing it with
+// compression | returns *verifiedReader | ErrCorrupt if the stored
+// bytes cannot be decrypted or decompressed | error
+func (s *Store) openVerified(key string, compression string) (*verifiedReader, error) {
+	info, err := s.Blobs.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := s.Blobs.Open(key)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := &errReader{r: f}
+	r := &verifiedReader{Closer: f, blob: blob, content: blob}
+
+	_, plain, err := s.decrypt(key, info.Size, readCloser{blob, f})
+	if err != nil {
+		f.Close()
+		return nil, r.damaged(err)
+	}
+
+	content, err := decompress(plain, compression)
+	if err != nil {
+		f.Close()
+		return nil, r.damaged(err)
+	}
+
+	r.content = &errReader{r: content}
+	return r, nil
+}
+
+// returns err opening the content as ErrCorrupt
+// unless the blob could not be read
+func (r *verifiedReader) damaged(err error) error {
+	if r.blob.err != nil {
+		return r.blob.err
+	}
+	return fmt.Errorf("%w: %w", ErrCorrupt, err)
+}
+
+// reader keeping the first error other than io.EOF of r
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// Quarantine moves the object with digest and its chunks
+// out of the store into quarantineFolder where they are kept
+// for inspection | the object is no longer held afterwards
+func (s *Store) Quarantine(digest string) error {
+	if !isSHA256Hex(digest) {
+		return fmt.Errorf("invalid digest (%s)", digest)
+	}
+
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+
+	held, err := s.HasDigest(digest)
+	if err != nil {
+		return err
+	}
+	if !held {
+		return fmt.Errorf("quarantining (%s): %w", digest, os.ErrNotExist)
+	}
+
+	// an object quarantined again replaces its older copy
+	dir := s.Root + "/" + quarantineFolder + "/" + digest
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir+"/"+chunksFolder, os.ModePerm); err != nil {
+		return err
+	}
+
+	key, err := s.manifestKey(digest)
+	if err != nil {
+		return err
+	}
+
+	prefix, err := s.chunkPrefix(digest)
+	if err != nil {
+		return err
+	}
+
+	// blobs are kept as they are stored | encrypted and compressed
+	if err := s.copyBlob(key, dir+"/manifest"); err != nil {
+		return err
+	}
+
+	chunks, err := s.Blobs.List(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range chunks {
+		if err := s.copyBlob(key, dir+"/"+chunksFolder+"/"+path.Base(key)); err != nil {
+			return err
+		}
+	}
+
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	// the object is gone once its manifest is
+	return s.removeObject(digest)
+}
+
+// copy the blob with key to a file at path
+func (s *Store) copyBlob(key string, path string) error {
+	r, err := s.Blobs.Open(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// rateLimiter spreads reads so at most rate bytes are read per second
+type rateLimiter struct {
+	rate  int64
+	quit  <-chan struct{}
+	start time.Time
+	read  int64
+}
+
+func newRateLimiter(rate int64, quit <-chan struct{}) *rateLimiter {
+	return &rateLimiter{
+		rate:  rate,
+		quit:  quit,
+		start: time.Now(),
+	}
+}
+
+// returns r reading within the rate of the limiter
+func (l *rateLimiter) reader(r io.Reader) io.Reader {
+	if l.rate <= 0 {
+		return r
+	}
+	return &rateReader{r: r, limiter: l}
+}
+
+// wait until n more bytes can be read within the rate
+// returns early when quit is closed
+func (l *rateLimiter) wait(n int) {
+	l.read += int64(n)
+
+	due := l.start.Add(time.Duration(float64(l.read) / float64(l.rate) * float64(time.Second)))
+	wait := time.Until(due)
+	if wait <= 0 {
+		return
+	}
+
+	select {
+	case <-time.After(wait):
+	case <-l.quit:
+	}
+}
+
+// rateReader reads from r within the rate of limiter
+type rateReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *rateReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.limiter.wait(n)
+	return n, err
+}
+
+// run scrub passes every ScrubInterval until the server stops
+func (s *FileServer) scrubLoop() {
+	ticker := time.NewTicker(s.ScrubInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.scrubber.Scrub(s.quitch)
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// Scrub checks every object held by this node now
+// corrupted objects are fetched again from healthy replicas
+func (s *FileServer) Scrub() {
+	s.scrubber.Scrub(s.quitch)
+}
+
+// ScrubStats returns the scrub metrics
+func (s *FileServer) ScrubStats() ScrubStats {
+	return s.scrubber.Stats()
+}
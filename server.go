@@ -1,18 +1,37 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/luqxus/dstore/crypto"
+	"github.com/luqxus/dstore/dht"
 	"github.com/luqxus/dstore/p2p"
 )
 
+const (
+	// default time to wait for peers to reply to a request
+	defaultRequestTimeout = 5 * time.Second
+
+	// default number of nodes a file is replicated to
+	defaultReplicationFactor = 3
+)
+
 // file server options
 type FileServerOpts struct {
 
@@ -22,11 +41,131 @@ type FileServerOpts struct {
 	// path transform function
 	PathTransformFunc PathTransformFunc
 
+	// encrypts objects at rest | plaintext if nil
+	Encryption Encryptor
+
+	// size of the chunks stored files are split into
+	// defaultChunkSize if zero
+	ChunkSize int64
+
+	// compression stored files are written with
+	// CompressionNone if empty | already compressed content
+	// types are stored as is and sent to peers compressed
+	Compression string
+
+	// holds the manifests and chunks of stored files
+	// files are kept under StorageRoot if nil
+	BlobStore BlobStore
+
+	// bytes of content this node holds at most | unlimited if zero
+	// peers are told how much room is left so they place files elsewhere
+	Capacity int64
+
+	// bytes of content each owner may store on this node
+	// unlimited if zero | OwnerQuotas overrides it per owner address
+	OwnerQuota  int64
+	OwnerQuotas map[string]int64
+
+	// node keystore used to open records sealed to this node
+	Keystore Keystore
+
 	// transport
 	Transport p2p.Transport
 
+	// how long to wait for peers to reply to a request
+	RequestTimeout time.Duration
+
+	// number of nodes a stored file is replicated to
+	// defaultReplicationFactor if zero
+	ReplicationFactor int
+
+	// if DataShards is not zero stored files are erasure coded
+	// into DataShards + ParityShards shards placed on distinct nodes
+	// instead of being replicated
+	DataShards   int
+	ParityShards int
+
+	// picks the nodes responsible for a file
+	// HashRingPlacement if nil
+	Placement Placement
+
+	// optional site and rack of this node used for placement
+	Site string
+	Rack string
+
 	// nodes | remote networks to connect to on starting server
 	BootstrapNodes []string
+
+	// time between anti-entropy repair rounds
+	// defaultRepairInterval if zero | repair is disabled if negative
+	RepairInterval time.Duration
+
+	// time between integrity scrub passes
+	// defaultScrubInterval if zero | scrubbing is disabled if negative
+	ScrubInterval time.Duration
+
+	// bytes read per second while scrubbing
+	// defaultScrubRate if zero | unlimited if negative
+	ScrubRate int64
+
+	// time between garbage collections of unreferenced objects
+	// defaultGCInterval if zero | garbage collection is disabled if negative
+	GCInterval time.Duration
+
+	// latest versions of every record whose content is kept
+	// by garbage collection | all if zero
+	KeepVersions int
+
+	// how long tombstones of deleted records are kept
+	// defaultTombstoneRetention if zero
+	TombstoneRetention time.Duration
+
+	// time between heartbeats detecting half open connections
+	// defaultHeartbeatInterval if zero | heartbeats are disabled if negative
+	HeartbeatInterval time.Duration
+
+	// delay before the first redial of a lost peer doubled after
+	// every failed attempt up to MaxRedialBackoff
+	// defaultRedialBackoff and defaultMaxRedialBackoff if zero
+	RedialBackoff    time.Duration
+	MaxRedialBackoff time.Duration
+
+	// optional hook called when peers join and leave
+	OnPeerEvent func(PeerEvent)
+}
+
+// Keystore holds the node private key
+type Keystore interface {
+	PrivateKey() (*ecdsa.PrivateKey, error)
+}
+
+// options for a single FileServer.StoreWithOpts call
+type StoreFileOpts struct {
+
+	// if set the record is encrypted to this secp256k1 public key
+	// before it is stored so peers only ever hold ciphertext
+	Recipient *ecdsa.PublicKey
+
+	// number of nodes the file is replicated to
+	// the node ReplicationFactor if zero
+	Replicas int
+
+	// MIME type of the record
+	ContentType string
+
+	// Ethereum address owning the record | this node if empty
+	Owner string
+
+	// patient the health record belongs to
+	PatientID string
+
+	// Ethereum address writing the version | this node if empty
+	Author string
+
+	// erasure code the record into DataShards + ParityShards shards
+	// the node DataShards and ParityShards if zero
+	DataShards   int
+	ParityShards int
 }
 
 // file server
@@ -43,26 +182,127 @@ type FileServer struct {
 	// connected remote peers map
 	peers map[string]p2p.Peer
 
+	// announced placement info of connected peers
+	// keyed by peer address like peers
+	nodes map[string]NodeInfo
+
+	// addresses being dialed by connect
+	// and when their handshake times out
+	dialing map[string]time.Time
+
+	// addresses of lost peers being redialed
+	redialing map[string]bool
+
+	// unanswered heartbeats in a row keyed by peer address
+	misses map[string]int
+
+	// placement info of this node
+	self NodeInfo
+
+	// node private key unlocked once from the keystore
+	// nil if there is none or it could not be unlocked
+	key *ecdsa.PrivateKey
+
+	// bytes of content this node told peers it holds
+	announcedUsage atomic.Int64
+
+	// pending requests lock
+	pendingLock sync.Mutex
+
+	// replies to outstanding requests keyed by request id
+	pending map[string]chan reply
+
+	// routing table and provider records locating content
+	// on nodes this node is not connected to
+	dht *dht.DHT
+
+	// anti-entropy repair metrics
+	repairs repairMetrics
+
+	// Merkle trees peers are walking keyed by peer address
+	syncLock  sync.Mutex
+	syncTrees map[string]syncTree
+
+	// taken by the sync tree requests being answered
+	syncSlots chan struct{}
+
+	// chunk transfer metrics
+	transfers transferMetrics
+
+	// checks objects on disk against their digest
+	scrubber *Scrubber
+
 	// quit channel
 	quitch chan struct{}
+
+	// closes quitch once
+	stopOnce sync.Once
+
+	// closed once the message loop returned
+	stopped chan struct{}
 }
 
 // Message carries payload and is sent over the wire
 type Message struct {
 
+	// request id | replies carry the id of the request they answer
+	ID string
+
 	// payload can of any type
 	Payload any
 }
 
-// MessageStoreFile tells the receiver that a file is
-// being transmitted for storage
+// ReplyStatus tells the requester how a request was handled
+type ReplyStatus int
+
+const (
+	// requested file is sent on the stream in the reply
+	ReplyFound ReplyStatus = iota
+
+	// receiver does not have the requested file
+	ReplyNotFound
+
+	// receiver failed handling the request
+	ReplyError
+)
+
+// ErrFileNotFound is returned when neither the local node
+// nor any connected peer has the requested file
+var ErrFileNotFound = errors.New("file not found")
+
+// MessageStoreFile asks the receiver to store the file described by Manifest
+// the receiver replies with the chunks it is missing which are then
+// sent with MessagePutChunk before asking again
 type MessageStoreFile struct {
 
 	// file path
 	Key string
 
+	// SHA-256 digest of the file content
+	Digest string
+
 	// file size
 	Size int64
+
+	// chunks the file is made of
+	Manifest Manifest
+
+	// record metadata indexed by the receiver
+	Metadata Metadata
+}
+
+// MessageStoreFileReply answers MessageStoreFile
+type MessageStoreFileReply struct {
+
+	// indexes of the manifest chunks the receiver is missing
+	// the file is stored once none are missing
+	Missing []int
+
+	// reason the request failed | empty on success
+	Error string
+
+	// why the receiver refused the file | RejectNone if it did not
+	Rejected RejectReason
 }
 
 // MessageGetFile tells the receiver to check and send file with Key
@@ -70,6 +310,57 @@ type MessageGetFile struct {
 
 	// file path
 	Key string
+
+	// SHA-256 digest of the file content if known by the requester
+	Digest string
+}
+
+// MessageAnnounce tells the receiver how to place files on the sender
+type MessageAnnounce struct {
+
+	// sender placement info
+	Node NodeInfo
+}
+
+// MessageGetFileReply answers a MessageGetFile
+// if Status is ReplyFound the chunks listed in Manifest
+// can be fetched from the sender with MessageGetChunk
+type MessageGetFileReply struct {
+
+	// how the request was handled
+	Status ReplyStatus
+
+	// size of the file
+	Size int64
+
+	// SHA-256 digest of the file
+	Digest string
+
+	// chunks the file is made of
+	Manifest Manifest
+
+	// metadata of the requested key if the sender has any
+	Metadata Metadata
+
+	// reason the request failed if Status is ReplyError
+	Error string
+}
+
+// reply received from a peer for an outstanding request
+type reply struct {
+
+	// peer address
+	from string
+
+	// reply payload
+	payload any
+}
+
+// returns a new random request id
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
 func (s *FileServer) stream(msg *Message) error {
@@ -83,9 +374,82 @@ func (s *FileServer) stream(msg *Message) error {
 	return gob.NewEncoder(multiWriter).Encode(msg)
 }
 
+// send, sends msg to a single peer
+// over the wire | returns [error]
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
+	buf := new(bytes.Buffer)
+
+	// encode msg for transmission
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return peer.Send(buf.Bytes())
+}
+
+// register pending request with id
+// returns channel the request replies are delivered on
+func (s *FileServer) addPending(id string, size int) chan reply {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	ch := make(chan reply, size)
+	s.pending[id] = ch
+	return ch
+}
+
+// remove pending request with id
+// replies arriving afterwards are dropped and
+// file streams of unread replies are aborted
+func (s *FileServer) finishPending(id string, replies chan reply) {
+	s.pendingLock.Lock()
+	delete(s.pending, id)
+	s.pendingLock.Unlock()
+
+	for {
+		select {
+		case r := <-replies:
+			if msg, ok := r.payload.(MessageChunkReply); ok && msg.Status == ReplyFound {
+				s.resetStream(r.from, msg.StreamID)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// send request payload to peer and wait for its single reply
+// returns reply payload (any) | error
+func (s *FileServer) request(ctx context.Context, peer p2p.Peer, payload any) (any, error) {
+	msg := Message{
+		ID:      newRequestID(),
+		Payload: payload,
+	}
+
+	replies := s.addPending(msg.ID, 1)
+	defer s.finishPending(msg.ID, replies)
+
+	if err := s.send(peer, &msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-replies:
+		return r.payload, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // broadcast, broadcasts file to all connected peers
 // over the wire | returns [error]
 func (s *FileServer) broadcast(msg *Message) error {
+	return s.multicast(msg, s.connectedPeers())
+}
+
+// multicast, sends msg to every peer in peers
+// over the wire | returns [error]
+func (s *FileServer) multicast(msg *Message, peers []p2p.Peer) error {
 	buf := new(bytes.Buffer)
 
 	// encode msg for transmission
@@ -93,10 +457,9 @@ func (s *FileServer) broadcast(msg *Message) error {
 		return err
 	}
 
-	// loop over all connected peers
-	for _, peer := range s.peers {
-		// send file to each peer
-		peer.Send([]byte{p2p.IncomingMessage})
+	// loop over peers
+	for _, peer := range peers {
+		// send msg to each peer
 		if err := peer.Send(buf.Bytes()); err != nil {
 			// on send error return error
 			return err
@@ -107,108 +470,680 @@ func (s *FileServer) broadcast(msg *Message) error {
 	return nil
 }
 
+// returns all connected peers
+func (s *FileServer) connectedPeers() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+// returns the nodes taking part in placement and the
+// connected peers keyed by node id | peerLock must be held
+func (s *FileServer) placementNodes() ([]NodeInfo, map[string]p2p.Peer) {
+	// this node takes part in placement like any other node
+	nodes := []NodeInfo{s.self}
+	byID := make(map[string]p2p.Peer)
+	for addr, peer := range s.peers {
+		// peers are placed once they announced the node they are
+		// a connection that did not yet may turn out to be a second
+		// one to a node placed already
+		node, ok := s.nodes[addr]
+		if !ok {
+			continue
+		}
+
+		// a node connected twice is placed once
+		if _, ok := byID[node.ID]; ok || node.ID == s.self.ID {
+			continue
+		}
+		nodes = append(nodes, node)
+		byID[node.ID] = peer
+	}
+
+	return nodes, byID
+}
+
+// returns the id of the node that dialed the connection to peer
+// with node id | the newer of two connections dialed by the
+// same node is kept as neither id is lower
+func (s *FileServer) dialerID(peer p2p.Peer, id string) string {
+	if peer.Outbound() {
+		return s.self.ID
+	}
+	return id
+}
+
+// returns the node id peer announced | its address if it did not
+func (s *FileServer) nodeID(peer p2p.Peer) string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addr := peer.RemoteAddr().String()
+	if node, ok := s.nodes[addr]; ok {
+		return node.ID
+	}
+	return addr
+}
+
+// reports whether this node is among the nodes responsible for digest
+func (s *FileServer) responsibleFor(digest string) bool {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	nodes, _ := s.placementNodes()
+	for _, node := range s.Placement.Place(digest, nodes, s.ReplicationFactor) {
+		if node.ID == s.self.ID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// returns the connected peers to replicate n copies of the object
+// with digest and size bytes to | the connected peers taking the
+// place of those refusing it in placement order
+// nodes that announced they have no room for the object are passed over
+func (s *FileServer) replicaPeers(digest string, size int64, n int) ([]p2p.Peer, []p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	all, byID := s.placementNodes()
+
+	// this node holds the object already
+	nodes := []NodeInfo{}
+	for _, node := range all {
+		if node.ID == s.self.ID || node.hasRoom(size) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	targets := []p2p.Peer{}
+	for _, node := range s.Placement.Place(digest, nodes, n) {
+		if peer, ok := byID[node.ID]; ok {
+			targets = append(targets, peer)
+			delete(byID, node.ID)
+		}
+	}
+
+	fallbacks := []p2p.Peer{}
+	for _, node := range s.Placement.Place(digest, nodes, len(nodes)) {
+		if peer, ok := byID[node.ID]; ok {
+			fallbacks = append(fallbacks, peer)
+		}
+	}
+
+	return targets, fallbacks
+}
+
+// returns up to n connected peers responsible for digest
+// and the remaining connected peers
+func (s *FileServer) placePeers(digest string, n int) ([]p2p.Peer, []p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	nodes, byID := s.placementNodes()
+
+	responsible := []p2p.Peer{}
+	placed := make(map[p2p.Peer]bool)
+	for _, node := range s.Placement.Place(digest, nodes, n) {
+		if peer, ok := byID[node.ID]; ok {
+			responsible = append(responsible, peer)
+			placed[peer] = true
+		}
+	}
+
+	// peers that did not announce themselves yet included
+	others := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		if !placed[peer] {
+			others = append(others, peer)
+		}
+	}
+
+	return responsible, others
+}
+
 // Get reads check and reads file from local network
 // if file not found check file over connected peers remote network
-func (s *FileServer) Get(key string) (int64, io.Reader, error) {
+// asking the peers responsible for the file first
+// the caller must close the returned reader
+func (s *FileServer) Get(key string) (int64, io.ReadCloser, error) {
+	digest, err := s.fetchKey(key)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// return file size (int64) | file reader (io.ReadCloser) | error (error)
+	return s.openDigest(digest)
+}
+
+// Open opens the file with key for reading and seeking
+// fetching it from the network like Get if it is not held locally
+// the caller must close the returned file
+// returns file (io.ReadSeekCloser) | metadata of the file if any (Metadata) | error
+func (s *FileServer) Open(key string) (io.ReadSeekCloser, Metadata, error) {
+	digest, err := s.fetchKey(key)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	// metadata describing other content is not returned
+	meta, err := s.store.Metadata(key)
+	if err != nil || meta.Digest != digest {
+		meta = Metadata{Key: key, Digest: digest}
+	}
+
+	f, err := s.openSeeker(digest)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return f, meta, nil
+}
+
+// fetch file with key from the network unless it is held locally
+// erasure coded records are rebuilt from their shards
+// returns digest of the content on disk | ErrFileNotFound if no peer serves it
+func (s *FileServer) fetchKey(key string) (string, error) {
+	if meta, err := s.store.Metadata(key); err == nil && meta.Erasure != nil {
+		return meta.Digest, s.rebuild(meta)
+	}
+
 	// check if file exists in local network
 	ok := s.store.Has(key)
 	if ok {
 
 		// if file found, read file
 		fmt.Println("serving file from local disk")
-		return s.store.Read(key)
+		return s.store.Resolve(key)
 	}
 
 	fmt.Println("file not found locally, searching on network...")
 
-	// if file is not found. prepare message of type MessageGetFile
+	// a stale mapping still tells us which content to ask for
+	// and which peers are responsible for it
+	digest, _ := s.store.Resolve(key)
+
+	candidates := [][]p2p.Peer{nil, s.connectedPeers()}
+	if len(digest) != 0 {
+		candidates[0], candidates[1] = s.placePeers(digest, s.ReplicationFactor)
+	}
+
+	for _, peers := range candidates {
+		if len(peers) == 0 {
+			continue
+		}
+
+		err := s.fetch(key, digest, peers)
+		if err == nil {
+			return s.store.Resolve(key)
+		}
+
+		if !errors.Is(err, ErrFileNotFound) {
+			return "", err
+		}
+	}
+
+	// look up the nodes holding the content on the DHT
+	if len(digest) != 0 {
+		if err := s.fetchLocated(key, digest); err == nil {
+			return s.store.Resolve(key)
+		}
+	}
+
+	// peers may know the record as erasure coded
+	versions, err := s.History(key)
+	if err != nil {
+		return "", ErrFileNotFound
+	}
+
+	meta := versions[len(versions)-1]
+	if meta.Erasure == nil {
+		return "", ErrFileNotFound
+	}
+
+	if err := s.rebuild(meta); err != nil {
+		return "", err
+	}
+
+	// the record is known here from now on
+	if _, err := s.store.IndexMetadata(meta); err != nil {
+		log.Printf("indexing metadata of (%s): %s", key, err)
+	}
+
+	return meta.Digest, nil
+}
+
+// fetchDigest fetches the content with digest from the network
+// without mapping any key to it
+// returns error | ErrFileNotFound if no node serves the content
+func (s *FileServer) fetchDigest(digest string) error {
+	responsible, others := s.placePeers(digest, s.ReplicationFactor)
+	for _, peers := range [][]p2p.Peer{responsible, others} {
+		if len(peers) == 0 {
+			continue
+		}
+
+		err := s.fetch("", digest, peers)
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, ErrFileNotFound) {
+			return err
+		}
+	}
+
+	if err := s.fetchLocated("", digest); err != nil {
+		return ErrFileNotFound
+	}
+
+	return nil
+}
+
+// fetch asks peers for the file with key and writes it
+// to local network storage fetching its chunks in parallel
+// from every peer serving the same manifest
+// returns error
+func (s *FileServer) fetch(key string, digest string, peers []p2p.Peer) error {
+	// prepare message of type MessageGetFile
 	msg := Message{
+		ID: newRequestID(),
 		Payload: MessageGetFile{
-			Key: key,
+			Key:    key,
+			Digest: digest,
 		},
 	}
 
-	// broadcast message over wire to request file from connected peerss
-	if err := s.broadcast(&msg); err != nil {
-		return 0, nil, err
+	// every peer answers the request exactly once
+	asked := len(peers)
+
+	replies := s.addPending(msg.ID, asked)
+	defer s.finishPending(msg.ID, replies)
+
+	// send request over wire to peers
+	if err := s.multicast(&msg, peers); err != nil {
+		return err
+	}
+
+	var (
+		// manifest and metadata served by the first peer holding the file
+		found MessageGetFileReply
+
+		// peers serving the manifest join the download as they reply
+		holders chan string
+		done    chan error
+	)
+
+	timeout := time.After(s.RequestTimeout)
+
+	// wait for replies while the download runs
+wait:
+	for ; asked > 0; asked-- {
+		select {
+		case r := <-replies:
+			msg, ok := r.payload.(MessageGetFileReply)
+			if !ok || msg.Status != ReplyFound {
+				continue
+			}
+
+			// the peer must serve the content we asked for
+			if len(digest) != 0 && digest != msg.Digest {
+				log.Printf("peer (%s) served %s for %s", r.from, msg.Digest, digest)
+				continue
+			}
+
+			if holders == nil {
+				if err := msg.Manifest.validate(); err != nil || msg.Manifest.Digest != msg.Digest {
+					log.Printf("peer (%s) served an invalid manifest for %s", r.from, msg.Digest)
+					continue
+				}
+
+				found = msg
+				holders = make(chan string, asked)
+				done = make(chan error, 1)
+				go func() { done <- s.download(found.Manifest, holders) }()
+			}
+
+			// every holder must serve the chunks of the first manifest
+			if msg.Digest == found.Digest && slices.Equal(msg.Manifest.Chunks, found.Manifest.Chunks) {
+				holders <- r.from
+			}
+
+		case err := <-done:
+			// the download ended before every peer replied
+			done <- err
+			break wait
+
+		case <-timeout:
+			if holders == nil {
+				return fmt.Errorf("%w: timed out waiting for peers", ErrFileNotFound)
+			}
+			break wait
+		}
+	}
+
+	if holders == nil {
+		return ErrFileNotFound
+	}
+
+	close(holders)
+	if err := <-done; err != nil {
+		return err
+	}
+
+	return s.storeFetched(key, found)
+}
+
+// store the file announced by reply once all its chunks are on disk
+// content fetched by digest alone is not mapped to a key
+func (s *FileServer) storeFetched(key string, reply MessageGetFileReply) error {
+	// the chunks hash to the manifest digest
+	if err := s.store.CommitManifest(reply.Manifest); err != nil {
+		return err
+	}
+
+	if len(key) != 0 {
+		meta := reply.Metadata
+		meta.Key, meta.Digest = key, reply.Digest
+		meta.Replicas = appendUnique(meta.Replicas, s.self.ID)
+
+		if _, err := s.store.LinkMetadata(meta); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("received (%d) bytes from peers\n", reply.Size)
+
+	// announce the new copy
+	go s.provide(reply.Digest)
+
+	return nil
+}
+
+// returns connected peer with address
+func (s *FileServer) peer(addr string) (p2p.Peer, error) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[addr]
+	if !ok {
+		return nil, fmt.Errorf("peer (%s) not in peers list", addr)
+	}
+
+	return peer, nil
+}
+
+// open decrypts records sealed to this node
+// any other content is returned as is
+func (s *FileServer) open(n int64, r io.Reader, err error) (int64, io.Reader, error) {
+	if err != nil || s.Keystore == nil {
+		return n, r, err
+	}
+
+	br := bufio.NewReader(r)
+	key, ok, err := s.sealedToSelf(br)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// records sealed to someone else are served as ciphertext
+	// for the holder of the recipient key to open
+	if !ok {
+		return n, br, nil
+	}
+
+	header, err := crypto.ReadSealedHeader(br)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	plain, err := header.Open(br, key)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header.PlainSize(n), plain, nil
+}
+
+// opens content with digest for reading like open
+// returns file size (int64) | reader (io.ReadCloser) | error
+func (s *FileServer) openDigest(digest string) (int64, io.ReadCloser, error) {
+	n, f, err := s.store.OpenDigest(digest)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n, r, err := s.open(n, f, nil)
+	if err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+
+	return n, readCloser{r, f}, nil
+}
+
+// reports whether the record read by br is sealed to this node
+// returns node private key | whether the record is sealed to it | error
+func (s *FileServer) sealedToSelf(br *bufio.Reader) (*ecdsa.PrivateKey, bool, error) {
+	recipient, ok := crypto.SealedRecipient(br)
+	if !ok {
+		return nil, false, nil
+	}
+
+	if s.key == nil {
+		return nil, false, fmt.Errorf("opening sealed record: %w", ErrNoKeystore)
+	}
+
+	return s.key, ethcrypto.PubkeyToAddress(s.key.PublicKey) == recipient, nil
+}
+
+// opens content with digest for reading and seeking like open
+// returns file (io.ReadSeekCloser) | error
+func (s *FileServer) openSeeker(digest string) (io.ReadSeekCloser, error) {
+	_, f, err := s.store.OpenDigest(digest)
+	if err != nil || s.Keystore == nil {
+		return f, err
+	}
+
+	_, sealed, err := s.sealedToSelf(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// content served as stored is seekable as it is
+	// once the bytes read checking the recipient are seeked back
+	if !sealed {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	f.Close()
+
+	// sealed records are only decrypted from the start
+	return newRewindReader(func() (int64, io.Reader, io.Closer, error) {
+		n, r, err := s.openDigest(digest)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+
+		return n, r, r, nil
+	})
+}
+
+// store file to local network and broadcast file over wire
+// to all connected peers
+// returns content digest (string) | error
+func (s *FileServer) Store(key string, r io.Reader) (string, error) {
+	return s.StoreWithOpts(key, r, StoreFileOpts{})
+}
+
+// StoreWithOpts stores file like Store applying opts
+// returns content digest (string) | error
+func (s *FileServer) StoreWithOpts(key string, r io.Reader, opts StoreFileOpts) (string, error) {
+
+	// seal record to recipient before it touches the disk
+	// the sealing goroutine ends once the record is read or given up
+	if opts.Recipient != nil {
+		sealed := sealTo(r, opts.Recipient)
+		defer sealed.Close()
+		r = sealed
+	}
+
+	replicas := opts.Replicas
+	if replicas == 0 {
+		replicas = s.ReplicationFactor
+	}
+
+	owner := opts.Owner
+	if len(owner) == 0 && common.IsHexAddress(s.self.ID) {
+		owner = s.self.ID
+	}
+
+	author := opts.Author
+	if len(author) == 0 && common.IsHexAddress(s.self.ID) {
+		author = s.self.ID
+	}
+
+	meta := Metadata{
+		Key:               key,
+		ContentType:       opts.ContentType,
+		Owner:             owner,
+		Author:            author,
+		PatientID:         opts.PatientID,
+		Replicas:          []string{s.self.ID},
+		ReplicationFactor: 1 + replicas,
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	// shards replace full copies
+	data, parity := opts.DataShards, opts.ParityShards
+	if data == 0 {
+		data, parity = s.DataShards, s.ParityShards
+	}
+	if data != 0 {
+		return s.storeShards(meta, r, data, parity)
+	}
 
-	// loop through all connected peers
-	for _, peer := range s.peers {
-		var fileSize int64
+	// write file to local network
+	meta, err := s.store.WriteWithMetadata(meta, r)
+	if err != nil {
+		return "", err
+	}
+	digest := meta.Digest
+
+	// announce this node as provider of the file
+	go s.provide(digest)
+	s.announceUsage()
+
+	// only the peers responsible for the file receive a copy
+	// this node may be one of them so fewer copies are made
+	peers, fallbacks := s.replicaPeers(digest, meta.Size, replicas)
+	meta.ReplicationFactor = 1 + len(peers)
+
+	// send file to responsible peers concurrently
+	// each transfer runs on its own stream
+	type result struct {
+		peer p2p.Peer
+		err  error
+	}
 
-		// read file size from peer
-		binary.Read(peer, binary.LittleEndian, &fileSize)
+	results := make(chan result, len(peers))
+	for _, peer := range peers {
+		go func(peer p2p.Peer) {
+			results <- result{peer, s.sendFile(peer, digest, meta)}
+		}(peer)
+	}
 
-		// read file from peer and write to local network
-		n, err := s.store.Write(key, io.LimitReader(peer, fileSize))
-		if err != nil {
-			return 0, nil, err
+	var sendErr error
+	stored := []string{}
+	for range peers {
+		r := <-results
+
+		// a peer out of room or over quota hands its copy
+		// to the next node in placement order
+		for rejectReason(r.err) != RejectNone && len(fallbacks) != 0 {
+			log.Println(r.err)
+			r = result{fallbacks[0], s.sendFile(fallbacks[0], digest, meta)}
+			fallbacks = fallbacks[1:]
 		}
-		fmt.Printf("received (%d) bytes from peer", n)
-		// fmt.Println(fileBuffer.String())
 
-		// close read stream
-		peer.CloseStream()
+		if r.err != nil {
+			sendErr = r.err
+			continue
+		}
+		stored = append(stored, s.nodeID(r.peer))
+	}
 
+	// record which nodes hold a copy
+	if _, err := s.store.UpdateMetadata(key, func(m *Metadata) {
+		m.ReplicationFactor = meta.ReplicationFactor
+		for _, id := range stored {
+			m.Replicas = appendUnique(m.Replicas, id)
+		}
+	}); err != nil {
+		log.Printf("recording replicas of (%s): %s", key, err)
 	}
 
-	// return file size (int64) | file reader (io.Reader) | error (error)
-	return s.store.Read(key)
+	return digest, sendErr
 }
 
-// store file to local network and broadcast file over wire
-// to all connected peers
+// send content with digest of the record with meta to peer for storage
+// the content is the record itself or one of its shards
+// chunks are read from disk one at a time so
+// the file is never held in memory
 // returns error
-func (s *FileServer) Store(key string, r io.Reader) error {
-
-	fileBuffer := new(bytes.Buffer)
-	tee := io.TeeReader(r, fileBuffer)
-
-	// write file to local network
-	size, err := s.store.Write(key, tee)
+func (s *FileServer) sendFile(peer p2p.Peer, digest string, meta Metadata) error {
+	m, err := s.store.Manifest(digest)
 	if err != nil {
 		return err
 	}
 
 	// prepare message of type MessageStoreFile
-	msg := Message{
-		Payload: MessageStoreFile{
-			Key:  key,  // file path
-			Size: size, // file size
-		},
-	}
-
-	// broadcast MessageStoreFile
-	// tells remote peers to store incoming file
-	err = s.broadcast(&msg)
-	if err != nil {
-		return nil
+	// tells remote peer to store the file made of the chunks in m
+	msg := MessageStoreFile{
+		Key:      meta.Key, // file path
+		Digest:   digest,   // file content digest
+		Size:     m.Size,   // file size
+		Manifest: m,        // file chunks
+		Metadata: meta,     // record metadata
 	}
 
-	time.Sleep(time.Millisecond * 3)
-
-	// broadcast file to all remote peers
-	for _, peer := range s.peers {
-		// send file stream type
-		peer.Send([]byte{p2p.IncomingStream})
-
-		// send stream
-		n, err := io.Copy(peer, fileBuffer)
+	// the peer tells which chunks it is missing | chunks it kept
+	// from an interrupted transfer are not sent again
+	for round := 0; round < maxStoreRounds; round++ {
+		missing, err := s.storeRequest(peer, msg)
 		if err != nil {
 			return err
 		}
 
-		fmt.Printf("wrote (%d) bytes to peer\n", n)
+		if len(missing) == 0 {
+			return nil
+		}
+
+		for _, i := range missing {
+			if i < 0 || i >= len(m.Chunks) {
+				return fmt.Errorf("peer (%s) asked for chunk %d of (%s)", peer.RemoteAddr(), i, m.Digest)
+			}
+
+			if err := s.sendChunk(peer, m, m.Chunks[i]); err != nil {
+				return err
+			}
+		}
 
-		// if err := peer.Send(payload); err != nil {
-		// 	return err
-		// }
+		fmt.Printf("wrote (%d) chunks to peer\n", len(missing))
 	}
 
-	return nil
+	return fmt.Errorf("peer (%s) did not store (%s)", peer.RemoteAddr(), m.Digest)
 }
 
 // implements OnPeer transport interface
@@ -224,23 +1159,159 @@ func (s *FileServer) OnPeer(peer p2p.Peer) error {
 	log.Printf("connection with remote %s", peer.RemoteAddr())
 
 	// add connected peer to peers map
-	s.peers[peer.RemoteAddr().String()] = peer
+	addr := peer.RemoteAddr().String()
+	s.peers[addr] = peer
 
-	return nil
+	// tell the peer how to place files on this node
+	err := s.send(peer, &Message{
+		Payload: MessageAnnounce{Node: s.nodeInfo()},
+	})
+
+	// the transport drops a refused peer without
+	// reporting it disconnected
+	if err != nil {
+		delete(s.peers, addr)
+	}
+
+	return err
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
 	storeOpts := StoreOpts{
 		Root:              opts.StorageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
+		Encryption:        opts.Encryption,
+		ChunkSize:         opts.ChunkSize,
+		Compression:       opts.Compression,
+		Blobs:             opts.BlobStore,
+	}
+
+	// if request timeout is not provided
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+
+	// if replication factor is not provided
+	if opts.ReplicationFactor == 0 {
+		opts.ReplicationFactor = defaultReplicationFactor
+	}
+
+	// if placement is not provided
+	if opts.Placement == nil {
+		opts.Placement = HashRingPlacement{}
+	}
+
+	// if repair interval is not provided
+	if opts.RepairInterval == 0 {
+		opts.RepairInterval = defaultRepairInterval
+	}
+
+	// if scrub interval is not provided
+	if opts.ScrubInterval == 0 {
+		opts.ScrubInterval = defaultScrubInterval
+	}
+
+	// if garbage collection interval is not provided
+	if opts.GCInterval == 0 {
+		opts.GCInterval = defaultGCInterval
+	}
+
+	// if tombstone retention is not provided
+	if opts.TombstoneRetention == 0 {
+		opts.TombstoneRetention = defaultTombstoneRetention
+	}
+
+	// if heartbeat interval is not provided
+	if opts.HeartbeatInterval == 0 {
+		opts.HeartbeatInterval = defaultHeartbeatInterval
+	}
+
+	// if redial backoff is not provided
+	if opts.RedialBackoff == 0 {
+		opts.RedialBackoff = defaultRedialBackoff
+	}
+
+	if opts.MaxRedialBackoff == 0 {
+		opts.MaxRedialBackoff = defaultMaxRedialBackoff
+	}
+
+	// unlocking the key is slow on purpose so it is done once
+	var key *ecdsa.PrivateKey
+	if opts.Keystore != nil {
+		k, err := opts.Keystore.PrivateKey()
+		if err != nil {
+			log.Printf("unlocking node key: %s", err)
+		}
+		key = k
 	}
 
-	return &FileServer{
+	s := &FileServer{
 		FileServerOpts: opts,
 		store:          NewStore(storeOpts),
 		quitch:         make(chan struct{}),
+		stopped:        make(chan struct{}),
 		peers:          make(map[string]p2p.Peer),
+		nodes:          make(map[string]NodeInfo),
+		dialing:        make(map[string]time.Time),
+		redialing:      make(map[string]bool),
+		misses:         make(map[string]int),
+		self:           selfNodeInfo(opts, key),
+		key:            key,
+		pending:        make(map[string]chan reply),
+		syncTrees:      make(map[string]syncTree),
+		syncSlots:      make(chan struct{}, maxSyncTreeRequests),
 	}
+
+	// corrupted objects are fetched again from replicas
+	s.scrubber = NewScrubber(ScrubberOpts{
+		Store:  s.store,
+		Rate:   opts.ScrubRate,
+		Repair: s.fetchDigest,
+	})
+
+	// clean up writes interrupted by a crash before the store is used
+	if removed, err := s.store.Recover(); err != nil {
+		log.Printf("recovering store: %s", err)
+	} else if removed > 0 {
+		log.Printf("removed (%d) leftovers of interrupted writes", removed)
+	}
+
+	// peers are told how much room is left from the start
+	if opts.Capacity > 0 {
+		used, err := s.store.Usage()
+		if err != nil {
+			log.Printf("computing storage usage: %s", err)
+		}
+		s.announcedUsage.Store(used)
+	}
+
+	s.dht = dht.NewDHT(dht.DHTOpts{
+		Self:    contactOf(s.self),
+		Network: dhtNetwork{s: s},
+	})
+
+	return s
+}
+
+// returns placement info of the node configured by opts
+// identified by the Ethereum address of key if it has one
+func selfNodeInfo(opts FileServerOpts, key *ecdsa.PrivateKey) NodeInfo {
+	node := NodeInfo{
+		Site:     opts.Site,
+		Rack:     opts.Rack,
+		Capacity: opts.Capacity,
+	}
+
+	if opts.Transport != nil {
+		node.ID = opts.Transport.Addr()
+		node.Addr = opts.Transport.Addr()
+	}
+
+	if key != nil {
+		node.ID = ethcrypto.PubkeyToAddress(key.PublicKey).Hex()
+	}
+
+	return node
 }
 
 func (s *FileServer) bootstrapNetwork() error {
@@ -249,9 +1320,17 @@ func (s *FileServer) bootstrapNetwork() error {
 			continue
 		}
 		go func(addr string) {
-			err := s.Transport.Dial(addr)
+			// dial through connect so the DHT bootstrap running
+			// alongside does not open a second connection
+			ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+			defer cancel()
+
+			_, err := s.connect(ctx, addr)
 			if err != nil {
 				log.Printf("dial error %s", err.Error())
+
+				// keep trying until the bootstrap node is up
+				s.redial(addr, 0)
 			}
 		}(addr)
 	}
@@ -279,6 +1358,26 @@ func (s *FileServer) Start() error {
 		s.bootstrapNetwork()
 	}
 
+	// periodically repair missing replicas
+	if s.RepairInterval > 0 {
+		go s.repairLoop()
+	}
+
+	// periodically check objects on disk
+	if s.ScrubInterval > 0 {
+		go s.scrubLoop()
+	}
+
+	// periodically remove unreferenced objects
+	if s.GCInterval > 0 {
+		go s.gcLoop()
+	}
+
+	// detect half open connections
+	if s.HeartbeatInterval > 0 {
+		go s.heartbeatLoop()
+	}
+
 	// start read loop
 	s.loop()
 
@@ -293,6 +1392,8 @@ func (s *FileServer) loop() {
 	defer func() {
 		log.Println("file server stopped")
 		s.Transport.Close()
+		s.store.Close()
+		close(s.stopped)
 	}()
 
 	for {
@@ -328,91 +1429,524 @@ func (s *FileServer) handleMessage(from string, msg *Message) error {
 	switch v := msg.Payload.(type) {
 	case MessageStoreFile:
 		// on message type is MessageStoreFile
-		return s.handleMessageStoreFile(from, v)
+		return s.handleMessageStoreFile(from, msg.ID, v)
 
 	case MessageGetFile:
 		// on message typoe is MessageGetFile
-		return s.handleMessageGetFile(from, v)
+		return s.handleMessageGetFile(from, msg.ID, v)
+
+	case MessageGetFileReply:
+		// on message type is MessageGetFileReply
+		return s.handleMessageGetFileReply(from, msg.ID, v)
+
+	case MessageAnnounce:
+		// on message type is MessageAnnounce
+		return s.handleMessageAnnounce(from, v)
+
+	case MessageFindNode:
+		// on message type is MessageFindNode
+		return s.handleMessageFindNode(from, msg.ID, v)
+
+	case MessageFindValue:
+		// on message type is MessageFindValue
+		return s.handleMessageFindValue(from, msg.ID, v)
+
+	case MessageProvide:
+		// on message type is MessageProvide
+		return s.handleMessageProvide(from, msg.ID, v)
+
+	case MessageDHTReply:
+		// on message type is MessageDHTReply
+		return s.handleMessageDHTReply(from, msg.ID, v)
+
+	case MessageDeleteFile:
+		// on message type is MessageDeleteFile
+		return s.handleMessageDeleteFile(from, v)
+
+	case MessageSyncTree:
+		// on message type is MessageSyncTree
+		return s.handleMessageSyncTree(from, msg.ID, v)
+
+	case MessageSyncTreeReply:
+		// on message type is MessageSyncTreeReply
+		return s.handleMessageSyncTreeReply(from, msg.ID, v)
+
+	case MessagePing:
+		// on message type is MessagePing
+		return s.handleMessagePing(from, msg.ID, v)
+
+	case MessagePong:
+		// on message type is MessagePong
+		return s.handleMessagePong(from, msg.ID, v)
+
+	case MessageStoreFileReply:
+		// on message type is MessageStoreFileReply
+		return s.handleMessageStoreFileReply(from, msg.ID, v)
+
+	case MessagePutChunk:
+		// on message type is MessagePutChunk
+		return s.handleMessagePutChunk(from, msg.ID, v)
+
+	case MessagePutChunkReply:
+		// on message type is MessagePutChunkReply
+		return s.handleMessagePutChunkReply(from, msg.ID, v)
+
+	case MessageGetChunk:
+		// on message type is MessageGetChunk
+		return s.handleMessageGetChunk(from, msg.ID, v)
+
+	case MessageChunkReply:
+		// on message type is MessageChunkReply
+		return s.handleMessageChunkReply(from, msg.ID, v)
+
+	case MessageGetHistory:
+		// on message type is MessageGetHistory
+		return s.handleMessageGetHistory(from, msg.ID, v)
+
+	case MessageHistoryReply:
+		// on message type is MessageHistoryReply
+		return s.handleMessageHistoryReply(from, msg.ID, v)
+	}
+	return nil
+}
+
+// handle MessageAnnounce message from peer
+// records peer placement info
+func (s *FileServer) handleMessageAnnounce(from string, msg MessageAnnounce) error {
+	s.peerLock.Lock()
+	peer, ok := s.peers[from]
+	if !ok {
+		s.peerLock.Unlock()
+		return fmt.Errorf("peer (%s) not in peers list", from)
+	}
+
+	// a peer can only announce the node it proved to be
+	if id := peer.Identity(); len(id) != 0 && msg.Node.ID != id {
+		s.peerLock.Unlock()
+		return fmt.Errorf("peer (%s) proved to be (%s) but announced (%s)", from, id, msg.Node.ID)
+	}
+
+	// two nodes dialing each other at once end up with two
+	// connections | both sides keep the same one and close the other
+	known := false
+	var duplicate p2p.Peer
+	for addr, node := range s.nodes {
+		if node.ID != msg.Node.ID {
+			continue
+		}
+
+		known = true
+		if addr == from {
+			continue
+		}
+
+		other := s.peers[addr]
+		if s.dialerID(other, node.ID) < s.dialerID(peer, msg.Node.ID) {
+			s.peerLock.Unlock()
+			log.Printf("closing second connection (%s) to node (%s)", from, msg.Node.ID)
+			return peer.Close()
+		}
+		duplicate = other
+	}
+
+	s.nodes[from] = msg.Node
+	s.peerLock.Unlock()
+
+	if duplicate != nil {
+		log.Printf("closing second connection (%s) to node (%s)", duplicate.RemoteAddr(), msg.Node.ID)
+		duplicate.Close()
+	}
+
+	if !known {
+		s.emit(PeerEvent{Type: PeerJoined, Addr: from, Node: msg.Node})
 	}
+
+	// first contact joins the DHT through the peer
+	joined := s.dht.Size() == 0
+	s.dht.Update(contactOf(msg.Node))
+	if joined {
+		go s.dht.Bootstrap(context.Background())
+	}
+
 	return nil
 }
 
+// rewindReader makes a stream that can only be read from the start
+// seekable by opening it again and skipping to the read offset
+type rewindReader struct {
+	// opens the stream
+	// returns stream size | reader | closer of the reader | error
+	open func() (int64, io.Reader, io.Closer, error)
+
+	// stream size
+	size int64
+
+	// offset of the next read
+	pos int64
+
+	// open stream and its offset
+	r  io.Reader
+	c  io.Closer
+	at int64
+}
+
+// opens the stream once to learn its size
+func newRewindReader(open func() (int64, io.Reader, io.Closer, error)) (*rewindReader, error) {
+	n, r, c, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	return &rewindReader{open: open, size: n, r: r, c: c}, nil
+}
+
+func (r *rewindReader) Read(b []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	// seeking backwards reads the stream again
+	if r.r == nil || r.at > r.pos {
+		r.Close()
+
+		_, reader, closer, err := r.open()
+		if err != nil {
+			return 0, err
+		}
+		r.r, r.c, r.at = reader, closer, 0
+	}
+
+	if r.at < r.pos {
+		n, err := io.CopyN(io.Discard, r.r, r.pos-r.at)
+		r.at += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.r.Read(b)
+	r.at += int64(n)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *rewindReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+
+	r.pos = offset
+	return offset, nil
+}
+
+// Close closes the open stream
+func (r *rewindReader) Close() error {
+	if r.c == nil {
+		return nil
+	}
+
+	err := r.c.Close()
+	r.r, r.c = nil, nil
+	return err
+}
+
 // handle MessageGetFile message from peer
 // checks for file in local network
-// if file found then writes file to peer
+// replies to peer with the file manifest if file found
+// the peer then fetches the chunks it needs
 // return error
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
+func (s *FileServer) handleMessageGetFile(from string, id string, msg MessageGetFile) error {
+	// check if peer if in peers map
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	// requested content digest or the one key maps to locally
+	digest := msg.Digest
+	if len(digest) == 0 {
+		digest, _ = s.store.Resolve(msg.Key)
+	}
+
+	held := false
+	if isSHA256Hex(digest) {
+		if held, err = s.store.HasDigest(digest); err != nil {
+			s.send(peer, &Message{
+				ID:      id,
+				Payload: MessageGetFileReply{Status: ReplyError, Error: err.Error()},
+			})
+			return err
+		}
+	}
+
 	// check if file in local network storage
-	if !s.store.Has(msg.Key) {
+	if !held {
 		// if file not found
 		fmt.Printf("file (%s) is does not exist on disk\n", msg.Key)
-		return fmt.Errorf("file (%s) is does not exist on disk", msg.Key)
+		return s.send(peer, &Message{
+			ID:      id,
+			Payload: MessageGetFileReply{Status: ReplyNotFound},
+		})
 	}
 
 	fmt.Println("serving file over the network")
 
-	// read file from local network storage
-	n, r, err := s.store.Read(msg.Key)
+	// read file manifest from local network storage
+	m, err := s.store.Manifest(digest)
 	if err != nil {
+		s.send(peer, &Message{
+			ID:      id,
+			Payload: MessageGetFileReply{Status: ReplyError, Error: err.Error()},
+		})
 		return err
 	}
 
-	// check if peer if in peers map
-	peer, ok := s.peers[from]
-	if !ok {
-		// if peer on in peers return error
-		return fmt.Errorf("peer (%s) not in peers list", from)
+	// metadata travels with the record when it is asked for by key
+	// unless the content asked for is not its latest version
+	var meta Metadata
+	if len(msg.Key) != 0 {
+		if m, err := s.store.Metadata(msg.Key); err == nil && m.Digest == digest {
+			meta = m
+		}
 	}
 
-	// send transmission type to peer
-	peer.Send([]byte{p2p.IncomingStream})
+	// announce file size, content digest and chunks to peer
+	return s.send(peer, &Message{
+		ID: id,
+		Payload: MessageGetFileReply{
+			Status:   ReplyFound,
+			Size:     m.Size,
+			Digest:   digest,
+			Manifest: m,
+			Metadata: meta,
+		},
+	})
+}
 
-	// write file size to peer
-	binary.Write(peer, binary.LittleEndian, n)
+// handle MessageGetFileReply message from peer
+// delivers reply to the request waiting for it
+// return error
+func (s *FileServer) handleMessageGetFileReply(from string, id string, msg MessageGetFileReply) error {
+	if !s.deliverReply(from, id, msg) {
+		return fmt.Errorf("reply (%s) from peer (%s) to unknown request", id, from)
+	}
+	return nil
+}
 
-	// write file to peer
-	_, err = io.Copy(peer, r)
-	if err != nil {
-		// on error writing file
-		return err
+// hand reply payload to the request with id waiting for it
+// returns false if no request is waiting
+func (s *FileServer) deliverReply(from string, id string, payload any) bool {
+	s.pendingLock.Lock()
+	ch, ok := s.pending[id]
+	s.pendingLock.Unlock()
+
+	if !ok {
+		return false
 	}
 
-	fmt.Printf("written (%d) bytes to peer\n", n)
+	select {
+	case ch <- reply{from: from, payload: payload}:
+		return true
+	default:
+		return false
+	}
+}
 
-	return nil
+// abort stream with id opened by peer
+func (s *FileServer) resetStream(from string, id uint64) {
+	peer, err := s.peer(from)
+	if err != nil {
+		return
+	}
+
+	if stream, err := peer.Stream(id); err == nil {
+		stream.Reset()
+	}
 }
 
 // handle MessageStoreFile message from peer
+// replies with the chunks still missing or stores the file
+// once all of them were received
 // return error
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
+func (s *FileServer) handleMessageStoreFile(from string, id string, msg MessageStoreFile) error {
 	// check if the sender peer is in peers map
-	peer, ok := s.peers[from]
-	if !ok {
-		// if not in peers return error
-		return fmt.Errorf("peer (%s) not found in peers", from)
-	}
-
-	// write file to local network storage
-	n, err := s.store.Write(msg.Key, io.LimitReader(peer, msg.Size))
+	peer, err := s.peer(from)
 	if err != nil {
-		// on error writing file
 		return err
 	}
 
-	log.Printf("written (%d) bytes to disk.\n", n)
+	// hashing a complete file must not block the read loop
+	go func() {
+		reply := MessageStoreFileReply{}
+
+		missing, err := s.receiveFile(peer, msg)
+		if err != nil {
+			// on error storing file
+			log.Println(err)
+			reply.Error = err.Error()
+			reply.Rejected = rejectReason(err)
+		}
+		reply.Missing = missing
+
+		// the sender learns how much room is left before it
+		// reads the reply so it places the file elsewhere
+		if reply.Rejected == RejectCapacity {
+			if err := s.send(peer, &Message{Payload: MessageAnnounce{Node: s.nodeInfo()}}); err != nil {
+				log.Printf("announcing storage usage to peer (%s): %s", from, err)
+			}
+		}
 
-	// close stream on done
-	peer.CloseStream()
+		if err := s.send(peer, &Message{ID: id, Payload: reply}); err != nil {
+			log.Printf("replying to peer (%s): %s", from, err)
+		}
+	}()
 
 	// return nil
 	return nil
 }
 
+// store the file announced by msg from peer if all its chunks
+// were received rejecting content that does not match the
+// announced digest | the content is charged to the record owner
+// only if peer proved to be the owner and to peer otherwise
+// returns indexes of the chunks still missing | error
+func (s *FileServer) receiveFile(peer p2p.Peer, msg MessageStoreFile) ([]int, error) {
+	m := msg.Manifest
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+
+	if m.Digest != msg.Digest {
+		return nil, fmt.Errorf("manifest of (%s) announced for (%s)", m.Digest, msg.Digest)
+	}
+
+	// shards of an erasure coded record must be listed in its layout
+	if l := msg.Metadata.Erasure; l != nil {
+		if err := l.validate(); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(l.Shards, msg.Digest) {
+			return nil, fmt.Errorf("(%s) is not a shard of (%s)", msg.Digest, msg.Metadata.Digest)
+		}
+	}
+
+	// the owner named in the metadata is only claimed by peer
+	payer := peer.Identity()
+	if owner := msg.Metadata.Owner; common.IsHexAddress(owner) && provenAs(peer, common.HexToAddress(owner)) {
+		payer = owner
+	}
+
+	held, err := s.store.HasDigest(m.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	// content held already takes no more room
+	if !held {
+		if err := s.reserveRoom(m.Digest, payer, m.Size); err != nil {
+			return nil, err
+		}
+	}
+
+	// the room stays reserved while chunks are still to be sent
+	missing, err := s.store.MissingChunks(m)
+	if err == nil && len(missing) != 0 {
+		return missing, nil
+	}
+	defer s.store.Release(m.Digest)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.store.CommitManifest(m); err != nil {
+		return nil, err
+	}
+	s.announceUsage()
+
+	// write record metadata to local network storage
+	meta := msg.Metadata
+	meta.Key = msg.Key
+	meta.chargedTo = payer
+	meta.Replicas = appendUnique(meta.Replicas, s.self.ID)
+
+	// the key is not mapped to a shard
+	if meta.Erasure != nil {
+		meta, err = s.store.IndexMetadata(meta)
+	} else {
+		meta.Digest = msg.Digest
+		meta, err = s.store.LinkMetadata(meta)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("written (%d) bytes to disk.\n", m.Size)
+
+	// announce the new copy
+	go s.provide(msg.Digest)
+
+	return nil, nil
+}
+
+// sealTo returns a reader over r encrypted to recipient
+// closing it early stops the encryption
+func sealTo(r io.Reader, recipient *ecdsa.PublicKey) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		w, err := crypto.SealTo(pw, recipient)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(w, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(w.Close())
+	}()
+
+	return pr
+}
+
 func (s *FileServer) Stop() {
-	close(s.quitch)
+	s.stopOnce.Do(func() {
+		close(s.quitch)
+	})
 }
 
 func init() {
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageGetFileReply{})
+	gob.Register(MessageAnnounce{})
+	gob.Register(MessageFindNode{})
+	gob.Register(MessageFindValue{})
+	gob.Register(MessageProvide{})
+	gob.Register(MessageDHTReply{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageSyncTree{})
+	gob.Register(MessageSyncTreeReply{})
+	gob.Register(MessagePing{})
+	gob.Register(MessagePong{})
+	gob.Register(MessageStoreFileReply{})
+	gob.Register(MessagePutChunk{})
+	gob.Register(MessagePutChunkReply{})
+	gob.Register(MessageGetChunk{})
+	gob.Register(MessageChunkReply{})
+	gob.Register(MessageGetHistory{})
+	gob.Register(MessageHistoryReply{})
 }
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/luqxus/dstore/dht"
+	"github.com/luqxus/dstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// in memory Keystore for tests
+type testKeystore struct {
+	key *ecdsa.PrivateKey
+}
+
+func (ks testKeystore) PrivateKey() (*ecdsa.PrivateKey, error) {
+	return ks.key, nil
+}
+
+func newTestKeystore(t *testing.T) testKeystore {
+	key, err := ethcrypto.GenerateKey()
+	assert.Nil(t, err)
+	return testKeystore{key: key}
+}
+
+func TestFileServerSealedRecord(t *testing.T) {
+	patient := newTestKeystore(t)
+	data := []byte(`{"archetype_node_id":"openEHR-EHR-COMPOSITION.encounter.v1"}`)
+
+	// node holding only ciphertext
+	replica := NewFileServer(FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Keystore:          newTestKeystore(t),
+	})
+
+	_, err := replica.StoreWithOpts("record", bytes.NewReader(data), StoreFileOpts{
+		Recipient: &patient.key.PublicKey,
+	})
+	assert.Nil(t, err)
+
+	_, r, err := replica.Get("record")
+	assert.Nil(t, err)
+
+	sealed, _ := io.ReadAll(r)
+	r.Close()
+	assert.False(t, bytes.Contains(sealed, data))
+
+	// node of the record recipient
+	ks := &countingKeystore{Keystore: patient}
+	holder := NewFileServer(FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Keystore:          ks,
+	})
+
+	_, err = holder.Store("record", bytes.NewReader(sealed))
+	assert.Nil(t, err)
+
+	n, r, err := holder.Get("record")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	plain, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, data, plain)
+
+	// sealed records are seekable once opened
+	f, _, err := holder.Open("record")
+	assert.Nil(t, err)
+	defer f.Close()
+
+	_, err = f.Seek(10, io.SeekStart)
+	assert.Nil(t, err)
+	plain, _ = io.ReadAll(f)
+	assert.Equal(t, data[10:], plain)
+
+	_, err = f.Seek(0, io.SeekStart)
+	assert.Nil(t, err)
+	plain, _ = io.ReadAll(f)
+	assert.Equal(t, data, plain)
+
+	// the key is unlocked once however often records are opened
+	assert.Equal(t, int32(1), ks.unlocks.Load())
+}
+
+// Keystore counting how often its key is unlocked
+type countingKeystore struct {
+	Keystore
+	unlocks atomic.Int32
+}
+
+func (ks *countingKeystore) PrivateKey() (*ecdsa.PrivateKey, error) {
+	ks.unlocks.Add(1)
+	return ks.Keystore.PrivateKey()
+}
+
+func makeTestServer(t *testing.T, listenAddr string, nodes ...string) *FileServer {
+	ks := newTestKeystore(t)
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    listenAddr,
+		HandshakeFunc: p2p.DefaultHandshakeFunc,
+		Decoder:       p2p.FrameDecoder{},
+		Encoder:       p2p.FrameEncoder{},
+		Keystore:      ks,
+	})
+
+	s := NewFileServer(FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Keystore:          ks,
+		Transport:         tr,
+		BootstrapNodes:    nodes,
+		RequestTimeout:    2 * time.Second,
+	})
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerDisconnect = s.OnPeerDisconnect
+
+	go s.Start()
+	t.Cleanup(s.Stop)
+
+	return s
+}
+
+// wait until server is connected to n peers that announced themselves
+// peers are only placed once they did
+func waitPeers(t *testing.T, s *FileServer, n int) {
+	assert.Eventually(t, func() bool {
+		s.peerLock.Lock()
+		defer s.peerLock.Unlock()
+
+		nodes := make(map[string]bool)
+		for _, node := range s.nodes {
+			nodes[node.ID] = true
+		}
+		return len(nodes) >= n
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFileServerGetFromPeer(t *testing.T) {
+	s1 := makeTestServer(t, "127.0.0.1:39101")
+	s2 := makeTestServer(t, "127.0.0.1:39102", "127.0.0.1:39101")
+	waitPeers(t, s1, 1)
+	waitPeers(t, s2, 1)
+
+	data := []byte("some ehr bytes")
+	digest, _, err := s1.store.Write("record", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	n, r, err := s2.Get("record")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, data, b)
+	assert.True(t, holds(t, s2.store, digest))
+
+	// a peer without the file replies instead of hanging the request
+	start := time.Now()
+	_, _, err = s2.Get("missing")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestFileServerConcurrentTransfers(t *testing.T) {
+	s1 := makeTestServer(t, "127.0.0.1:39111")
+	s2 := makeTestServer(t, "127.0.0.1:39112", "127.0.0.1:39111")
+	waitPeers(t, s1, 1)
+	waitPeers(t, s2, 1)
+
+	// several records larger than a stream window fetched at once
+	keys := []string{"a", "b", "c", "d"}
+	records := make(map[string][]byte)
+	for i, key := range keys {
+		records[key] = bytes.Repeat([]byte{byte(i)}, 3*p2p.DefaultStreamWindow)
+		_, _, err := s1.store.Write(key, bytes.NewReader(records[key]))
+		assert.Nil(t, err)
+	}
+
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+
+			_, r, err := s2.Get(key)
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			b, _ := io.ReadAll(r)
+			r.Close()
+			assert.True(t, bytes.Equal(records[key], b))
+		}(key)
+	}
+	wg.Wait()
+}
+
+func TestFileServerReplicationFactor(t *testing.T) {
+	s1 := makeTestServer(t, "127.0.0.1:39121")
+	others := []*FileServer{
+		makeTestServer(t, "127.0.0.1:39122", "127.0.0.1:39121"),
+		makeTestServer(t, "127.0.0.1:39123", "127.0.0.1:39121"),
+		makeTestServer(t, "127.0.0.1:39124", "127.0.0.1:39121"),
+	}
+	waitPeers(t, s1, len(others))
+
+	digest, err := s1.StoreWithOpts("record", bytes.NewReader([]byte("some ehr bytes")), StoreFileOpts{
+		Replicas: 2,
+	})
+	assert.Nil(t, err)
+
+	responsible, _ := s1.placePeers(digest, 2)
+
+	// only the responsible peers receive a copy
+	holders := func() int {
+		n := 0
+		for _, s := range others {
+			if holds(t, s.store, digest) {
+				n++
+			}
+		}
+		return n
+	}
+	assert.Eventually(t, func() bool { return holders() == len(responsible) }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, len(responsible), holders())
+}
+
+func TestFileServerLocateOverDHT(t *testing.T) {
+	// s1 <- s2 <- s3 | s3 is not connected to the node holding the file
+	s1 := makeTestServer(t, "127.0.0.1:39131")
+	s2 := makeTestServer(t, "127.0.0.1:39132", "127.0.0.1:39131")
+	waitPeers(t, s1, 1)
+	s3 := makeTestServer(t, "127.0.0.1:39133", "127.0.0.1:39132")
+	waitPeers(t, s2, 2)
+
+	// s3 learns about s1 by joining the DHT through s2
+	assert.Eventually(t, func() bool { return s3.dht.Size() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	data := []byte("some ehr bytes")
+	digest, _, err := s1.store.Write("record", bytes.NewReader(data))
+	assert.Nil(t, err)
+	s1.provide(digest)
+
+	addrs, err := s3.Locate(digest)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.1:39131"}, addrs)
+
+	// s3 connects to the provider and fetches the file from it
+	assert.Nil(t, s3.fetchLocated("record", digest))
+	assert.True(t, holds(t, s3.store, digest))
+
+	// nodes cannot announce others as providers
+	forged, err := dht.KeyFromDigest(nameOf("forged"))
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, dhtNetwork{s: s2}.Provide(ctx, contactOf(s1.self), forged, contactOf(s3.self)))
+	providers, _ := s1.dht.HandleFindValue(dht.Contact{}, forged)
+	assert.Empty(t, providers)
+}
+
+func TestFileServerRepair(t *testing.T) {
+	s1 := makeTestServer(t, "127.0.0.1:39141")
+	s2 := makeTestServer(t, "127.0.0.1:39142", "127.0.0.1:39141")
+	waitPeers(t, s1, 1)
+	waitPeers(t, s2, 1)
+
+	// records stored while s2 was unreachable
+	keys := []string{"record-a", "record-b", "record-c"}
+	for _, key := range keys {
+		_, _, err := s1.store.Write(key, bytes.NewReader([]byte("ehr bytes of "+key)))
+		assert.Nil(t, err)
+	}
+
+	s2.repair()
+
+	for _, key := range keys {
+		assert.True(t, s2.store.Has(key))
+	}
+
+	stats := s2.RepairStats()
+	assert.Equal(t, uint64(1), stats.Rounds)
+	assert.Equal(t, uint64(1), stats.PeersSynced)
+	assert.Equal(t, uint64(len(keys)), stats.ObjectsRepaired)
+	assert.Equal(t, uint64(len(keys)), stats.NamesRepaired)
+	assert.Equal(t, uint64(0), stats.Failures)
+
+	// object sets converged | nothing left to repair
+	s2.repair()
+	assert.Equal(t, uint64(len(keys)), s2.RepairStats().ObjectsRepaired)
+}
+
+func TestFileServerDelete(t *testing.T) {
+	s1 := makeTestServer(t, "127.0.0.1:39151")
+	s2 := makeTestServer(t, "127.0.0.1:39152", "127.0.0.1:39151")
+	waitPeers(t, s1, 1)
+	waitPeers(t, s2, 1)
+
+	digest, err := s1.Store("record", bytes.NewReader([]byte("some ehr bytes")))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return s2.store.Has("record") }, 2*time.Second, 10*time.Millisecond)
+
+	// anyone else than the owner or a proven node is refused
+	var from string
+	s2.peerLock.Lock()
+	for addr := range s2.peers {
+		from = addr
+	}
+	s2.peerLock.Unlock()
+
+	stranger := newTestKeystore(t).key
+	forged := signedTombstone(t, stranger, "record", time.Now())
+	_, err = s2.applyTombstone(from, forged)
+	assert.ErrorIs(t, err, ErrNotDeleter)
+	assert.True(t, s2.store.Has("record"))
+
+	// owners delete their records
+	_, err = s2.store.WriteWithMetadata(Metadata{Key: "owned", Owner: forged.Deleter}, bytes.NewReader([]byte("owned bytes")))
+	assert.Nil(t, err)
+	applied, err := s2.applyTombstone(from, signedTombstone(t, stranger, "owned", time.Now()))
+	assert.Nil(t, err)
+	assert.True(t, applied)
+	assert.False(t, s2.store.Has("owned"))
+
+	_, err = s2.applyTombstone(from, signedTombstone(t, s1.Keystore.(testKeystore).key, "record", time.Now().Add(time.Hour)))
+	assert.NotNil(t, err)
+	assert.True(t, s2.store.Has("record"))
+
+	tombstone, err := s1.Delete("record", "right to erasure request")
+	assert.Nil(t, err)
+	assert.Nil(t, tombstone.Verify())
+	assert.False(t, holds(t, s1.store, digest))
+
+	// replicas erase the record too
+	assert.Eventually(t, func() bool { return !holds(t, s2.store, digest) }, 2*time.Second, 10*time.Millisecond)
+	assert.False(t, s2.store.Has("record"))
+
+	_, ok := s2.store.Tombstone(nameOf("record"))
+	assert.True(t, ok)
+
+	// tombstones can not be altered
+	tombstone.Reason = "something else"
+	assert.NotNil(t, tombstone.Verify())
+}
+
+// returns a tombstone of key deleted at deletedAt signed with key
+func signedTombstone(t *testing.T, key *ecdsa.PrivateKey, name string, deletedAt time.Time) Tombstone {
+	tombstone := Tombstone{
+		Name:      nameOf(name),
+		Deleter:   ethcrypto.PubkeyToAddress(key.PublicKey).Hex(),
+		DeletedAt: deletedAt,
+	}
+
+	var err error
+	tombstone.Signature, err = ethcrypto.Sign(tombstone.hash(), key)
+	assert.Nil(t, err)
+
+	return tombstone
+}
+
+func TestFileServerTombstoneRepair(t *testing.T) {
+	s1 := makeTestServer(t, "127.0.0.1:39161")
+	s2 := makeTestServer(t, "127.0.0.1:39162", "127.0.0.1:39161")
+
+	// s2 keeps a copy of a record deleted before it connects
+	data := []byte("some ehr bytes")
+	_, _, err := s2.store.Write("record", bytes.NewReader(data))
+	assert.Nil(t, err)
+	digest, _, err := s1.store.Write("record", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	_, err = s1.Delete("record", "right to erasure request")
+	assert.Nil(t, err)
+
+	waitPeers(t, s1, 1)
+	waitPeers(t, s2, 1)
+
+	// repair does not resurrect the record and erases the stale copy
+	s1.repair()
+	assert.False(t, s1.store.Has("record"))
+	assert.Equal(t, uint64(0), s1.RepairStats().ObjectsRepaired)
+	assert.Eventually(t, func() bool { return !holds(t, s2.store, digest) }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestFileServerAnnounceIdentity(t *testing.T) {
+	s := NewFileServer(FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	// peer that proved to hold key during the handshake
+	key := newTestKeystore(t).key
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	peer := p2p.NewTCPPeer(conn, false)
+	peer.SetPublicKey(key.PublicKey)
+	from := peer.RemoteAddr().String()
+	s.peers[from] = peer
+
+	impostor := ethcrypto.PubkeyToAddress(newTestKeystore(t).key.PublicKey).Hex()
+	assert.NotNil(t, s.handleMessageAnnounce(from, MessageAnnounce{Node: NodeInfo{ID: impostor}}))
+	assert.NotContains(t, s.nodes, from)
+
+	id := ethcrypto.PubkeyToAddress(key.PublicKey).Hex()
+	assert.Nil(t, s.handleMessageAnnounce(from, MessageAnnounce{Node: NodeInfo{ID: id}}))
+	assert.Equal(t, id, s.nodes[from].ID)
+}
+
+func TestFileServerCheckHistory(t *testing.T) {
+	d1, d2, d3 := nameOf("first"), nameOf("second"), nameOf("third")
+	local := []Metadata{{Key: "record", Version: 2, Digest: d2, Parent: d1}}
+
+	history := []Metadata{
+		{Key: "record", Version: 1, Digest: d1},
+		{Key: "record", Version: 2, Digest: d2, Parent: d1},
+		{Key: "record", Version: 3, Digest: d3, Parent: d2},
+	}
+	assert.Nil(t, checkHistory("record", history, local))
+	assert.Len(t, mergeHistory(local, history), 3)
+
+	// a version rewritten by the peer is refused
+	forged := slices.Clone(history)
+	forged[1].Digest = d3
+	assert.ErrorIs(t, checkHistory("record", forged, local), ErrVersionConflict)
+
+	// versions must follow each other
+	assert.NotNil(t, checkHistory("record", []Metadata{history[0], history[2]}, nil))
+	assert.NotNil(t, checkHistory("other", history, nil))
+}
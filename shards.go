@@ -0,0 +1,555 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/luqxus/dstore/erasure"
+	"github.com/luqxus/dstore/p2p"
+)
+
+// bytes of every shard in a stripe of an erasure coded record
+// a stripe is read and encoded at once
+const shardBlockSize = 64 << 10
+
+// ErasureLayout describes how an erasure coded record is split
+// the content is cut into stripes of DataShards blocks and
+// ParityShards parity blocks are computed for every stripe
+// shard i holds block i of every stripe and is stored
+// on its own node as an object of its own
+type ErasureLayout struct {
+	DataShards   int
+	ParityShards int
+
+	// bytes of every shard in a stripe
+	BlockSize int
+
+	// SHA-256 digests of the shards in order
+	// data shards first then parity shards
+	Shards []string
+}
+
+// validate checks a layout received from a peer
+func (l ErasureLayout) validate() error {
+	if l.DataShards <= 0 || l.ParityShards < 0 || l.DataShards+l.ParityShards > erasure.MaxShards {
+		return fmt.Errorf("invalid shard counts %d + %d", l.DataShards, l.ParityShards)
+	}
+
+	if l.BlockSize <= 0 || l.BlockSize > maxChunkSize {
+		return fmt.Errorf("invalid shard block size %d", l.BlockSize)
+	}
+
+	if len(l.Shards) != l.DataShards+l.ParityShards {
+		return fmt.Errorf("%d shard digests for %d shards", len(l.Shards), l.DataShards+l.ParityShards)
+	}
+
+	for _, digest := range l.Shards {
+		if !isSHA256Hex(digest) {
+			return fmt.Errorf("invalid shard digest (%s)", digest)
+		}
+	}
+
+	return nil
+}
+
+// returns the number of blocks in every shard of size bytes of content
+func (l ErasureLayout) stripes(size int64) int64 {
+	stripe := int64(l.DataShards) * int64(l.BlockSize)
+	return (size + stripe - 1) / stripe
+}
+
+// DeleteShards removes the erasure coded record with hashed key name
+// and the shards of all its versions held on disk
+// if it was written before before
+// returns false if there is no such record
+func (s *Store) DeleteShards(name string, before time.Time) (bool, error) {
+	idx, err := s.index()
+	if err != nil {
+		return false, err
+	}
+
+	meta, err := idx.GetName(name)
+	if errors.Is(err, ErrNoMetadata) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// the key was written again after it was deleted
+	if meta.Erasure == nil || !meta.CreatedAt.Before(before) {
+		return false, nil
+	}
+
+	versions, err := idx.Versions(meta.Key)
+	if err != nil {
+		return false, err
+	}
+
+	if err := idx.DeleteName(name); err != nil {
+		return false, err
+	}
+
+	// rebuilt copies go with the shards
+	for _, v := range versions {
+		if v.Erasure == nil {
+			continue
+		}
+
+		for _, digest := range append(v.Erasure.Shards, v.Digest) {
+			if err := s.DeleteDigest(digest); err != nil {
+				return true, err
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// split content read from r into the shards of the erasure coded
+// record meta and place every shard on its own node
+// this node keeps the shards placed on it only
+// returns content digest (string) | error
+func (s *FileServer) storeShards(meta Metadata, r io.Reader, data int, parity int) (string, error) {
+	coder, err := erasure.New(data, parity)
+	if err != nil {
+		return "", err
+	}
+
+	// shards are written to disk while the content is split
+	// each one by its own writer reading from a pipe
+	total := data + parity
+	writers := make([]io.Writer, total)
+	pipes := make([]*io.PipeWriter, total)
+	digests := make([]string, total)
+	errs := make([]error, total)
+
+	// parity of compressed content does not compress either
+	compression := s.store.compressionFor(meta.ContentType)
+
+	var wg sync.WaitGroup
+	for i := range total {
+		pr, pw := io.Pipe()
+		writers[i], pipes[i] = pw, pw
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			digests[i], _, errs[i] = s.store.writeStream(pr, "", compression)
+
+			// unblock the split if the shard could not be written
+			pr.CloseWithError(errs[i])
+		}(i)
+	}
+
+	// record digest is computed over the whole content
+	hash := sha256.New()
+	size, err := coder.Split(io.TeeReader(r, hash), writers, shardBlockSize)
+	for _, pw := range pipes {
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+
+	// shards of content that could not be stored are removed
+	discard := func() {
+		for _, digest := range digests {
+			if len(digest) != 0 {
+				s.store.DeleteDigest(digest)
+			}
+		}
+	}
+
+	if err == nil {
+		err = errors.Join(errs...)
+	}
+	if err != nil {
+		discard()
+		return "", err
+	}
+
+	meta.Digest = hex.EncodeToString(hash.Sum(nil))
+	meta.Size = size
+	meta.ReplicationFactor = total
+	meta.Erasure = &ErasureLayout{
+		DataShards:   data,
+		ParityShards: parity,
+		BlockSize:    shardBlockSize,
+		Shards:       digests,
+	}
+
+	// every shard goes to a different node | this node included
+	ids, peers := s.placeShards(meta.Digest, total)
+	if len(ids) < total {
+		discard()
+		return "", fmt.Errorf("%d nodes cannot hold %d shards", len(ids), total)
+	}
+
+	meta.Replicas = nil
+	if slices.Contains(ids, s.self.ID) {
+		meta.Replicas = []string{s.self.ID}
+	}
+
+	meta, err = s.store.IndexMetadata(meta)
+	if err != nil {
+		return "", err
+	}
+
+	// send shards to their nodes concurrently
+	type result struct {
+		shard int
+		err   error
+	}
+
+	results := make(chan result, total)
+	sent := 0
+	for i, id := range ids {
+		if id == s.self.ID {
+			continue
+		}
+
+		sent++
+		go func(i int, peer p2p.Peer) {
+			results <- result{i, s.sendFile(peer, digests[i], meta)}
+		}(i, peers[id])
+	}
+
+	var sendErr error
+	stored := []int{}
+	for range sent {
+		r := <-results
+		if r.err != nil {
+			// the shard is kept here until repair places it
+			sendErr = r.err
+			continue
+		}
+		stored = append(stored, r.shard)
+	}
+
+	s.dropShards(meta, stored)
+
+	// record which nodes hold a shard
+	if _, err := s.store.UpdateMetadata(meta.Key, func(m *Metadata) {
+		for _, i := range stored {
+			m.Replicas = appendUnique(m.Replicas, ids[i])
+		}
+	}); err != nil {
+		log.Printf("recording shard holders of (%s): %s", meta.Key, err)
+	}
+
+	return meta.Digest, sendErr
+}
+
+// returns the ids of the nodes holding each shard of the record
+// with digest in shard order and the connected peers keyed by node id
+// fewer ids than shards are returned if there are fewer nodes
+func (s *FileServer) placeShards(digest string, shards int) ([]string, map[string]p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	nodes, byID := s.placementNodes()
+
+	ids := []string{}
+	for _, node := range s.Placement.Place(digest, nodes, shards) {
+		ids = append(ids, node.ID)
+	}
+
+	return ids, byID
+}
+
+// remove the shards of meta with the given indexes from disk
+// unless this node holds the same content as one of its own shards
+func (s *FileServer) dropShards(meta Metadata, shards []int) {
+	l := meta.Erasure
+	ids, _ := s.placeShards(meta.Digest, len(l.Shards))
+
+	// identical shards share their digest
+	own := map[string]bool{}
+	for i, id := range ids {
+		if id == s.self.ID {
+			own[l.Shards[i]] = true
+		}
+	}
+
+	for _, i := range shards {
+		if own[l.Shards[i]] {
+			continue
+		}
+		if err := s.store.DeleteDigest(l.Shards[i]); err != nil {
+			log.Printf("removing shard %d of (%s): %s", i, meta.Digest, err)
+		}
+	}
+}
+
+// rebuild the content of erasure coded record meta from its shards
+// and store it on disk without mapping the key to it
+// returns error | ErrFileNotFound if too few shards are available
+func (s *FileServer) rebuild(meta Metadata) error {
+	held, err := s.store.HasDigest(meta.Digest)
+	if err != nil || held {
+		return err
+	}
+
+	if err := meta.Erasure.validate(); err != nil {
+		return err
+	}
+
+	fmt.Printf("rebuilding (%s) from its shards\n", meta.Key)
+
+	return s.withShards(meta, -1, func(coder *erasure.Coder, shards []io.Reader) error {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(coder.Join(pw, shards, meta.Erasure.BlockSize, meta.Size))
+		}()
+
+		// the rebuilt content must hash to the record digest
+		_, err := s.store.WriteDigest(meta.Digest, pr)
+		pr.CloseWithError(err)
+		return err
+	})
+}
+
+// regenerate shard of erasure coded record meta from the others
+// and store it on disk
+// returns error
+func (s *FileServer) regenerateShard(meta Metadata, shard int) error {
+	l := meta.Erasure
+
+	return s.withShards(meta, shard, func(coder *erasure.Coder, shards []io.Reader) error {
+		pr, pw := io.Pipe()
+		go func() {
+			out := make([]io.Writer, len(shards))
+			out[shard] = pw
+			pw.CloseWithError(coder.Rebuild(out, shards, l.BlockSize, l.stripes(meta.Size)))
+		}()
+
+		// the shard must hash to the digest in the layout
+		_, err := s.store.WriteDigest(l.Shards[shard], pr)
+		pr.CloseWithError(err)
+		return err
+	})
+}
+
+// call fn with readers over DataShards shards of meta other than skip
+// the missing ones are fetched from the network first and
+// the shards fetched for this call only are removed afterwards
+func (s *FileServer) withShards(meta Metadata, skip int, fn func(*erasure.Coder, []io.Reader) error) error {
+	l := meta.Erasure
+	coder, err := erasure.New(l.DataShards, l.ParityShards)
+	if err != nil {
+		return err
+	}
+
+	available, fetched, err := s.gatherShards(meta, skip)
+	defer s.dropShards(meta, fetched)
+	if err != nil {
+		return err
+	}
+
+	shards := make([]io.Reader, len(l.Shards))
+	for _, i := range available {
+		_, f, err := s.store.OpenDigest(l.Shards[i])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		shards[i] = f
+	}
+
+	return fn(coder, shards)
+}
+
+// make DataShards shards of meta other than skip available on disk
+// fetching the missing ones from the network in parallel
+// returns indexes of the shards on disk | indexes of the fetched ones | error
+func (s *FileServer) gatherShards(meta Metadata, skip int) ([]int, []int, error) {
+	l := meta.Erasure
+
+	available, candidates := []int{}, []int{}
+	for i, digest := range l.Shards {
+		if i == skip {
+			continue
+		}
+
+		held, err := s.store.HasDigest(digest)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if held {
+			available = append(available, i)
+		} else {
+			candidates = append(candidates, i)
+		}
+	}
+
+	// data shards are tried first as they need no decoding
+	fetched := []int{}
+	for len(available) < l.DataShards && len(candidates) != 0 {
+		n := min(l.DataShards-len(available), len(candidates))
+		batch := candidates[:n]
+		candidates = candidates[n:]
+
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for j, i := range batch {
+			wg.Add(1)
+			go func(j int, digest string) {
+				defer wg.Done()
+				errs[j] = s.fetchDigest(digest)
+			}(j, l.Shards[i])
+		}
+		wg.Wait()
+
+		for j, i := range batch {
+			if errs[j] != nil {
+				log.Printf("fetching shard %d of (%s): %s", i, meta.Digest, errs[j])
+				continue
+			}
+			available = append(available, i)
+			fetched = append(fetched, i)
+		}
+	}
+
+	if len(available) < l.DataShards {
+		return available, fetched, fmt.Errorf("%w: %d of %d shards of (%s) available",
+			ErrFileNotFound, len(available), l.DataShards, meta.Digest)
+	}
+
+	return available, fetched, nil
+}
+
+// place the shards of every erasure coded record version this node knows
+// on the nodes currently responsible for them
+// lost shards are regenerated from the others
+func (s *FileServer) repairShards() {
+	after := ""
+	for {
+		records, err := s.store.List(MetadataQuery{After: after, Limit: maxListLimit})
+		if err != nil {
+			log.Printf("listing records to repair: %s", err)
+			s.repairs.failures.Add(1)
+			return
+		}
+
+		for _, record := range records {
+			if record.Erasure == nil {
+				continue
+			}
+
+			versions, err := s.store.Versions(record.Key)
+			if err != nil {
+				log.Printf("reading history of (%s): %s", record.Key, err)
+				continue
+			}
+
+			for _, meta := range versions {
+				if meta.Erasure != nil {
+					s.repairRecordShards(meta)
+				}
+			}
+		}
+
+		if len(records) < maxListLimit {
+			return
+		}
+		after = records[len(records)-1].Key
+	}
+}
+
+// make sure every shard of meta is held by the node responsible for it
+// a shard missing from its node is brought to this node as it is
+// or regenerated from the others and then sent to the node
+func (s *FileServer) repairRecordShards(meta Metadata) {
+	l := meta.Erasure
+	ids, peers := s.placeShards(meta.Digest, len(l.Shards))
+
+	for i, id := range ids {
+		digest := l.Shards[i]
+		held, err := s.store.HasDigest(digest)
+		if err != nil {
+			log.Printf("repairing shard %d of (%s): %s", i, meta.Digest, err)
+			continue
+		}
+
+		// nil if the shard belongs on this node
+		var peer p2p.Peer
+		if id != s.self.ID {
+			var ok bool
+			if peer, ok = peers[id]; !ok {
+				continue
+			}
+
+			// shards held elsewhere are left to their holder
+			if !held {
+				found, err := s.holds(peer, digest)
+				if err != nil || found {
+					continue
+				}
+			}
+		}
+
+		if !held {
+			// a node may still hold the shard as it is
+			err := s.fetchDigest(digest)
+			if errors.Is(err, ErrFileNotFound) {
+				err = s.regenerateShard(meta, i)
+			}
+
+			s.countShardRepair(meta, i, err)
+			if err != nil {
+				continue
+			}
+		}
+
+		if peer == nil {
+			continue
+		}
+
+		// the peer only receives what it is missing
+		if err := s.sendFile(peer, digest, meta); err != nil {
+			log.Printf("placing shard %d of (%s) on peer (%s): %s", i, meta.Digest, peer.RemoteAddr(), err)
+			s.repairs.failures.Add(1)
+			continue
+		}
+
+		s.dropShards(meta, []int{i})
+	}
+}
+
+// count the outcome of repairing shard of meta
+func (s *FileServer) countShardRepair(meta Metadata, shard int, err error) {
+	if err != nil {
+		log.Printf("repairing shard %d of (%s): %s", shard, meta.Digest, err)
+		s.repairs.failures.Add(1)
+		return
+	}
+	s.repairs.shards.Add(1)
+}
+
+// reports whether peer holds the content with digest
+func (s *FileServer) holds(peer p2p.Peer, digest string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	r, err := s.request(ctx, peer, MessageGetFile{Digest: digest})
+	if err != nil {
+		return false, err
+	}
+
+	reply, ok := r.(MessageGetFileReply)
+	if !ok {
+		return false, fmt.Errorf("unexpected reply %T from (%s)", r, peer.RemoteAddr())
+	}
+
+	return reply.Status == ReplyFound, nil
+}
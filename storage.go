@@ -2,21 +2,44 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 const defaultRootFolder = "spxce"
 
+const (
+	// namesFolder holds the key -> digest mappings
+	namesFolder = "names"
+
+	// tmpFolder holds files that are still being written
+	tmpFolder = "tmp"
+
+	// tombstonesFolder holds the tombstones of deleted keys
+	tombstonesFolder = "tombstones"
+)
+
+// ErrDigestMismatch is returned when written content does not
+// hash to the digest it was expected to have
+var ErrDigestMismatch = errors.New("content digest mismatch")
+
+// ErrInvalidDigest is returned when a digest is not a hex encoded SHA-256 sum
+var ErrInvalidDigest = errors.New("invalid content digest")
+
 // PathTransformFunc transform the file path
 // created from the file content hash sum
-// return PathKey
-type PathTransformFunc func(string) PathKey
+// returns PathKey | error if the hash sum has no valid path
+type PathTransformFunc func(string) (PathKey, error)
 
 type StoreOpts struct {
 	// Root is the name of the root folder
@@ -27,10 +50,26 @@ type StoreOpts struct {
 	// created from the file content hash sum
 	// return PathKey
 	PathTransformFunc PathTransformFunc
+
+	// Encryption encrypts objects at rest
+	// objects are stored in plaintext if nil
+	Encryption Encryptor
+
+	// size of the chunks objects are split into
+	// defaultChunkSize if zero
+	ChunkSize int64
+
+	// compression objects are written with | CompressionNone if empty
+	// content types compressed already are always stored as is
+	Compression string
+
+	// Blobs holds the manifests and chunks of stored objects
+	// an FSBlobStore rooted at Root if nil
+	Blobs BlobStore
 }
 
 // DefaultPathTransformFunc is used if no custom transform is provided
-var DefaultPathTransformFunc = func(key string) PathKey {
+var DefaultPathTransformFunc = func(key string) (PathKey, error) {
 	return PathKey{
 
 		// path to file
@@ -41,7 +80,7 @@ var DefaultPathTransformFunc = func(key string) PathKey {
 
 		// root of the path
 		Root: key,
-	}
+	}, nil
 }
 
 // storage struct
@@ -49,6 +88,21 @@ type Store struct {
 
 	// storage options
 	StoreOpts
+
+	// metadata index opened on first use
+	indexLock sync.Mutex
+	meta      *MetadataIndex
+
+	// serializes moving received objects into place
+	commitLock sync.Mutex
+
+	// bytes of content held | guarded by commitLock
+	// computed on first use if usageKnown is false
+	usage      int64
+	usageKnown bool
+
+	// room set aside for objects being received | guarded by commitLock
+	reserved map[string]reservation
 }
 
 // A container of the paths and filename of a file
@@ -62,20 +116,21 @@ type PathKey struct {
 }
 
 // CASPathTransformFunc implements PathTransformFunc
-// returns PathKey
-func CASPathTransformFunc(key string) PathKey {
+// splits the hex encoded content digest into folders
+// returns PathKey | ErrInvalidDigest if digest is not a SHA-256 sum
+func CASPathTransformFunc(digest string) (PathKey, error) {
 
-	// hash file key
-	hash := sha1.Sum([]byte(key))
-
-	// encode hash bytes to string
-	hashStr := hex.EncodeToString(hash[:])
+	// digests may come from peers | slicing
+	// anything else could run past its end
+	if !isSHA256Hex(digest) {
+		return PathKey{}, fmt.Errorf("%w (%s)", ErrInvalidDigest, digest)
+	}
 
 	// file path block sizes
 	blockSize := 5
 
 	// how many slices (folders\blocks) to file
-	sliceLen := len(hashStr) / blockSize
+	sliceLen := len(digest) / blockSize
 
 	// path slice
 	paths := make([]string, sliceLen)
@@ -86,15 +141,15 @@ func CASPathTransformFunc(key string) PathKey {
 		from, to := i*blockSize, (i*blockSize)+blockSize
 
 		// add block to paths slice
-		paths[i] = hashStr[from:to]
+		paths[i] = digest[from:to]
 	}
 
-	// return new PathKey created from provided file key
+	// return new PathKey created from provided content digest
 	return PathKey{
 		Pathname: strings.Join(paths, "/"), // path to file
-		Filename: hashStr,                  // file name
-		Root:     hashStr[:blockSize],      // file root folder
-	}
+		Filename: digest,                   // file name
+		Root:     digest[:blockSize],       // file root folder
+	}, nil
 }
 
 // create new store
@@ -113,6 +168,14 @@ func NewStore(opts StoreOpts) *Store {
 		opts.Root = defaultRootFolder
 	}
 
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultChunkSize
+	}
+
+	if opts.Blobs == nil {
+		opts.Blobs = NewFSBlobStore(opts.Root)
+	}
+
 	// return store pointer
 	return &Store{
 		StoreOpts: opts,
@@ -124,111 +187,1096 @@ func (p *PathKey) FullPath() string {
 	return fmt.Sprintf("%s/%s", p.Pathname, p.Filename)
 }
 
+// Has reports whether key is mapped to a digest
+// whose content exists on disk
+// content that cannot be looked up cannot be served and is not held
 func (s *Store) Has(key string) bool {
-	// transform key to PathKey
-	pathKey := s.PathTransformFunc(key)
+	// resolve key to content digest
+	digest, err := s.Resolve(key)
+	if err != nil {
+		return false
+	}
 
-	// get file stats
-	_, err := os.Stat(s.Root + "/" + pathKey.FullPath())
+	ok, err := s.HasDigest(digest)
+	if err != nil {
+		log.Printf("looking up (%s): %s", digest, err)
+		return false
+	}
+	return ok
+}
+
+// HasDigest reports whether content with digest exists
+// returns true if it does | error if it cannot be looked up
+func (s *Store) HasDigest(digest string) (bool, error) {
+	key, err := s.manifestKey(digest)
+	if err != nil {
+		return false, err
+	}
+
+	return s.Blobs.Has(key)
+}
 
-	// check if error returned by Stat is os.ErrNotExist
-	return !errors.Is(err, os.ErrNotExist)
+// Resolve returns the content digest key is mapped to
+func (s *Store) Resolve(key string) (string, error) {
+	return s.ResolveName(nameOf(key))
+}
+
+// ResolveName returns the content digest the hashed key name is mapped to
+func (s *Store) ResolveName(name string) (string, error) {
+	b, err := os.ReadFile(s.nameHashPath(name))
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
 }
 
 // clears all system files
+// the blob store may be shared so only the objects
+// and chunks written by the store are removed from it
 func (s *Store) Clear() error {
+	digests, err := s.Objects()
+	if err != nil {
+		return err
+	}
+
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+
+	for _, digest := range digests {
+		if err := s.removeObject(digest); err != nil {
+			return err
+		}
+	}
+
+	// chunks of objects that were never committed
+	if err := s.deletePrefix(chunksFolder + "/"); err != nil {
+		return err
+	}
+
+	s.usageKnown = false
+
+	// the index goes with the root folder
+	if err := s.Close(); err != nil {
+		return err
+	}
 
 	// remote all from storage root folder [inclusice of the root]
 	return os.RemoveAll(s.Root)
 }
 
+// Close closes the metadata index
+// it is opened again when the store is used
+func (s *Store) Close() error {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	if s.meta == nil {
+		return nil
+	}
+
+	err := s.meta.Close()
+	s.meta = nil
+	return err
+}
+
+// returns the metadata index opening it on first use
+func (s *Store) index() (*MetadataIndex, error) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	if s.meta != nil {
+		return s.meta, nil
+	}
+
+	if err := os.MkdirAll(s.Root, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	meta, err := OpenMetadataIndex(s.Root + "/" + metadataFolder)
+	if err != nil {
+		return nil, fmt.Errorf("opening metadata index: %w", err)
+	}
+
+	if err := s.indexRefs(meta); err != nil {
+		meta.Close()
+		return nil, fmt.Errorf("indexing references: %w", err)
+	}
+
+	if err := s.chargeUsage(meta); err != nil {
+		meta.Close()
+		return nil, fmt.Errorf("counting usage: %w", err)
+	}
+
+	s.meta = meta
+	return meta, nil
+}
+
+// index the references of the key mappings and versions
+// unless idx was written since references are kept in it
+func (s *Store) indexRefs(idx *MetadataIndex) error {
+	indexed, err := idx.RefsIndexed()
+	if err != nil || indexed {
+		return err
+	}
+
+	entries, err := readDir(s.Root + "/" + namesFolder)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]string)
+	for _, entry := range entries {
+		// skip mappings that are still being written
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+
+		digest, err := s.ResolveName(entry.Name())
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		names[entry.Name()] = digest
+	}
+
+	return idx.IndexRefs(names)
+}
+
+// charge every owner for the content of the versions held
+// unless idx was written since charges are kept in it
+func (s *Store) chargeUsage(idx *MetadataIndex) error {
+	charged, err := idx.UsageCharged()
+	if err != nil || charged {
+		return err
+	}
+
+	return idx.ChargeUsage(func(meta Metadata) (bool, error) {
+		if meta.Erasure == nil {
+			return s.HasDigest(meta.Digest)
+		}
+
+		// a node holds one shard of erasure coded content
+		for _, shard := range meta.Erasure.Shards {
+			held, err := s.HasDigest(shard)
+			if err != nil || held {
+				return held, err
+			}
+		}
+		return false, nil
+	})
+}
+
+// Metadata returns the metadata of key
+// returns Metadata | ErrNoMetadata if there is none
+func (s *Store) Metadata(key string) (Metadata, error) {
+	idx, err := s.index()
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return idx.Get(key)
+}
+
+// MetadataName returns the metadata of the key with hashed name
+// returns Metadata | ErrNoMetadata if there is none
+func (s *Store) MetadataName(name string) (Metadata, error) {
+	idx, err := s.index()
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return idx.GetName(name)
+}
+
+// returns when a version written at at is recorded as written
+// now if at is unknown or further ahead than maxClockSkew
+// so no write dated in the future outlives later deletions
+func createdAt(at time.Time) time.Time {
+	now := time.Now().UTC()
+	if at.IsZero() || at.After(now.Add(maxClockSkew)) {
+		return now
+	}
+	return at
+}
+
+// UpdateMetadata applies fn to the metadata of key
+// returns the updated Metadata | error
+func (s *Store) UpdateMetadata(key string, fn func(*Metadata)) (Metadata, error) {
+	idx, err := s.index()
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return idx.Update(key, fn)
+}
+
+// List returns the metadata of stored records matching q
+func (s *Store) List(q MetadataQuery) ([]Metadata, error) {
+	idx, err := s.index()
+	if err != nil {
+		return nil, err
+	}
+
+	return idx.List(q)
+}
+
 func (s *Store) Delete(key string) error {
 
-	// transform key to PathKey
-	pathKey := s.PathTransformFunc(key)
+	// resolve key to content digest
+	digest, err := s.Resolve(key)
+	if err != nil {
+		return err
+	}
+
+	// transform digest to PathKey
+	pathKey, err := s.PathTransformFunc(digest)
+	if err != nil {
+		return err
+	}
 
 	// defer when function ends
 	defer func() {
 		fmt.Printf("deleted [%s] from disk\n", pathKey.Filename)
 	}()
 
-	// delete all from file root folder
-	return os.RemoveAll(s.Root + "/" + pathKey.Root)
+	// remove key -> digest mapping
+	if err := s.unlinkName(nameOf(key)); err != nil {
+		return err
+	}
+
+	idx, err := s.index()
+	if err != nil {
+		return err
+	}
+
+	if err := idx.Delete(key); err != nil {
+		return err
+	}
+
+	// other keys and versions may map to the same content
+	// older versions are left to garbage collection | only the
+	// object itself goes as other objects may share its root folder
+	return s.deleteUnreferenced(digest, true)
+}
+
+// DeleteName removes the mapping of the hashed key name
+// if its latest version was written before before
+// returns false if there is no such mapping
+func (s *Store) DeleteName(name string, before time.Time) (bool, error) {
+	stat, err := os.Stat(s.nameHashPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	idx, err := s.index()
+	if err != nil {
+		return false, err
+	}
+
+	// names restored by repair have no metadata
+	// and were written when their mapping was
+	written := stat.ModTime()
+	meta, err := idx.GetName(name)
+	if err == nil {
+		written = meta.CreatedAt
+	} else if !errors.Is(err, ErrNoMetadata) {
+		return false, err
+	}
+
+	// the key was written again after it was deleted
+	if !written.Before(before) {
+		return false, nil
+	}
+
+	if err := s.unlinkName(name); err != nil {
+		return false, err
+	}
+
+	return true, idx.DeleteName(name)
+}
+
+// DeleteDigest removes content with digest from disk
+// unless a key is still mapped to it
+func (s *Store) DeleteDigest(digest string) error {
+	return s.deleteUnreferenced(digest, false)
+}
+
+// remove content with digest unless a key is mapped to it
+// or a version of a record refers to it if versions is set
+// references are looked up with commitLock held and keys are
+// linked after their reference is indexed so no key is linked
+// to the content while it is removed
+func (s *Store) deleteUnreferenced(digest string, versions bool) error {
+	idx, err := s.index()
+	if err != nil {
+		return err
+	}
+
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+
+	refs, err := idx.Refs(digest)
+	if err != nil {
+		return err
+	}
+
+	// references of names are indexed before names are mapped
+	// and dropped after they are unmapped so some may be stale
+	stale := []string{}
+	for _, ref := range refs {
+		name, ok := strings.CutPrefix(ref, namePrefix)
+		if !ok {
+			if versions {
+				return nil
+			}
+			continue
+		}
+
+		mapped, err := s.ResolveName(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if mapped == digest {
+			return nil
+		}
+		stale = append(stale, name)
+	}
+
+	if err := s.removeObject(digest); err != nil {
+		return err
+	}
+
+	for _, name := range stale {
+		if err := idx.DeleteNameRef(name, digest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove the mapping of the hashed key name and its reference
+func (s *Store) unlinkName(name string) error {
+	digest, err := s.ResolveName(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(s.nameHashPath(name)); err != nil {
+		return err
+	}
+
+	idx, err := s.index()
+	if err != nil {
+		return err
+	}
+
+	return idx.DeleteNameRef(name, digest)
+}
+
+// remove the manifest and chunks of the object with digest
+// commitLock must be held
+func (s *Store) removeObject(digest string) error {
+	key, err := s.manifestKey(digest)
+	if err != nil {
+		return err
+	}
+
+	prefix, err := s.chunkPrefix(digest)
+	if err != nil {
+		return err
+	}
+
+	idx, err := s.index()
+	if err != nil {
+		return err
+	}
+
+	s.dropUsage(digest)
+
+	// the manifest goes first so the object never looks complete
+	// while its chunks are being removed
+	if err := s.Blobs.Delete(key); err != nil {
+		return err
+	}
+
+	if err := idx.ReleaseCharges(digest); err != nil {
+		return err
+	}
+
+	return s.deletePrefix(prefix)
+}
+
+// PutTombstone records that the key with tombstone name was deleted
+func (s *Store) PutTombstone(t Tombstone) error {
+	if !isSHA256Hex(t.Name) {
+		return fmt.Errorf("invalid tombstone name (%s)", t.Name)
+	}
+
+	// create tombstones folder
+	if err := os.MkdirAll(s.Root+"/"+tombstonesFolder, os.ModePerm); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	// write tombstone to a temporary file and rename it
+	return replaceFile(s.tombstonePath(t.Name), b)
+}
+
+// Tombstone returns the tombstone of the hashed key name
+// returns false if the key was not deleted
+func (s *Store) Tombstone(name string) (Tombstone, bool) {
+	b, err := os.ReadFile(s.tombstonePath(name))
+	if err != nil {
+		return Tombstone{}, false
+	}
+
+	t := Tombstone{}
+	if err := json.Unmarshal(b, &t); err != nil {
+		return Tombstone{}, false
+	}
+
+	return t, true
+}
+
+// PurgeTombstones removes tombstones of keys deleted before before
+// returns number of removed tombstones (int) | error
+func (s *Store) PurgeTombstones(before time.Time) (int, error) {
+	entries, err := os.ReadDir(s.Root + "/" + tombstonesFolder)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, entry := range entries {
+		t, ok := s.Tombstone(entry.Name())
+		if !ok || !t.DeletedAt.Before(before) {
+			continue
+		}
+
+		if err := os.Remove(s.tombstonePath(entry.Name())); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
 }
 
 // read file from storage
 // return filesize (int64) | reader (io.Reader) | error
 func (s *Store) Read(key string) (int64, io.Reader, error) {
+	return s.Open(key)
+}
+
+// read file with content digest from storage
+// the content is streamed from disk one chunk at a time
+// reads fail if an encrypted object has been tampered with
+// return filesize (int64) | reader (io.Reader) | error
+func (s *Store) ReadDigest(digest string) (int64, io.Reader, error) {
+	return s.OpenDigest(digest)
+}
+
+// Open opens the file with key for reading and seeking
+// the caller must close the returned file
+// return filesize (int64) | file (io.ReadSeekCloser) | error
+func (s *Store) Open(key string) (int64, io.ReadSeekCloser, error) {
 
-	// read file stream
-	n, f, err := s.readStream(key)
+	// resolve key to content digest
+	digest, err := s.Resolve(key)
 	if err != nil {
-		// on error reading file
 		return 0, nil, err
 	}
 
-	// close file on function end
-	defer f.Close()
+	return s.OpenDigest(digest)
+}
 
-	buf := new(bytes.Buffer)
+// OpenDigest opens the file with content digest for reading and seeking
+// only the chunk being read is held open
+// return filesize (int64) | file (io.ReadSeekCloser) | error
+func (s *Store) OpenDigest(digest string) (int64, io.ReadSeekCloser, error) {
+	m, err := s.Manifest(digest)
+	if err != nil {
+		return 0, nil, err
+	}
 
-	// copy read io.Reader data to buffer
-	_, err = io.Copy(buf, f)
+	return m.Size, newChunkReader(s.storedChunks(digest), m), nil
+}
+
+// Write writes file to storage under the SHA-256 digest of its content
+// and maps key to that digest
+// returns content digest (string) | written bytes size (int64) | error
+func (s *Store) Write(key string, r io.Reader) (string, int64, error) {
+	meta, err := s.WriteWithMetadata(Metadata{Key: key}, r)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return meta.Digest, meta.Size, nil
+}
+
+// WriteVerified writes file to storage like Write but fails with
+// ErrDigestMismatch if the content does not hash to digest
+// returns written bytes size (int64) | error
+func (s *Store) WriteVerified(key string, digest string, r io.Reader) (int64, error) {
+	meta, err := s.WriteWithMetadata(Metadata{Key: key, Digest: digest}, r)
+	if err != nil {
+		return 0, err
+	}
 
-	// return filesize (int64) | reader (io.Reader) | error
-	return n, buf, err
+	return meta.Size, nil
 }
 
-func (s *Store) Write(key string, r io.Reader) (int64, error) {
+// WriteWithMetadata writes file to storage, maps meta.Key to its
+// digest and records meta in the metadata index
+// the content must hash to meta.Digest if it is set
+// returns the recorded Metadata | error
+func (s *Store) WriteWithMetadata(meta Metadata, r io.Reader) (Metadata, error) {
 	// write file stream
-	return s.writeStream(key, r)
+	digest, _, err := s.writeStream(r, meta.Digest, s.compressionFor(meta.ContentType))
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	meta.Digest = digest
+	return s.LinkMetadata(meta)
+}
+
+// LinkMetadata maps meta.Key to the object with meta.Digest
+// held on disk and records meta in the metadata index
+// returns the recorded Metadata | error
+func (s *Store) LinkMetadata(meta Metadata) (Metadata, error) {
+	idx, err := s.index()
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	m, err := s.Manifest(meta.Digest)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	meta.Size = m.Size
+	meta.Compression = m.Compression
+	meta.CreatedAt = createdAt(meta.CreatedAt)
+
+	// objects are immutable | the write adds a version to the history
+	meta, latest, err := idx.Put(meta)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	// map key to the content of its latest version
+	if latest {
+		if err := s.link(meta.Key, meta.Digest); err != nil {
+			return Metadata{}, err
+		}
+	}
+
+	return meta, nil
+}
+
+// IndexMetadata records meta in the metadata index without
+// mapping meta.Key to content on disk | used for erasure coded
+// records whose content is spread over other nodes
+// returns the recorded Metadata | error
+func (s *Store) IndexMetadata(meta Metadata) (Metadata, error) {
+	idx, err := s.index()
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	meta.CreatedAt = createdAt(meta.CreatedAt)
+
+	meta, latest, err := idx.Put(meta)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	// the key no longer maps to the content of an older version
+	if latest {
+		err := s.unlinkName(nameOf(meta.Key))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return Metadata{}, err
+		}
+	}
+
+	return meta, nil
+}
+
+// Version returns the metadata of version of key
+// returns Metadata | ErrNoMetadata if there is no such version
+func (s *Store) Version(key string, version int) (Metadata, error) {
+	idx, err := s.index()
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return idx.Version(key, version)
+}
+
+// Versions returns the history of key oldest version first
+func (s *Store) Versions(key string) ([]Metadata, error) {
+	idx, err := s.index()
+	if err != nil {
+		return nil, err
+	}
+
+	return idx.Versions(key)
 }
 
-// read file from storage as stream
+// ReadVersion reads version of the file with key
 // returns file size (int64) | reader (io.Reader) | error
-func (s *Store) readStream(key string) (int64, io.ReadCloser, error) {
+func (s *Store) ReadVersion(key string, version int) (int64, io.Reader, error) {
+	meta, err := s.Version(key, version)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return s.ReadDigest(meta.Digest)
+}
+
+// WriteDigest writes content expected to hash to digest
+// without mapping any key to it
+// returns written bytes size (int64) | error
+func (s *Store) WriteDigest(digest string, r io.Reader) (int64, error) {
+	_, n, err := s.writeStream(r, digest, s.Compression)
+	return n, err
+}
+
+// Names returns the hashed keys mapped to each content
+// digest that exists on disk
+// returns digest -> name hashes (map[string][]string) | error
+func (s *Store) Names() (map[string][]string, error) {
+	entries, err := os.ReadDir(s.Root + "/" + namesFolder)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string][]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string][]string)
+	for _, entry := range entries {
+		// skip mappings that are still being written
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+
+		b, err := os.ReadFile(s.Root + "/" + namesFolder + "/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
 
-	// transform key to PathKey
-	pathKey := s.PathTransformFunc(key)
+		// names mapped to content that is not held are skipped
+		digest := string(b)
+		held, err := s.HasDigest(digest)
+		if err != nil && !errors.Is(err, ErrInvalidDigest) {
+			return nil, err
+		}
+		if !held {
+			continue
+		}
+
+		names[digest] = append(names[digest], entry.Name())
+	}
+
+	return names, nil
+}
+
+// LinkName maps the hashed key name to digest unless
+// name is already mapped
+// returns true if the mapping was created
+func (s *Store) LinkName(name string, digest string) (bool, error) {
+	// names and digests come from peers | both are hex SHA-256 sums
+	if !isSHA256Hex(name) || !isSHA256Hex(digest) {
+		return false, fmt.Errorf("invalid name mapping (%s -> %s)", name, digest)
+	}
+
+	_, err := os.Stat(s.nameHashPath(name))
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	return true, s.linkName(name, digest)
+}
+
+// open file at path decrypting it if objects are encrypted at rest
+// returns content size (int64) | reader (io.ReadCloser) | error
+func (s *Store) openFile(path string) (int64, io.ReadCloser, error) {
 
 	// get file stats
-	stat, err := os.Stat(s.Root + "/" + pathKey.FullPath())
+	stat, err := os.Stat(path)
 	if err != nil {
 		// on error getting stats
 		return 0, nil, err
 	}
 
 	// open file
-	r, err := os.Open(s.Root + "/" + pathKey.FullPath())
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return s.decrypt(path, stat.Size(), f)
+}
+
+// open blob with key decrypting it if objects are encrypted at rest
+// returns content size (int64) | reader (io.ReadCloser) | error
+func (s *Store) openBlob(key string) (int64, io.ReadCloser, error) {
+	info, err := s.Blobs.Stat(key)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	f, err := s.Blobs.Open(key)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return s.decrypt(key, info.Size, f)
+}
+
+// returns reader decrypting f holding size stored bytes
+// read from name if objects are encrypted at rest
+// returns content size (int64) | reader (io.ReadCloser) | error
+func (s *Store) decrypt(name string, size int64, f io.ReadCloser) (int64, io.ReadCloser, error) {
+	// plaintext files are returned as is
+	if s.Encryption == nil {
+		return size, f, nil
+	}
+
+	// decrypt file while it is being read
+	r, err := s.Encryption.Decrypt(f)
+	if err != nil {
+		f.Close()
+		return 0, nil, fmt.Errorf("decrypting (%s): %w", name, err)
+	}
 
 	// returns file size (int64) | reader (io.Reader) | error
-	return stat.Size(), r, err
+	return s.Encryption.PlainSize(size), readCloser{r, f}, nil
 }
 
-// write file to storage
-// return written bytes size (int64) | error
-func (s *Store) writeStream(key string, r io.Reader) (int64, error) {
+// write file to storage under the digest of its content
+// the content is split into chunks of ChunkSize bytes
+// every chunk is compressed with compression
+// if expected is not empty the computed digest must match it
+// return content digest (string) | written bytes size (int64) | error
+func (s *Store) writeStream(r io.Reader, expected string, compression string) (string, int64, error) {
+	if err := checkCompression(compression); err != nil {
+		return "", 0, err
+	}
 
-	// transform key to PathKey
-	pathKey := s.PathTransformFunc(key)
+	// create temporary folder
+	if err := os.MkdirAll(s.Root+"/"+tmpFolder, os.ModePerm); err != nil {
+		return "", 0, err
+	}
 
-	// create directories to file
-	if err := os.MkdirAll(s.Root+"/"+pathKey.Pathname, os.ModePerm); err != nil {
-		return 0, err
+	// chunks are written to a temporary folder since
+	// the object digest is only known once the stream ends
+	dir, err := os.MkdirTemp(s.Root+"/"+tmpFolder, "write-")
+	if err != nil {
+		return "", 0, err
+	}
+
+	// remove temporary folder on failure
+	// after a successful commit this is a no-op
+	defer os.RemoveAll(dir)
+
+	// object digest is computed over the whole content
+	hash := sha256.New()
+	tee := io.TeeReader(r, hash)
+
+	m := Manifest{Compression: compression}
+	for {
+		c, err := s.writeChunk(dir, io.LimitReader(tee, s.ChunkSize), compression, "")
+		if err != nil {
+			return "", 0, err
+		}
+
+		// end of the stream
+		if c.Size == 0 {
+			break
+		}
+
+		m.Chunks = append(m.Chunks, c)
+		m.Size += c.Size
 	}
 
-	// create file in created directories
-	f, err := os.Create(s.Root + "/" + pathKey.FullPath())
+	m.Digest = hex.EncodeToString(hash.Sum(nil))
+
+	// verify content against expected digest
+	if len(expected) != 0 && expected != m.Digest {
+		return "", 0, fmt.Errorf("%w: expected %s got %s", ErrDigestMismatch, expected, m.Digest)
+	}
+
+	if err := s.commit(dir, m); err != nil {
+		return "", 0, err
+	}
+
+	// return content digest, written bytes size and error
+	return m.Digest, m.Size, nil
+}
+
+// write b to the blob with key
+// encrypting it if objects are encrypted at rest
+func (s *Store) writeBlob(key string, b []byte) error {
+	var buf bytes.Buffer
+
+	w, err := s.encryptTo(&buf)
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+
+	// flush the last encrypted segment
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	_, err = s.Blobs.Write(key, &buf)
+	return err
+}
+
+// move the local file at path to the blob with key
+// blob stores that cannot take over files get a copy
+func (s *Store) putBlob(key string, path string) error {
+	if importer, ok := s.Blobs.(blobImporter); ok {
+		return importer.Import(key, path)
 	}
 
-	// write reader data to created file
-	n, err := io.Copy(f, r)
+	f, err := os.Open(path)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	defer f.Close()
+
+	_, err = s.Blobs.Write(key, f)
+	return err
+}
+
+// remove every blob whose key starts with prefix
+// prefix ends with a slash | an empty one is refused
+// as the blob store may hold data of others
+func (s *Store) deletePrefix(prefix string) error {
+	if !strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("refusing to delete blobs under prefix (%s)", prefix)
+	}
+
+	if deleter, ok := s.Blobs.(blobPrefixDeleter); ok {
+		return deleter.DeletePrefix(prefix)
+	}
+
+	keys, err := s.Blobs.List(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := s.Blobs.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// returns the key of the manifest of the object with digest
+func (s *Store) manifestKey(digest string) (string, error) {
+	pathKey, err := s.PathTransformFunc(digest)
+	if err != nil {
+		return "", err
+	}
+	return pathKey.FullPath(), nil
+}
+
+// returns writer encrypting into w if objects are encrypted at rest
+// closing it flushes the last encrypted segment and leaves w open
+func (s *Store) encryptTo(w io.Writer) (io.WriteCloser, error) {
+	if s.Encryption == nil {
+		return nopWriteCloser{w}, nil
+	}
+
+	return s.Encryption.Encrypt(w)
+}
+
+// map key to content digest
+// writing a key again lifts its tombstone
+func (s *Store) link(key string, digest string) error {
+	if err := s.linkName(nameOf(key), digest); err != nil {
+		return err
+	}
+
+	err := os.Remove(s.tombstonePath(nameOf(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// map the hashed key name to digest
+// the reference is indexed before the mapping is written and the one
+// of the content it replaces dropped after so none is ever missing
+// fails with os.ErrNotExist if the content was removed meanwhile
+func (s *Store) linkName(name string, digest string) error {
+	idx, err := s.index()
+	if err != nil {
+		return err
 	}
 
-	// return written bytes size and error
-	return n, nil
+	old, err := s.ResolveName(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := idx.AddNameRef(name, digest); err != nil {
+		return err
+	}
+
+	if err := s.linkPath(s.nameHashPath(name), digest); err != nil {
+		return err
+	}
+
+	if len(old) != 0 && old != digest {
+		if err := idx.DeleteNameRef(name, old); err != nil {
+			return err
+		}
+	}
+
+	// removal looks references up with commitLock held so content
+	// is either kept for the reference or already gone
+	s.commitLock.Lock()
+	held, err := s.HasDigest(digest)
+	s.commitLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if !held {
+		return fmt.Errorf("linking (%s): %w", digest, os.ErrNotExist)
+	}
+
+	return nil
+}
+
+// write digest to mapping file at path
+func (s *Store) linkPath(path string, digest string) error {
+
+	// create names folder
+	if err := os.MkdirAll(s.Root+"/"+namesFolder, os.ModePerm); err != nil {
+		return err
+	}
+
+	// write mapping to a temporary file and rename it
+	// so a reader never sees a partially written digest
+	return replaceFile(path, []byte(digest))
+}
+
+// returns path of the file holding the digest key is mapped to
+func (s *Store) namePath(key string) string {
+	return s.nameHashPath(nameOf(key))
+}
+
+// returns the name key is stored under
+// keys are hashed so any string is a valid file name
+func nameOf(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// returns path of the mapping file of hashed key name
+func (s *Store) nameHashPath(name string) string {
+	return s.Root + "/" + namesFolder + "/" + name
+}
+
+// returns path of the tombstone of hashed key name
+func (s *Store) tombstonePath(name string) string {
+	return s.Root + "/" + tombstonesFolder + "/" + name
+}
+
+// reports whether s is a hex encoded SHA-256 sum
+func isSHA256Hex(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// readCloser reads from a reader wrapping a file
+// and closes the underlying file
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// replace file at path with b through a temporary .tmp file
+// the file holds either the old or the new content after a crash
+func replaceFile(path string, b []byte) error {
+	// concurrent writers of path each have their own temporary file
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	// remove temporary file on failure
+	// after a successful rename this is a no-op
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// flush the entries of folder at path to disk
+// so files renamed into it survive a crash
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// nopWriteCloser writes to a writer that is closed by its owner
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
 }
@@ -2,17 +2,51 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/luqxus/dstore/crypto"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 func TestPathTransformFunc(t *testing.T) {
-	key := "momsbestpicture"
-	pathKey := CASPathTransformFunc(key)
-	expected := "68044/29f74/181a6/3c50c/3d81d/733a1/2f14a/353ff"
+	digest := "b159a9f0a78305c07dbce386598952bfa30b6aabb46a98b072c9195348abf9ea"
+	pathKey, err := CASPathTransformFunc(digest)
+	assert.Nil(t, err)
+	expected := "b159a/9f0a7/8305c/07dbc/e3865/98952/bfa30/b6aab/b46a9/8b072/c9195/348ab"
 	assert.Equal(t, expected, pathKey.Pathname)
+	assert.Equal(t, digest, pathKey.Filename)
+
+	// digests shorter than a folder are rejected
+	_, err = CASPathTransformFunc("b159")
+	assert.ErrorIs(t, err, ErrInvalidDigest)
+}
+
+// returns the key of chunk of the object with digest in s
+func chunkKeyOf(t *testing.T, s *Store, digest string, chunk string) string {
+	key, err := s.chunkKey(digest, chunk)
+	assert.Nil(t, err)
+	return key
+}
+
+// reports whether s holds the content with digest
+func holds(t *testing.T, s *Store, digest string) bool {
+	ok, err := s.HasDigest(digest)
+	assert.Nil(t, err)
+	return ok
+}
+
+// returns the CAS root folder of digest
+func rootOf(t *testing.T, digest string) string {
+	pathKey, err := CASPathTransformFunc(digest)
+	assert.Nil(t, err)
+	return pathKey.Root
 }
 
 func TestStore(t *testing.T) {
@@ -22,11 +56,13 @@ func TestStore(t *testing.T) {
 	}
 
 	s := NewStore(opts)
+	defer s.Clear()
+
 	key := "specialpicture"
 
 	data := []byte("some jpg bytes")
 
-	_, err := s.writeStream(key, bytes.NewReader(data))
+	_, _, err := s.Write(key, bytes.NewReader(data))
 	if err != nil {
 		t.Error(err)
 	}
@@ -42,17 +78,59 @@ func TestStore(t *testing.T) {
 	assert.Equal(t, b, data)
 }
 
+func TestStoreContentAddressing(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Root:              t.TempDir(),
+	})
+
+	data := []byte("some jpg bytes")
+
+	d1, _, err := s.Write("first", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	d2, _, err := s.Write("second", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	// identical content is stored once under the same digest
+	assert.Equal(t, d1, d2)
+	assert.True(t, holds(t, s, d1))
+
+	// different content under the same key does not overwrite the old object
+	d3, _, err := s.Write("first", bytes.NewReader([]byte("other bytes")))
+	assert.Nil(t, err)
+	assert.NotEqual(t, d1, d3)
+	assert.True(t, holds(t, s, d1))
+
+	resolved, err := s.Resolve("first")
+	assert.Nil(t, err)
+	assert.Equal(t, d3, resolved)
+
+	_, err = s.WriteVerified("third", d1, bytes.NewReader([]byte("tampered")))
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+	assert.False(t, s.Has("third"))
+
+	// content that cannot be looked up is fetched from peers instead
+	blobs := s.Blobs
+	s.Blobs = unreadableBlobs{BlobStore: blobs, prefix: ""}
+	assert.False(t, s.Has("first"))
+	s.Blobs = blobs
+	assert.True(t, s.Has("first"))
+}
+
 func TestStoreDeleteKey(t *testing.T) {
 	opts := StoreOpts{
 		PathTransformFunc: CASPathTransformFunc,
 	}
 
 	s := NewStore(opts)
+	defer s.Clear()
+
 	key := "specialpicture"
 
 	data := []byte("some jpg bytes")
 
-	_, err := s.writeStream(key, bytes.NewReader(data))
+	_, _, err := s.Write(key, bytes.NewReader(data))
 	if err != nil {
 		t.Error(err)
 	}
@@ -60,4 +138,711 @@ func TestStoreDeleteKey(t *testing.T) {
 	if err := s.Delete(key); err != nil {
 		t.Error(err)
 	}
+
+	assert.False(t, s.Has(key))
+}
+
+func TestStoreDeleteSharedFolder(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Root:              t.TempDir(),
+	})
+	defer s.Close()
+
+	// both digests start with b70fc
+	first, _, err := s.Write("first", bytes.NewReader([]byte("record 1754")))
+	assert.Nil(t, err)
+	second, _, err := s.Write("second", bytes.NewReader([]byte("record 2429")))
+	assert.Nil(t, err)
+	assert.Equal(t, rootOf(t, first), rootOf(t, second))
+
+	// content shared with another key stays
+	_, _, err = s.Write("copy", bytes.NewReader([]byte("record 2429")))
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.Delete("first"))
+	assert.Nil(t, s.Delete("copy"))
+	assert.False(t, holds(t, s, first))
+
+	_, r, err := s.Read("second")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, []byte("record 2429"), b)
+
+	// content a key maps to is not removed by digest
+	assert.Nil(t, s.DeleteDigest(second))
+	assert.True(t, holds(t, s, second))
+
+	// an index written without references gets them on open
+	assert.Nil(t, s.Close())
+	idx, err := OpenMetadataIndex(s.Root + "/" + metadataFolder)
+	assert.Nil(t, err)
+	refs, err := idx.Refs(second)
+	assert.Nil(t, err)
+	assert.Contains(t, refs, namePrefix+nameOf("second"))
+
+	batch := new(leveldb.Batch)
+	batch.Delete(refKey(second, namePrefix+nameOf("second")))
+	batch.Delete([]byte(refsIndexedKey))
+	assert.Nil(t, idx.db.Write(batch, nil))
+	assert.Nil(t, idx.Close())
+
+	assert.Nil(t, s.DeleteDigest(second))
+	assert.True(t, holds(t, s, second))
+}
+
+func TestStoreEncryption(t *testing.T) {
+	enc, err := NewEnvelopeEncryptor(bytes.Repeat([]byte{0x42}, 32))
+	assert.Nil(t, err)
+
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Root:              t.TempDir(),
+		Encryption:        enc,
+	})
+
+	// spans several sealed segments
+	data := bytes.Repeat([]byte("some ehr bytes "), 10000)
+
+	digest, _, err := s.Write("record", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	// bytes on disk are not the plaintext
+	pathKey, err := s.PathTransformFunc(digest)
+	assert.Nil(t, err)
+	raw, err := os.ReadFile(s.Root + "/" + pathKey.FullPath())
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("some ehr bytes")))
+
+	n, r, err := s.Read("record")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, data, b)
+
+	// flip a bit of the ciphertext
+	raw[len(raw)/2] ^= 0x01
+	assert.Nil(t, os.WriteFile(s.Root+"/"+pathKey.FullPath(), raw, 0o644))
+
+	_, _, err = s.Read("record")
+	assert.ErrorIs(t, err, crypto.ErrTampered)
+}
+
+func TestStoreMetadata(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Root:              t.TempDir(),
+	})
+	defer s.Close()
+
+	for i, patient := range []string{"p1", "p2", "p1"} {
+		_, err := s.WriteWithMetadata(Metadata{
+			Key:         fmt.Sprintf("record-%d", i),
+			ContentType: "application/fhir+json",
+			Owner:       "0x01",
+			PatientID:   patient,
+		}, bytes.NewReader([]byte(fmt.Sprintf("ehr bytes %d", i))))
+		assert.Nil(t, err)
+	}
+
+	meta, err := s.Metadata("record-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "p2", meta.PatientID)
+	assert.Equal(t, int64(len("ehr bytes 1")), meta.Size)
+	assert.False(t, meta.CreatedAt.IsZero())
+
+	digest, err := s.Resolve("record-1")
+	assert.Nil(t, err)
+	assert.Equal(t, digest, meta.Digest)
+
+	records, err := s.List(MetadataQuery{PatientID: "p1"})
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "record-0", records[0].Key)
+	assert.Equal(t, "record-2", records[1].Key)
+
+	// pages continue after the last key
+	records, err = s.List(MetadataQuery{Owner: "0x01", Limit: 2})
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+
+	records, err = s.List(MetadataQuery{Owner: "0x01", After: records[1].Key})
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "record-2", records[0].Key)
+
+	// overwriting a key moves it between secondary indexes
+	_, err = s.WriteWithMetadata(Metadata{Key: "record-0", PatientID: "p2"}, bytes.NewReader([]byte("new")))
+	assert.Nil(t, err)
+
+	records, err = s.List(MetadataQuery{PatientID: "p1"})
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+
+	// deletes keep the index consistent
+	assert.Nil(t, s.Delete("record-2"))
+	_, err = s.Metadata("record-2")
+	assert.ErrorIs(t, err, ErrNoMetadata)
+
+	deleted, err := s.DeleteName(nameOf("record-1"), time.Now().Add(time.Second))
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+
+	records, err = s.List(MetadataQuery{})
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "record-0", records[0].Key)
+}
+
+func TestStoreVersions(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Root:              t.TempDir(),
+	})
+	defer s.Close()
+
+	v1, err := s.WriteWithMetadata(Metadata{Key: "record", Author: "0x01"}, bytes.NewReader([]byte("first")))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, v1.Version)
+	assert.Empty(t, v1.Parent)
+
+	v2, err := s.WriteWithMetadata(Metadata{Key: "record", Author: "0x02"}, bytes.NewReader([]byte("second")))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, v2.Version)
+	assert.Equal(t, v1.Digest, v2.Parent)
+
+	// rewriting the latest content is not a new version
+	same, err := s.WriteWithMetadata(Metadata{Key: "record"}, bytes.NewReader([]byte("second")))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, same.Version)
+
+	// an older version arriving late does not replace the latest
+	_, err = s.WriteWithMetadata(Metadata{Key: "late", Version: 2}, bytes.NewReader([]byte("late 2")))
+	assert.Nil(t, err)
+	_, err = s.WriteWithMetadata(Metadata{Key: "late", Version: 1}, bytes.NewReader([]byte("late 1")))
+	assert.Nil(t, err)
+
+	_, r, err := s.Read("late")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, []byte("late 2"), b)
+
+	// a recorded version keeps its content and author
+	_, err = s.WriteWithMetadata(Metadata{Key: "record", Version: 1}, bytes.NewReader([]byte("forged")))
+	assert.ErrorIs(t, err, ErrVersionConflict)
+
+	again, err := s.WriteWithMetadata(Metadata{Key: "record", Version: 1, Author: "0x03"}, bytes.NewReader([]byte("first")))
+	assert.Nil(t, err)
+	assert.Equal(t, "0x01", again.Author)
+
+	versions, err := s.Versions("record")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, "0x01", versions[0].Author)
+	assert.Equal(t, "0x02", versions[1].Author)
+
+	// old versions stay readable
+	_, r, err = s.ReadVersion("record", 1)
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(r)
+	assert.Equal(t, []byte("first"), b)
+
+	_, err = s.Version("record", 3)
+	assert.ErrorIs(t, err, ErrNoMetadata)
+
+	// the history goes with the record
+	assert.Nil(t, s.Delete("record"))
+	versions, err = s.Versions("record")
+	assert.Nil(t, err)
+	assert.Empty(t, versions)
+}
+
+func TestStoreChunks(t *testing.T) {
+	opts := StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Root:              t.TempDir(),
+		ChunkSize:         1024,
+	}
+	s := NewStore(opts)
+	defer s.Close()
+
+	data := bytes.Repeat([]byte("some dicom bytes "), 1000)
+	digest, n, err := s.Write("study", bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	m, err := s.Manifest(digest)
+	assert.Nil(t, err)
+	assert.Len(t, m.Chunks, (len(data)+1023)/1024)
+	assert.Nil(t, m.validate())
+
+	_, r, err := s.Read("study")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, data, b)
+
+	// a second store receives the chunks in two goes
+	opts.Root = t.TempDir()
+	other := NewStore(opts)
+	defer other.Close()
+
+	copyChunk := func(i int) {
+		_, r, err := s.ReadChunk(digest, m.Chunks[i].Digest)
+		assert.Nil(t, err)
+		defer r.Close()
+		assert.Nil(t, other.WriteChunk(digest, m.Chunks[i], m.Compression, r))
+	}
+
+	for i := 0; i < len(m.Chunks)/2; i++ {
+		copyChunk(i)
+	}
+
+	missing, err := other.MissingChunks(m)
+	assert.Nil(t, err)
+	assert.Len(t, missing, len(m.Chunks)-len(m.Chunks)/2)
+	assert.NotNil(t, other.CommitManifest(m))
+
+	// chunks must hash to the digest in the manifest
+	err = other.WriteChunk(digest, m.Chunks[missing[0]], m.Compression, bytes.NewReader(bytes.Repeat([]byte{0}, 1024)))
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+
+	for _, i := range missing {
+		copyChunk(i)
+	}
+	assert.Nil(t, other.CommitManifest(m))
+	assert.True(t, holds(t, other, digest))
+
+	_, r, err = other.ReadDigest(digest)
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(r)
+	assert.Equal(t, data, b)
+}
+
+func TestStoreOpen(t *testing.T) {
+	enc, err := NewEnvelopeEncryptor(bytes.Repeat([]byte{0x42}, 32))
+	assert.Nil(t, err)
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	// plaintext chunks are seeked and encrypted ones skipped through
+	for _, encryption := range []Encryptor{nil, enc} {
+		s := NewStore(StoreOpts{
+			PathTransformFunc: CASPathTransformFunc,
+			Root:              t.TempDir(),
+			Encryption:        encryption,
+			ChunkSize:         1024,
+		})
+
+		_, _, err := s.Write("scan", bytes.NewReader(data))
+		assert.Nil(t, err)
+
+		n, f, err := s.Open("scan")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(data)), n)
+
+		// reads span chunk boundaries
+		pos, err := f.Seek(1000, io.SeekStart)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1000), pos)
+
+		b := make([]byte, 3000)
+		_, err = io.ReadFull(f, b)
+		assert.Nil(t, err)
+		assert.Equal(t, data[1000:4000], b)
+
+		// backwards from the end
+		_, err = f.Seek(-10, io.SeekEnd)
+		assert.Nil(t, err)
+		b, _ = io.ReadAll(f)
+		assert.Equal(t, data[len(data)-10:], b)
+
+		_, err = f.Seek(-1, io.SeekStart)
+		assert.NotNil(t, err)
+
+		assert.Nil(t, f.Close())
+		s.Close()
+	}
+}
+
+func TestStoreCompression(t *testing.T) {
+	enc, err := NewEnvelopeEncryptor(bytes.Repeat([]byte{0x42}, 32))
+	assert.Nil(t, err)
+
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Root:              t.TempDir(),
+		Encryption:        enc,
+		ChunkSize:         1024,
+		Compression:       CompressionGzip,
+	})
+	defer s.Close()
+
+	// compositions are repetitive json
+	data := bytes.Repeat([]byte(`{"archetype_node_id":"openEHR-EHR-OBSERVATION.blood_pressure.v2","systolic":120},`), 100)
+
+	meta, err := s.WriteWithMetadata(Metadata{Key: "composition", ContentType: "application/openehr+json"}, bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, CompressionGzip, meta.Compression)
+	assert.Equal(t, int64(len(data)), meta.Size)
+
+	// chunks take less room on disk than their content
+	m, err := s.Manifest(meta.Digest)
+	assert.Nil(t, err)
+	assert.Equal(t, CompressionGzip, m.Compression)
+	for _, c := range m.Chunks {
+		stat, err := os.Stat(s.Root + "/" + chunkKeyOf(t, s, meta.Digest, c.Digest))
+		assert.Nil(t, err)
+		assert.Less(t, stat.Size(), c.Size)
+	}
+
+	// reads and seeks see the content as written
+	_, f, err := s.Open("composition")
+	assert.Nil(t, err)
+	_, err = f.Seek(1500, io.SeekStart)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(f)
+	assert.Equal(t, data[1500:], b)
+	f.Close()
+
+	n, err := s.verify(meta.Digest, func(r io.Reader) io.Reader { return r })
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	// compressed pixel data is stored as is
+	meta, err = s.WriteWithMetadata(Metadata{
+		Key:         "xray",
+		ContentType: "application/dicom; transfer-syntax=1.2.840.10008.1.2.4.50",
+	}, bytes.NewReader(data[:2048]))
+	assert.Nil(t, err)
+	assert.Equal(t, CompressionNone, meta.Compression)
+
+	assert.False(t, compressible("image/jpeg"))
+	assert.True(t, compressible("application/dicom; transfer-syntax=1.2.840.10008.1.2.1"))
+	assert.True(t, compressible(""))
+}
+
+func TestStoreUsage(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Root:              t.TempDir(),
+		ChunkSize:         1024,
+	})
+	defer s.Close()
+
+	first, _, err := s.Write("first", bytes.NewReader(bytes.Repeat([]byte("a"), 3000)))
+	assert.Nil(t, err)
+
+	used, err := s.Usage()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3000), used)
+
+	// identical content is held once and rejected content not at all
+	_, _, err = s.Write("copy", bytes.NewReader(bytes.Repeat([]byte("a"), 3000)))
+	assert.Nil(t, err)
+	_, err = s.WriteDigest(nameOf("other"), bytes.NewReader([]byte("second")))
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+	_, _, err = s.Write("second", bytes.NewReader([]byte("second")))
+	assert.Nil(t, err)
+
+	used, err = s.Usage()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3006), used)
+
+	assert.Nil(t, s.Delete("first"))
+	assert.Nil(t, s.Delete("copy"))
+	assert.Nil(t, s.DeleteDigest(first))
+
+	used, err = s.Usage()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), used)
+
+	owned, err := s.WriteWithMetadata(Metadata{Key: "owned", Owner: "0xaa"}, bytes.NewReader([]byte("owned bytes")))
+	assert.Nil(t, err)
+
+	n, err := s.OwnerUsage("0xaa")
+	assert.Nil(t, err)
+	assert.Equal(t, owned.Size, n)
+
+	// room reserved for objects being received counts until released
+	var reserved int64
+	assert.Nil(t, s.Reserve(nameOf("a"), "0xaa", 100, func(used, ownerUsed int64) error { return nil }))
+	assert.Nil(t, s.Reserve(nameOf("b"), "0xaa", 50, func(used, ownerUsed int64) error {
+		reserved = ownerUsed
+		return nil
+	}))
+	assert.Equal(t, owned.Size+100, reserved)
+
+	assert.True(t, s.Reserved(nameOf("a")))
+	s.Release(nameOf("a"))
+	assert.False(t, s.Reserved(nameOf("a")))
+
+	// superseded versions count until their content is collected
+	amended, err := s.WriteWithMetadata(Metadata{Key: "owned", Owner: "0xaa"}, bytes.NewReader([]byte("amended bytes")))
+	assert.Nil(t, err)
+	n, err = s.OwnerUsage("0xaa")
+	assert.Nil(t, err)
+	assert.Equal(t, owned.Size+amended.Size, n)
+
+	_, err = s.CollectGarbage(GCOpts{KeepVersions: 1, Grace: -1})
+	assert.Nil(t, err)
+	n, err = s.OwnerUsage("0xaa")
+	assert.Nil(t, err)
+	assert.Equal(t, amended.Size, n)
+
+	// recording where copies are kept charges nothing more
+	_, err = s.UpdateMetadata("owned", func(m *Metadata) { m.Replicas = append(m.Replicas, "0xbb") })
+	assert.Nil(t, err)
+	n, err = s.OwnerUsage("0xaa")
+	assert.Nil(t, err)
+	assert.Equal(t, amended.Size, n)
+
+	assert.Nil(t, s.Delete("owned"))
+	n, err = s.OwnerUsage("0xaa")
+	assert.Nil(t, err)
+	assert.Zero(t, n)
+}
+
+func TestStoreGarbageCollection(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Root:              t.TempDir(),
+		ChunkSize:         1024,
+	})
+	defer s.Close()
+
+	v1, err := s.WriteWithMetadata(Metadata{Key: "record"}, bytes.NewReader([]byte("first")))
+	assert.Nil(t, err)
+	v2, err := s.WriteWithMetadata(Metadata{Key: "record"}, bytes.NewReader([]byte("second")))
+	assert.Nil(t, err)
+
+	// content no key maps to
+	stray := nameOf("stray bytes")
+	_, err = s.WriteDigest(stray, bytes.NewReader([]byte("stray bytes")))
+	assert.Nil(t, err)
+
+	// chunk the manifest of v2 does not list
+	_, err = s.Blobs.Write(chunkKeyOf(t, s, v2.Digest, nameOf("junk")), bytes.NewReader([]byte("junk")))
+	assert.Nil(t, err)
+
+	// a dry run only reports
+	report, err := s.CollectGarbage(GCOpts{KeepVersions: 1, Grace: -1, DryRun: true})
+	assert.Nil(t, err)
+	assert.True(t, report.DryRun)
+	assert.ElementsMatch(t, []string{v1.Digest, stray}, report.Objects)
+	assert.Equal(t, int64(len("first")+len("stray bytes")), report.Bytes)
+	assert.Equal(t, 1, report.Chunks)
+	assert.True(t, holds(t, s, v1.Digest))
+	assert.True(t, holds(t, s, stray))
+
+	// objects written within the grace period are kept
+	// by a store opened again after a restart
+	assert.Nil(t, s.Close())
+	s = NewStore(s.StoreOpts)
+	defer s.Close()
+
+	report, err = s.CollectGarbage(GCOpts{KeepVersions: 1})
+	assert.Nil(t, err)
+	assert.Empty(t, report.Objects)
+	assert.Equal(t, 2, report.Kept)
+	assert.Equal(t, 1, report.Chunks)
+
+	report, err = s.CollectGarbage(GCOpts{KeepVersions: 1, Grace: -1})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{v1.Digest, stray}, report.Objects)
+	assert.Equal(t, 0, report.Chunks)
+	assert.NotEmpty(t, report.Dirs)
+
+	assert.False(t, holds(t, s, v1.Digest))
+	assert.False(t, holds(t, s, stray))
+
+	_, err = os.Stat(s.Root + "/" + rootOf(t, stray))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// the latest version stays readable
+	_, r, err := s.ReadVersion("record", 2)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, []byte("second"), b)
+
+	used, err := s.Usage()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len("second")), used)
+
+	// nothing is left to collect
+	report, err = s.CollectGarbage(GCOpts{Grace: -1})
+	assert.Nil(t, err)
+	assert.Empty(t, report.Objects)
+	assert.Empty(t, report.Dirs)
+}
+
+func TestStoreRecover(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Root:              t.TempDir(),
+		ChunkSize:         1024,
+	})
+	defer s.Close()
+
+	data := bytes.Repeat([]byte("some dicom bytes "), 200)
+	digest, _, err := s.Write("study", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	m, err := s.Manifest(digest)
+	assert.Nil(t, err)
+
+	leftover := func(path string) string {
+		path = s.Root + "/" + path
+		assert.Nil(t, os.MkdirAll(path[:strings.LastIndex(path, "/")], os.ModePerm))
+		assert.Nil(t, os.WriteFile(path, []byte("partial"), 0o644))
+		return path
+	}
+
+	// writes interrupted at every step
+	write := leftover(tmpFolder + "/write-123/chunk-456")
+	file := leftover(tmpFolder + "/file-789")
+	name := leftover(namesFolder + "/" + nameOf("study") + ".tmp")
+
+	orphan := nameOf("never committed")
+	orphanChunks, err := s.chunkPrefix(orphan)
+	assert.Nil(t, err)
+	orphanChunks = s.Root + "/" + orphanChunks
+	leftover(chunkKeyOf(t, s, orphan, m.Chunks[0].Digest))
+
+	// a transfer to resume and one given up on
+	partial := nameOf("being received")
+	chunk := leftover(tmpFolder + "/" + partialFolder + "/" + partial + "/" + m.Chunks[0].Digest)
+	temp := leftover(tmpFolder + "/" + partialFolder + "/" + partial + "/chunk-123")
+
+	stale := nameOf("abandoned")
+	leftover(tmpFolder + "/" + partialFolder + "/" + stale + "/" + m.Chunks[0].Digest)
+	old := time.Now().Add(-2 * partialRetention)
+	assert.Nil(t, os.Chtimes(s.partialDir(stale), old, old))
+
+	removed, err := s.Recover()
+	assert.Nil(t, err)
+	assert.Equal(t, 6, removed)
+
+	for _, path := range []string{write, file, name, orphanChunks, temp, s.partialDir(stale)} {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+
+	_, err = os.Stat(chunk)
+	assert.Nil(t, err)
+
+	// committed objects are untouched
+	_, r, err := s.Read("study")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, data, b)
+
+	// nothing is left to recover
+	removed, err = s.Recover()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+}
+
+func TestStoreScrub(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Root:              t.TempDir(),
+		ChunkSize:         1024,
+	})
+	defer s.Close()
+
+	healthy := bytes.Repeat([]byte("some ehr bytes "), 300)
+	_, _, err := s.Write("healthy", bytes.NewReader(healthy))
+	assert.Nil(t, err)
+
+	damaged := bytes.Repeat([]byte("some dicom bytes "), 300)
+	digest, _, err := s.Write("damaged", bytes.NewReader(damaged))
+	assert.Nil(t, err)
+
+	objects, err := s.Objects()
+	assert.Nil(t, err)
+	assert.Len(t, objects, 2)
+
+	// flip a byte of a chunk on disk
+	m, err := s.Manifest(digest)
+	assert.Nil(t, err)
+	path := s.Root + "/" + chunkKeyOf(t, s, digest, m.Chunks[1].Digest)
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	b[10] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, b, 0o644))
+
+	// more than 6 KiB are read at 32 KiB per second
+	scrubber := NewScrubber(ScrubberOpts{Store: s, Rate: 32 * 1024})
+	start := time.Now()
+	scrubber.Scrub(nil)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	stats := scrubber.Stats()
+	assert.Equal(t, uint64(1), stats.Passes)
+	assert.Equal(t, uint64(2), stats.ObjectsScrubbed)
+	assert.Greater(t, stats.BytesScrubbed, uint64(len(healthy)))
+	assert.Equal(t, uint64(1), stats.Corrupt)
+	assert.False(t, stats.LastPass.IsZero())
+
+	// the damaged object is moved aside
+	assert.False(t, holds(t, s, digest))
+	_, err = os.Stat(s.Root + "/" + quarantineFolder + "/" + digest + "/manifest")
+	assert.Nil(t, err)
+
+	_, r, err := s.Read("healthy")
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(r)
+	assert.Equal(t, healthy, b)
+
+	// a healthy copy takes its place again
+	_, _, err = s.Write("damaged", bytes.NewReader(damaged))
+	assert.Nil(t, err)
+
+	scrubber.Scrub(nil)
+	stats = scrubber.Stats()
+	assert.Equal(t, uint64(4), stats.ObjectsScrubbed)
+	assert.Equal(t, uint64(1), stats.Corrupt)
+
+	// objects that cannot be read are failures and stay held
+	blobs := s.Blobs
+	s.Blobs = unreadableBlobs{BlobStore: blobs, prefix: chunksFolder + "/"}
+	scrubber.Scrub(nil)
+	stats = scrubber.Stats()
+	assert.Equal(t, uint64(1), stats.Corrupt)
+	assert.Equal(t, uint64(2), stats.Failures)
+	assert.True(t, holds(t, s, digest))
+
+	// a missing chunk damages the object
+	s.Blobs = blobs
+	m, err = s.Manifest(digest)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Remove(s.Root+"/"+chunkKeyOf(t, s, digest, m.Chunks[0].Digest)))
+	scrubber.Scrub(nil)
+	assert.Equal(t, uint64(2), scrubber.Stats().Corrupt)
+	assert.False(t, holds(t, s, digest))
+}
+
+// blob store failing to look up and open the blobs
+// whose key starts with prefix
+type unreadableBlobs struct {
+	BlobStore
+	prefix string
+}
+
+func (b unreadableBlobs) Has(key string) (bool, error) {
+	if strings.HasPrefix(key, b.prefix) {
+		return false, fmt.Errorf("looking up (%s): backend unavailable", key)
+	}
+	return b.BlobStore.Has(key)
+}
+
+func (b unreadableBlobs) Open(key string) (io.ReadCloser, error) {
+	if strings.HasPrefix(key, b.prefix) {
+		return nil, fmt.Errorf("opening (%s): backend unavailable", key)
+	}
+	return b.BlobStore.Open(key)
 }
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/luqxus/dstore/p2p"
+)
+
+// default time tombstones are kept | nodes offline
+// for longer may resurrect deleted records
+const defaultTombstoneRetention = 30 * 24 * time.Hour
+
+// tombstones and versions dated further ahead of the local
+// clock are refused or dated now
+const maxClockSkew = 5 * time.Minute
+
+// ErrNoKeystore is returned when an operation needs the key
+// of a node that has no keystore or could not unlock it
+var ErrNoKeystore = errors.New("node has no keystore")
+
+// ErrNotDeleter is returned when a tombstone is signed by
+// someone who may not delete the record it covers
+var ErrNotDeleter = errors.New("deleter may not delete record")
+
+// Tombstone records the deletion of a key across the network
+// it is kept for TombstoneRetention so anti-entropy repair
+// does not bring the deleted record back
+type Tombstone struct {
+
+	// hashed key that was deleted
+	Name string
+
+	// content digest the key was mapped to | any if empty
+	Digest string
+
+	// Ethereum address of the deleting node
+	Deleter string
+
+	// why the record was deleted (e.g. GDPR erasure request)
+	Reason string
+
+	// when the record was deleted
+	DeletedAt time.Time
+
+	// deleter signature over the fields above
+	Signature []byte
+}
+
+// MessageDeleteFile propagates a tombstone through the network
+type MessageDeleteFile struct {
+	Tombstone Tombstone
+}
+
+// returns hash of the signed tombstone fields
+func (t Tombstone) hash() []byte {
+	buf := new(bytes.Buffer)
+	for _, field := range []string{t.Name, t.Digest, t.Deleter, t.Reason} {
+		binary.Write(buf, binary.BigEndian, uint32(len(field)))
+		buf.WriteString(field)
+	}
+	binary.Write(buf, binary.BigEndian, t.DeletedAt.UnixNano())
+
+	return ethcrypto.Keccak256(buf.Bytes())
+}
+
+// Verify checks the tombstone was signed by Deleter
+func (t Tombstone) Verify() error {
+	pub, err := ethcrypto.SigToPub(t.hash(), t.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid tombstone signature: %w", err)
+	}
+
+	if !common.IsHexAddress(t.Deleter) || ethcrypto.PubkeyToAddress(*pub) != common.HexToAddress(t.Deleter) {
+		return fmt.Errorf("tombstone of (%s) not signed by deleter (%s)", t.Name, t.Deleter)
+	}
+
+	return nil
+}
+
+// Delete removes the record with key from this node and
+// propagates a tombstone signed by this node to the network
+// returns Tombstone | error
+func (s *FileServer) Delete(key string, reason string) (Tombstone, error) {
+	priv := s.key
+	if priv == nil {
+		return Tombstone{}, ErrNoKeystore
+	}
+
+	// content is unknown if the key is not stored locally
+	digest, _ := s.store.Resolve(key)
+
+	t := Tombstone{
+		Name:      nameOf(key),
+		Digest:    digest,
+		Deleter:   ethcrypto.PubkeyToAddress(priv.PublicKey).Hex(),
+		Reason:    reason,
+		DeletedAt: time.Now(),
+	}
+
+	sig, err := ethcrypto.Sign(t.hash(), priv)
+	if err != nil {
+		return Tombstone{}, err
+	}
+	t.Signature = sig
+
+	if _, err := s.applyTombstone("", t); err != nil {
+		return Tombstone{}, err
+	}
+
+	// send tombstone to all connected peers
+	return t, s.broadcast(&Message{
+		Payload: MessageDeleteFile{Tombstone: t},
+	})
+}
+
+// verify tombstone relayed by the peer with address from and
+// delete the record it covers | from is empty for deletions of this node
+// returns false if the tombstone was applied before or
+// the key was written again after its deletion
+func (s *FileServer) applyTombstone(from string, t Tombstone) (bool, error) {
+	if err := t.Verify(); err != nil {
+		return false, err
+	}
+
+	if t.DeletedAt.After(time.Now().Add(maxClockSkew)) {
+		return false, fmt.Errorf("tombstone of (%s) dated in the future (%s)", t.Name, t.DeletedAt)
+	}
+
+	if err := s.authorizeTombstone(from, t); err != nil {
+		return false, err
+	}
+
+	if known, ok := s.store.Tombstone(t.Name); ok && !known.DeletedAt.Before(t.DeletedAt) {
+		return false, nil
+	}
+
+	digest, err := s.store.ResolveName(t.Name)
+	if err == nil {
+		// the key maps to other content than the one deleted
+		if len(t.Digest) != 0 && t.Digest != digest {
+			return false, nil
+		}
+
+		deleted, err := s.store.DeleteName(t.Name, t.DeletedAt)
+		if err != nil {
+			return false, err
+		}
+		if !deleted {
+			return false, nil
+		}
+	} else if _, err := s.store.DeleteShards(t.Name, t.DeletedAt); err != nil {
+		// erasure coded records are not mapped to content
+		return false, err
+	}
+
+	if err := s.store.PutTombstone(t); err != nil {
+		return false, err
+	}
+
+	if len(digest) == 0 {
+		digest = t.Digest
+	}
+
+	// erase content no other key maps to
+	if len(digest) != 0 {
+		if err := s.store.DeleteDigest(digest); err != nil {
+			return true, err
+		}
+	}
+
+	fmt.Printf("deleted [%s] from disk: %s\n", t.Name, t.Reason)
+
+	return true, nil
+}
+
+// check that the deleter of t may delete the record it covers
+// records are deleted by their owner or by nodes whose identity
+// was proven to this node on connecting | the relaying peer or an
+// announced node | tombstones of this node are trusted
+func (s *FileServer) authorizeTombstone(from string, t Tombstone) error {
+	if len(from) == 0 {
+		return nil
+	}
+
+	deleter := common.HexToAddress(t.Deleter)
+
+	meta, err := s.store.MetadataName(t.Name)
+	if err != nil && !errors.Is(err, ErrNoMetadata) {
+		return err
+	}
+	if common.IsHexAddress(meta.Owner) && common.HexToAddress(meta.Owner) == deleter {
+		return nil
+	}
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if peer, ok := s.peers[from]; ok && provenAs(peer, deleter) {
+		return nil
+	}
+
+	for addr, node := range s.nodes {
+		if common.IsHexAddress(node.ID) && common.HexToAddress(node.ID) == deleter && provenAs(s.peers[addr], deleter) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: (%s) deleting (%s)", ErrNotDeleter, t.Deleter, t.Name)
+}
+
+// reports whether peer proved to hold the key of address
+func provenAs(peer p2p.Peer, address common.Address) bool {
+	if peer == nil {
+		return false
+	}
+	id := peer.Identity()
+	return common.IsHexAddress(id) && common.HexToAddress(id) == address
+}
+
+// reports whether the mapping of name to digest was deleted
+func (s *FileServer) tombstoned(name string, digest string) (Tombstone, bool) {
+	t, ok := s.store.Tombstone(name)
+	if !ok || (len(t.Digest) != 0 && t.Digest != digest) {
+		return Tombstone{}, false
+	}
+	return t, true
+}
+
+// remove tombstones older than TombstoneRetention
+func (s *FileServer) purgeTombstones() {
+	n, err := s.store.PurgeTombstones(time.Now().Add(-s.TombstoneRetention))
+	if err != nil {
+		log.Printf("purging tombstones: %s", err)
+		return
+	}
+
+	if n != 0 {
+		log.Printf("purged (%d) tombstones", n)
+	}
+}
+
+// handle MessageDeleteFile message from peer
+// applies the tombstone and passes it on to the other peers
+func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
+	applied, err := s.applyTombstone(from, msg.Tombstone)
+	if err != nil || !applied {
+		return err
+	}
+
+	peers := []p2p.Peer{}
+	for _, peer := range s.connectedPeers() {
+		if peer.RemoteAddr().String() != from {
+			peers = append(peers, peer)
+		}
+	}
+
+	return s.multicast(&Message{Payload: msg}, peers)
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/luqxus/dstore/p2p"
+)
+
+// MessageStoreFile exchanges needed before a peer gives up
+// storing a file | the first round sends the missing chunks
+// and the second one stores the file
+const maxStoreRounds = 3
+
+// MessagePutChunk tells the receiver that a chunk of a file
+// it was asked to store is sent on stream StreamID
+type MessagePutChunk struct {
+
+	// SHA-256 digest of the file the chunk belongs to
+	Digest string
+
+	// chunk sent
+	Chunk Chunk
+
+	// compression the chunk is sent and stored with
+	// the compression of the manifest of the file
+	Compression string
+
+	// bytes sent on the stream
+	Size int64
+
+	// stream the chunk is sent on
+	StreamID uint64
+}
+
+// MessagePutChunkReply answers MessagePutChunk once the chunk is on disk
+type MessagePutChunkReply struct {
+
+	// reason the chunk was rejected | empty on success
+	Error string
+}
+
+// MessageGetChunk asks the receiver for a chunk of a file
+type MessageGetChunk struct {
+
+	// SHA-256 digest of the file the chunk belongs to
+	Digest string
+
+	// SHA-256 digest of the chunk
+	Chunk string
+}
+
+// MessageChunkReply answers MessageGetChunk
+// if Status is ReplyFound the chunk is sent on stream StreamID
+type MessageChunkReply struct {
+
+	// how the request was handled
+	Status ReplyStatus
+
+	// size of the streamed chunk
+	Size int64
+
+	// compression the streamed chunk is stored with by the sender
+	Compression string
+
+	// stream the chunk is sent on
+	StreamID uint64
+}
+
+// TransferStats counts the chunks moved between peers
+type TransferStats struct {
+
+	// chunks served to peers
+	ChunksSent uint64
+
+	// chunks received from peers
+	ChunksReceived uint64
+
+	// bytes streamed to and from peers
+	// chunks travel compressed as they are stored
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// transfer counters updated concurrently
+type transferMetrics struct {
+	sent          atomic.Uint64
+	received      atomic.Uint64
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+}
+
+// TransferStats returns the chunk transfer metrics
+func (s *FileServer) TransferStats() TransferStats {
+	return TransferStats{
+		ChunksSent:     s.transfers.sent.Load(),
+		ChunksReceived: s.transfers.received.Load(),
+		BytesSent:      s.transfers.bytesSent.Load(),
+		BytesReceived:  s.transfers.bytesReceived.Load(),
+	}
+}
+
+// send MessageStoreFile msg to peer and wait for its reply
+// returns indexes of the chunks the peer is missing | error
+func (s *FileServer) storeRequest(peer p2p.Peer, msg MessageStoreFile) ([]int, error) {
+	// the peer hashes the whole file before it replies
+	timeout := s.RequestTimeout * time.Duration(1+len(msg.Manifest.Chunks))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	r, err := s.request(ctx, peer, msg)
+	if err != nil {
+		return nil, fmt.Errorf("storing (%s) on peer (%s): %w", msg.Digest, peer.RemoteAddr(), err)
+	}
+
+	reply, ok := r.(MessageStoreFileReply)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %T from (%s)", r, peer.RemoteAddr())
+	}
+
+	if err := reply.Rejected.err(); err != nil {
+		return nil, fmt.Errorf("storing (%s) on peer (%s): %w: %s", msg.Digest, peer.RemoteAddr(), err, reply.Error)
+	}
+
+	if len(reply.Error) != 0 {
+		return nil, fmt.Errorf("storing (%s) on peer (%s): %s", msg.Digest, peer.RemoteAddr(), reply.Error)
+	}
+
+	return reply.Missing, nil
+}
+
+// send chunk c of the file described by m to peer on a new stream
+// and wait until the peer wrote it to disk
+// the chunk is sent compressed as it is stored
+// returns error
+func (s *FileServer) sendChunk(peer p2p.Peer, m Manifest, c Chunk) error {
+	n, r, err := s.store.ReadChunk(m.Digest, c.Digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	stream, err := peer.OpenStream()
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		ID: newRequestID(),
+		Payload: MessagePutChunk{
+			Digest:      m.Digest,
+			Chunk:       c,
+			Compression: m.Compression,
+			Size:        n,
+			StreamID:    stream.ID(),
+		},
+	}
+
+	replies := s.addPending(msg.ID, 1)
+	defer s.finishPending(msg.ID, replies)
+
+	if err := s.send(peer, &msg); err != nil {
+		stream.Reset()
+		return err
+	}
+
+	// send stream
+	written, err := io.Copy(stream, r)
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+
+	if err := stream.Close(); err != nil {
+		return err
+	}
+
+	select {
+	case rep := <-replies:
+		reply, ok := rep.payload.(MessagePutChunkReply)
+		if !ok {
+			return fmt.Errorf("unexpected reply %T from (%s)", rep.payload, rep.from)
+		}
+
+		if len(reply.Error) != 0 {
+			return fmt.Errorf("peer (%s) rejected chunk (%s): %s", rep.from, c.Digest, reply.Error)
+		}
+
+	case <-time.After(s.RequestTimeout):
+		return fmt.Errorf("peer (%s) did not acknowledge chunk (%s)", peer.RemoteAddr(), c.Digest)
+	}
+
+	s.transfers.sent.Add(1)
+	s.transfers.bytesSent.Add(uint64(written))
+
+	return nil
+}
+
+// result of fetching one chunk
+type chunkResult struct {
+
+	// index of the chunk in the manifest
+	index int
+
+	// peer asked for the chunk
+	from string
+
+	err error
+}
+
+// download the chunks of m missing on disk from the peers sent on holders
+// every holder fetches chunks one after the other so chunks are
+// fetched in parallel from all holders
+// chunks of an interrupted download are kept so the next one resumes
+// returns error once every holder failed and holders is closed
+func (s *FileServer) download(m Manifest, holders <-chan string) error {
+	missing, err := s.store.MissingChunks(m)
+	if err != nil {
+		return err
+	}
+
+	// chunks left to fetch | an index is either queued
+	// or being fetched by exactly one holder
+	queue := make(chan int, len(missing))
+	for _, i := range missing {
+		queue <- i
+	}
+
+	results := make(chan chunkResult)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	workers := 0
+	for remaining := len(missing); remaining > 0; {
+		select {
+		case from, ok := <-holders:
+			if !ok {
+				holders = nil
+				break
+			}
+
+			workers++
+			go s.fetchChunks(from, m, queue, results, stop)
+
+		case r := <-results:
+			if r.err == nil {
+				remaining--
+				break
+			}
+
+			// another holder fetches the chunk
+			log.Printf("fetching chunk %d of (%s) from peer (%s): %s", r.index, m.Digest, r.from, r.err)
+			queue <- r.index
+			workers--
+		}
+
+		if workers == 0 && holders == nil && remaining > 0 {
+			return fmt.Errorf("%w: %d chunks of (%s) unavailable", ErrFileNotFound, remaining, m.Digest)
+		}
+	}
+
+	return nil
+}
+
+// fetch chunks of m taken from queue from peer from until
+// stop is closed or a chunk fails
+func (s *FileServer) fetchChunks(from string, m Manifest, queue chan int, results chan<- chunkResult, stop <-chan struct{}) {
+	for {
+		select {
+		case i := <-queue:
+			err := s.fetchChunk(from, m, m.Chunks[i])
+			results <- chunkResult{index: i, from: from, err: err}
+
+			// a failing holder leaves its chunks to the others
+			if err != nil {
+				return
+			}
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+// fetch chunk c of the file described by m from peer from
+// and write it to local network storage
+// returns error
+func (s *FileServer) fetchChunk(from string, m Manifest, c Chunk) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	r, err := s.request(ctx, peer, MessageGetChunk{Digest: m.Digest, Chunk: c.Digest})
+	if err != nil {
+		return err
+	}
+
+	reply, ok := r.(MessageChunkReply)
+	if !ok {
+		return fmt.Errorf("unexpected reply %T from (%s)", r, from)
+	}
+
+	if reply.Status != ReplyFound {
+		return fmt.Errorf("peer (%s) does not have chunk (%s)", from, c.Digest)
+	}
+
+	stream, err := peer.Stream(reply.StreamID)
+	if err != nil {
+		return err
+	}
+
+	// close read stream
+	defer stream.Close()
+
+	// the peer may store the file with another compression
+	// than the manifest fetched lists
+	body, err := recompress(io.LimitReader(stream, reply.Size), reply.Compression, m.Compression)
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+
+	// the chunk must hash to the digest listed in the manifest
+	if err := s.store.WriteChunk(m.Digest, c, m.Compression, body); err != nil {
+		stream.Reset()
+		return err
+	}
+
+	s.transfers.received.Add(1)
+	s.transfers.bytesReceived.Add(uint64(reply.Size))
+
+	return nil
+}
+
+// handle MessageStoreFileReply message from peer
+func (s *FileServer) handleMessageStoreFileReply(from string, id string, msg MessageStoreFileReply) error {
+	if !s.deliverReply(from, id, msg) {
+		return fmt.Errorf("reply (%s) from peer (%s) to unknown request", id, from)
+	}
+	return nil
+}
+
+// handle MessagePutChunk message from peer
+// writes the chunk sent on the stream and acknowledges it
+func (s *FileServer) handleMessagePutChunk(from string, id string, msg MessagePutChunk) error {
+	// check if the sender peer is in peers map
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	// chunk is sent on its own stream
+	stream, err := peer.Stream(msg.StreamID)
+	if err != nil {
+		return err
+	}
+
+	// read chunk without blocking the read loop
+	go func() {
+		// close stream on done
+		defer stream.Close()
+
+		reply := MessagePutChunkReply{}
+
+		// chunks are only taken for objects room was set aside for
+		// when the peer announced them | rejecting content that
+		// does not match the announced digest
+		var err error
+		if !s.store.Reserved(msg.Digest) {
+			err = fmt.Errorf("%w: no room reserved for (%s)", ErrCapacityExceeded, msg.Digest)
+		} else {
+			err = s.store.WriteChunk(msg.Digest, msg.Chunk, msg.Compression, io.LimitReader(stream, msg.Size))
+		}
+		if err != nil {
+			log.Printf("writing chunk from peer (%s): %s", from, err)
+			stream.Reset()
+			reply.Error = err.Error()
+		} else {
+			s.transfers.received.Add(1)
+			s.transfers.bytesReceived.Add(uint64(msg.Size))
+		}
+
+		if err := s.send(peer, &Message{ID: id, Payload: reply}); err != nil {
+			log.Printf("replying to peer (%s): %s", from, err)
+		}
+	}()
+
+	return nil
+}
+
+// handle MessagePutChunkReply message from peer
+func (s *FileServer) handleMessagePutChunkReply(from string, id string, msg MessagePutChunkReply) error {
+	if !s.deliverReply(from, id, msg) {
+		return fmt.Errorf("reply (%s) from peer (%s) to unknown request", id, from)
+	}
+	return nil
+}
+
+// handle MessageGetChunk message from peer
+// streams the chunk if it is held on disk
+func (s *FileServer) handleMessageGetChunk(from string, id string, msg MessageGetChunk) error {
+	// check if peer if in peers map
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	n, r, err := s.store.ReadChunk(msg.Digest, msg.Chunk)
+	if err != nil {
+		return s.send(peer, &Message{
+			ID:      id,
+			Payload: MessageChunkReply{Status: ReplyNotFound},
+		})
+	}
+
+	// the chunk is sent compressed as it is stored
+	m, err := s.store.Manifest(msg.Digest)
+	if err != nil {
+		r.Close()
+		return s.send(peer, &Message{
+			ID:      id,
+			Payload: MessageChunkReply{Status: ReplyNotFound},
+		})
+	}
+
+	// open stream the chunk is sent on
+	stream, err := peer.OpenStream()
+	if err != nil {
+		r.Close()
+		return err
+	}
+
+	// announce chunk size and stream to peer
+	err = s.send(peer, &Message{
+		ID: id,
+		Payload: MessageChunkReply{
+			Status:      ReplyFound,
+			Size:        n,
+			Compression: m.Compression,
+			StreamID:    stream.ID(),
+		},
+	})
+	if err != nil {
+		r.Close()
+		stream.Reset()
+		return err
+	}
+
+	// write chunk to peer without blocking the read loop
+	go func() {
+		defer r.Close()
+
+		written, err := io.Copy(stream, r)
+		if err != nil {
+			// on error writing chunk
+			log.Printf("writing chunk to peer (%s): %s", from, err)
+			stream.Reset()
+			return
+		}
+
+		s.transfers.sent.Add(1)
+		s.transfers.bytesSent.Add(uint64(written))
+		stream.Close()
+	}()
+
+	return nil
+}
+
+// handle MessageChunkReply message from peer
+// delivers reply to the request waiting for it
+func (s *FileServer) handleMessageChunkReply(from string, id string, msg MessageChunkReply) error {
+	if s.deliverReply(from, id, msg) {
+		return nil
+	}
+
+	// request is no longer waiting | abort the chunk stream
+	if msg.Status == ReplyFound {
+		s.resetStream(from, msg.StreamID)
+	}
+
+	return fmt.Errorf("reply (%s) from peer (%s) to unknown request", id, from)
+}
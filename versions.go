@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"time"
+)
+
+// ErrNoVersion is returned when a record has no version with the asked number
+var ErrNoVersion = errors.New("version not found")
+
+// MessageGetHistory asks the receiver for the versions of Key it knows
+type MessageGetHistory struct {
+
+	// record key
+	Key string
+}
+
+// MessageHistoryReply answers MessageGetHistory
+type MessageHistoryReply struct {
+
+	// versions of the record oldest first | empty if unknown
+	Versions []Metadata
+}
+
+// History returns the versions of the record with key oldest first
+// peers are asked when this node does not know the record
+// or only holds the versions written after it became a replica
+// returns []Metadata | ErrFileNotFound if no node knows the record
+func (s *FileServer) History(key string) ([]Metadata, error) {
+	versions, err := s.store.Versions(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// a replica may only hold the versions written after it joined
+	if len(versions) != 0 && versions[0].Version == 1 {
+		return versions, nil
+	}
+
+	peers := s.connectedPeers()
+	if len(peers) == 0 {
+		if len(versions) != 0 {
+			return versions, nil
+		}
+		return nil, ErrFileNotFound
+	}
+
+	msg := Message{
+		ID:      newRequestID(),
+		Payload: MessageGetHistory{Key: key},
+	}
+
+	// every peer answers the request exactly once
+	asked := len(peers)
+
+	replies := s.addPending(msg.ID, asked)
+	defer s.finishPending(msg.ID, replies)
+
+	if err := s.multicast(&msg, peers); err != nil {
+		return nil, err
+	}
+
+	timeout := time.After(s.RequestTimeout)
+
+	// the longest history agreeing with the local one
+	// is the most up to date one
+	var longest []Metadata
+wait:
+	for ; asked > 0; asked-- {
+		select {
+		case r := <-replies:
+			msg, ok := r.payload.(MessageHistoryReply)
+			if !ok || len(msg.Versions) <= len(longest) {
+				continue
+			}
+			if err := checkHistory(key, msg.Versions, versions); err != nil {
+				log.Printf("history of (%s) from peer (%s): %s", key, r.from, err)
+				continue
+			}
+			longest = msg.Versions
+		case <-timeout:
+			break wait
+		}
+	}
+
+	versions = mergeHistory(versions, longest)
+	if len(versions) == 0 {
+		return nil, ErrFileNotFound
+	}
+
+	return versions, nil
+}
+
+// check that versions sent by a peer are a history of key
+// numbered without gaps | every version naming the one before
+// as its parent | and agreeing with the versions held locally
+func checkHistory(key string, versions []Metadata, local []Metadata) error {
+	held := make(map[int]Metadata, len(local))
+	for _, v := range local {
+		held[v.Version] = v
+	}
+
+	for i, v := range versions {
+		if v.Key != key || v.Version < 1 || !isSHA256Hex(v.Digest) {
+			return fmt.Errorf("invalid version (%d) of (%s)", v.Version, v.Key)
+		}
+
+		if i > 0 {
+			prev := versions[i-1]
+			if v.Version != prev.Version+1 || v.Parent != prev.Digest {
+				return fmt.Errorf("version (%d) does not follow version (%d)", v.Version, prev.Version)
+			}
+		}
+
+		if h, ok := held[v.Version]; ok && (h.Digest != v.Digest || h.Parent != v.Parent) {
+			return fmt.Errorf("%w: version (%d) is (%s) not (%s)", ErrVersionConflict, v.Version, h.Digest, v.Digest)
+		}
+	}
+
+	return nil
+}
+
+// returns the versions of local and remote oldest first
+// the local copy of a version held by both is kept
+func mergeHistory(local []Metadata, remote []Metadata) []Metadata {
+	byVersion := make(map[int]Metadata, len(local)+len(remote))
+	for _, v := range remote {
+		byVersion[v.Version] = v
+	}
+	for _, v := range local {
+		byVersion[v.Version] = v
+	}
+
+	versions := make([]Metadata, 0, len(byVersion))
+	for _, v := range byVersion {
+		versions = append(versions, v)
+	}
+	slices.SortFunc(versions, func(a, b Metadata) int {
+		return a.Version - b.Version
+	})
+
+	return versions
+}
+
+// GetVersion reads version of the record with key
+// fetching its content from the network if it is not held locally
+// the caller must close the returned reader
+// returns file size (int64) | file reader (io.ReadCloser) | error
+func (s *FileServer) GetVersion(key string, version int) (int64, io.ReadCloser, error) {
+	meta, err := s.fetchVersion(key, version)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return s.openDigest(meta.Digest)
+}
+
+// OpenVersion opens version of the record with key for reading and seeking
+// fetching its content from the network if it is not held locally
+// the caller must close the returned file
+// returns file (io.ReadSeekCloser) | metadata of the version (Metadata) | error
+func (s *FileServer) OpenVersion(key string, version int) (io.ReadSeekCloser, Metadata, error) {
+	meta, err := s.fetchVersion(key, version)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	f, err := s.openSeeker(meta.Digest)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return f, meta, nil
+}
+
+// fetch version of the record with key from the network
+// unless its content is held locally
+// returns Metadata of the version | error
+func (s *FileServer) fetchVersion(key string, version int) (Metadata, error) {
+	versions, err := s.History(key)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	var meta Metadata
+	for _, v := range versions {
+		if v.Version == version {
+			meta = v
+			break
+		}
+	}
+
+	if meta.Version == 0 {
+		return Metadata{}, fmt.Errorf("%w: %s version %d", ErrNoVersion, key, version)
+	}
+
+	held, err := s.store.HasDigest(meta.Digest)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if held {
+		return meta, nil
+	}
+
+	if meta.Erasure != nil {
+		return meta, s.rebuild(meta)
+	}
+
+	fmt.Printf("version (%d) of (%s) not found locally, searching on network...\n", version, key)
+
+	// versions are immutable so any copy of the digest will do
+	// the content is not mapped to the key | the latest version is
+	if err := s.fetchDigest(meta.Digest); err != nil {
+		return Metadata{}, err
+	}
+
+	return meta, nil
+}
+
+// handle MessageGetHistory message from peer
+func (s *FileServer) handleMessageGetHistory(from string, id string, msg MessageGetHistory) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	versions, err := s.store.Versions(msg.Key)
+	if err != nil {
+		log.Printf("reading history of (%s): %s", msg.Key, err)
+	}
+
+	return s.send(peer, &Message{
+		ID:      id,
+		Payload: MessageHistoryReply{Versions: versions},
+	})
+}
+
+// handle MessageHistoryReply message from peer
+func (s *FileServer) handleMessageHistoryReply(from string, id string, msg MessageHistoryReply) error {
+	if !s.deliverReply(from, id, msg) {
+		return fmt.Errorf("reply (%s) from peer (%s) to unknown request", id, from)
+	}
+	return nil
+}